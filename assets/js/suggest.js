@@ -0,0 +1,48 @@
+// Fill in <datalist>s with suggestions from /api/suggest as the user types
+// The tags input holds a comma-separated list, so only the last tag is completed
+function suggest(input, list, complete) {
+    var timer;
+    input.addEventListener('input', function () {
+        clearTimeout(timer);
+        timer = setTimeout(function () {
+            var parts = input.value.split(',');
+            var q = parts.pop().trim();
+            var prefix = parts.length ? parts.join(',') + ', ' : '';
+            if (q === '') {
+                list.innerHTML = '';
+                return;
+            }
+            fetch('/api/suggest?q=' + encodeURIComponent(q))
+            .then(function(response) {
+                if(response.ok) {
+                    return response.json();
+                }
+                throw new Error('Network response was not ok.');
+            })
+            .then((suggestions) => {
+                list.innerHTML = '';
+                complete(suggestions).forEach(function (value) {
+                    var option = document.createElement('option');
+                    option.value = prefix + value;
+                    list.appendChild(option);
+                });
+            })
+            .catch(error => console.error('Error:', error));
+        }, 200);
+    });
+}
+
+document.addEventListener('DOMContentLoaded', function () {
+    var search = document.querySelector('input#searchwiki');
+    var searchList = document.getElementById('searchwiki-suggestions');
+    if (search && searchList) {
+        suggest(search, searchList, function (s) {
+            return s.pages.map(function (p) { return p.name; });
+        });
+    }
+    var tags = document.querySelector('input#tags');
+    var tagsList = document.getElementById('tags-suggestions');
+    if (tags && tagsList) {
+        suggest(tags, tagsList, function (s) { return s.tags; });
+    }
+});
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~aqtrans/gowiki/render"
+	log "github.com/sirupsen/logrus"
+)
+
+// pageLinks returns the paths within the wiki a page links to and the images it shows, without a leading slash
+// Relative links are taken from the page's directory, as the browser would
+func pageLinks(name string, content []byte) (links, images []string) {
+	dests, imageDests := render.Links(content)
+	return wikiPaths(name, dests), wikiPaths(name, imageDests)
+}
+
+// wikiPaths turns link destinations into paths within the wiki, dropping duplicates and anything pointing elsewhere
+func wikiPaths(name string, dests []string) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, dest := range dests {
+		u, err := url.Parse(dest)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+			continue
+		}
+		p := u.Path
+		if !strings.HasPrefix(p, "/") {
+			p = path.Join("/", path.Dir(name), p)
+		}
+		p = strings.TrimPrefix(path.Clean(p), "/")
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// addLinks records the pages a page links to and the images it shows
+func (c *wikiCache) addLinks(filename string, links, images []string) {
+	if len(links) != 0 {
+		c.Links[filename] = links
+	}
+	if len(images) != 0 {
+		c.Images[filename] = images
+	}
+}
+
+// indexBacklinks lists the pages linking to each page, from Links
+func (c *wikiCache) indexBacklinks() {
+	c.backlinks = make(map[string][]string)
+	for from, links := range c.Links {
+		linked := make(map[string]bool)
+		for _, link := range links {
+			to, exists := c.resolve(link)
+			if !exists || to == from || linked[to] {
+				continue
+			}
+			linked[to] = true
+			c.backlinks[to] = append(c.backlinks[to], from)
+		}
+	}
+	for _, from := range c.backlinks {
+		sort.Strings(from)
+	}
+}
+
+// listedBacklinks returns the pages linking to the given page, leaving out any the user is not allowed to see
+func (c wikiCache) listedBacklinks(name string, isLoggedIn, isAdmin bool) []string {
+	var listed []string
+	for _, from := range c.backlinks[name] {
+		if permissionListed(c.names[from], isLoggedIn, isAdmin) {
+			listed = append(listed, from)
+		}
+	}
+	return listed
+}
+
+type backlinks struct {
+	Name      string   `json:"name"`
+	Backlinks []string `json:"backlinks"`
+}
+
+// backlinksHandler lists the pages linking to a page as JSON
+func (env *wikiEnv) backlinksHandler(w http.ResponseWriter, r *http.Request) {
+	name := nameFromContext(r.Context())
+	user := env.authState.GetUser(r)
+	theCache := env.loadCache()
+
+	b := backlinks{
+		Name:      name,
+		Backlinks: theCache.listedBacklinks(name, env.authState.IsLoggedIn(r), user.IsAdmin()),
+	}
+	if b.Backlinks == nil {
+		b.Backlinks = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(b)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"page":  name,
+			"error": err,
+		}).Errorln("Error encoding backlinks")
+	}
+}
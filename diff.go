@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+const (
+	diffContext = "ctx"
+	diffAdd     = "add"
+	diffDel     = "del"
+
+	// Number of unchanged lines shown around each change
+	diffContextLines = 3
+)
+
+// diffLine is a single line of a line-based diff between two texts
+// OldNum and NewNum are the line numbers on each side, or 0 if the line is not on that side
+// Segments is set on changed lines paired with a counterpart, to highlight the words that differ
+type diffLine struct {
+	Type     string
+	Text     string
+	OldNum   int
+	NewNum   int
+	Segments []diffSegment
+}
+
+// diffSegment is part of a changed line; Changed is set if it differs from the paired line
+type diffSegment struct {
+	Text    string
+	Changed bool
+}
+
+// diffHunk is a group of changed lines, with some unchanged lines around them
+type diffHunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []diffLine
+}
+
+// diffRow is a line of a side-by-side diff; either side is nil where there is no line
+type diffRow struct {
+	Left  *diffLine
+	Right *diffLine
+}
+
+// Prefix returns the unified diff marker for the line
+func (d diffLine) Prefix() string {
+	switch d.Type {
+	case diffAdd:
+		return "+"
+	case diffDel:
+		return "-"
+	}
+	return " "
+}
+
+// splitLines splits text into lines, keeping the trailing newline on each line
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a line-based diff from a to b
+func diffLines(a, b string) []diffLine {
+	dmp := diffmatchpatch.New()
+	dmp.DiffTimeout = 0
+	ar, br, lineArray := dmp.DiffLinesToRunes(a, b)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMainRunes(ar, br, false), lineArray)
+
+	var lines []diffLine
+	for _, d := range diffs {
+		var t string
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			t = diffAdd
+		case diffmatchpatch.DiffDelete:
+			t = diffDel
+		default:
+			t = diffContext
+		}
+		for _, l := range splitLines(d.Text) {
+			lines = append(lines, diffLine{
+				Type: t,
+				Text: strings.TrimSuffix(l, "\n"),
+			})
+		}
+	}
+	return lines
+}
+
+// fileDiff computes the hunks of a unified diff from a to b, with word-level highlighting
+func fileDiff(a, b string) []diffHunk {
+	lines := diffLines(a, b)
+
+	// Number the lines on each side, keeping track of how many came before each line
+	oldBefore := make([]int, len(lines))
+	newBefore := make([]int, len(lines))
+	oldNum, newNum := 0, 0
+	var changes []int
+	for i := range lines {
+		oldBefore[i], newBefore[i] = oldNum, newNum
+		if lines[i].Type != diffAdd {
+			oldNum++
+			lines[i].OldNum = oldNum
+		}
+		if lines[i].Type != diffDel {
+			newNum++
+			lines[i].NewNum = newNum
+		}
+		if lines[i].Type != diffContext {
+			changes = append(changes, i)
+		}
+	}
+	highlightWords(lines)
+
+	var hunks []diffHunk
+	for i := 0; i < len(changes); {
+		start := changes[i] - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := changes[i] + diffContextLines + 1
+		// Merge changes whose context would overlap or touch
+		for i++; i < len(changes) && changes[i]-diffContextLines <= end; i++ {
+			end = changes[i] + diffContextLines + 1
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		h := diffHunk{
+			OldStart: oldBefore[start] + 1,
+			NewStart: newBefore[start] + 1,
+			Lines:    lines[start:end],
+		}
+		for _, l := range h.Lines {
+			if l.Type != diffAdd {
+				h.OldLines++
+			}
+			if l.Type != diffDel {
+				h.NewLines++
+			}
+		}
+		// Like diff(1), an empty side starts at the line before the hunk
+		if h.OldLines == 0 {
+			h.OldStart--
+		}
+		if h.NewLines == 0 {
+			h.NewStart--
+		}
+		hunks = append(hunks, h)
+	}
+	return hunks
+}
+
+// Header returns the unified diff hunk header, e.g. @@ -1,4 +1,5 @@
+func (h diffHunk) Header() string {
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", h.OldStart, h.OldLines, h.NewStart, h.NewLines)
+}
+
+// Rows lays the hunk out side by side, pairing removed lines with the lines added in their place
+func (h diffHunk) Rows() []diffRow {
+	var rows []diffRow
+	for i := 0; i < len(h.Lines); {
+		if h.Lines[i].Type == diffContext {
+			rows = append(rows, diffRow{Left: &h.Lines[i], Right: &h.Lines[i]})
+			i++
+			continue
+		}
+		var dels, adds []*diffLine
+		for ; i < len(h.Lines) && h.Lines[i].Type == diffDel; i++ {
+			dels = append(dels, &h.Lines[i])
+		}
+		for ; i < len(h.Lines) && h.Lines[i].Type == diffAdd; i++ {
+			adds = append(adds, &h.Lines[i])
+		}
+		for j := 0; j < len(dels) || j < len(adds); j++ {
+			var row diffRow
+			if j < len(dels) {
+				row.Left = dels[j]
+			}
+			if j < len(adds) {
+				row.Right = adds[j]
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// highlightWords pairs up removed lines with the lines added right after them,
+// and marks the words that differ between each pair
+func highlightWords(lines []diffLine) {
+	for i := 0; i < len(lines); {
+		if lines[i].Type != diffDel {
+			i++
+			continue
+		}
+		delStart := i
+		for i < len(lines) && lines[i].Type == diffDel {
+			i++
+		}
+		addStart := i
+		for i < len(lines) && lines[i].Type == diffAdd {
+			i++
+		}
+		for j := 0; delStart+j < addStart && addStart+j < i; j++ {
+			del, add := &lines[delStart+j], &lines[addStart+j]
+			del.Segments, add.Segments = wordDiff(del.Text, add.Text)
+		}
+	}
+}
+
+var wordPattern = regexp.MustCompile(`\w+|\s+|[^\w\s]`)
+
+// wordDiff diffs two lines word by word, returning the segments of each
+func wordDiff(a, b string) (left, right []diffSegment) {
+	// Map each distinct word to a rune, so the words can be diffed like characters
+	// The same approach as diffmatchpatch's DiffLinesToRunes
+	var words []string
+	wordRunes := make(map[string]rune)
+	toRunes := func(text string) []rune {
+		var runes []rune
+		for _, word := range wordPattern.FindAllString(text, -1) {
+			r, ok := wordRunes[word]
+			if !ok {
+				r = rune(len(words))
+				words = append(words, word)
+				wordRunes[word] = r
+			}
+			runes = append(runes, r)
+		}
+		return runes
+	}
+	aRunes, bRunes := toRunes(a), toRunes(b)
+	// Stay clear of the surrogate range, which does not survive conversion to a string
+	if len(words) >= 0xD800 {
+		return []diffSegment{{Text: a, Changed: true}}, []diffSegment{{Text: b, Changed: true}}
+	}
+
+	dmp := diffmatchpatch.New()
+	dmp.DiffTimeout = 0
+	for _, d := range dmp.DiffMainRunes(aRunes, bRunes, false) {
+		var text strings.Builder
+		for _, r := range d.Text {
+			text.WriteString(words[r])
+		}
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			left = appendSegment(left, text.String(), false)
+			right = appendSegment(right, text.String(), false)
+		case diffmatchpatch.DiffDelete:
+			left = appendSegment(left, text.String(), true)
+		case diffmatchpatch.DiffInsert:
+			right = appendSegment(right, text.String(), true)
+		}
+	}
+	return left, right
+}
+
+// appendSegment adds text to segments, merging it into the last segment if both are (un)changed
+func appendSegment(segments []diffSegment, text string, changed bool) []diffSegment {
+	if n := len(segments); n > 0 && segments[n-1].Changed == changed {
+		segments[n-1].Text += text
+		return segments
+	}
+	return append(segments, diffSegment{Text: text, Changed: changed})
+}
+
+// fileAtRevision returns a page's content at a revision, or "" if the page did not exist then
+// Revisions from before the page was moved are read from where it was at the time; see revisionPath
+func (env *wikiEnv) fileAtRevision(name, revision string) (string, error) {
+	content, err := env.store.FileAt(env.revisionPath(name, revision), revision)
+	if err != nil {
+		if env.store.RevisionExists(revision) {
+			return "", nil
+		}
+		return "", errBadRevision
+	}
+	return string(content), nil
+}
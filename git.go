@@ -2,34 +2,46 @@ package main
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
-	"html/template"
 	"os"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// execStore is the Store running the git binary for everything except reading and writing files
+type execStore struct {
+	worktree
+	cfg config
+}
+
+func newExecStore(cfg config) *execStore {
+	return &execStore{
+		worktree: newWorktree(cfg.WikiDir),
+		cfg:      cfg,
+	}
+}
+
 // CUSTOM GIT WRAPPERS
 // Construct an *exec.Cmd for `git {args}` with a workingDirectory
-func (env *wikiEnv) gitCommand(args ...string) *exec.Cmd {
-	c := exec.Command(env.cfg.GitPath, args...)
+func (s *execStore) gitCommand(args ...string) *exec.Cmd {
+	c := exec.Command(s.cfg.GitPath, args...)
 	c.Env = os.Environ()
-	c.Env = append(c.Env, `GIT_COMMITTER_NAME="`+env.cfg.GitCommitName+`"`, `GIT_COMMITTER_EMAIL="`+env.cfg.GitCommitEmail+`"`)
-	c.Dir = env.cfg.WikiDir
+	c.Env = append(c.Env, "GIT_COMMITTER_NAME="+s.cfg.GitCommitName, "GIT_COMMITTER_EMAIL="+s.cfg.GitCommitEmail)
+	c.Dir = s.cfg.WikiDir
 	return c
 }
 
 // Execute `git init {directory}` in the current workingDirectory
-func (env *wikiEnv) gitInit() error {
+func (s *execStore) Init() error {
 	//wd, err := os.Getwd()
 	//if err != nil {
 	//	return err
 	//}
-	return env.gitCommand("init").Run()
+	return s.gitCommand("init").Run()
 }
 
 /*
@@ -47,113 +59,60 @@ func gitClone(repo string) error {
 }
 */
 
-// Execute `git status -s` in directory
-// If there is output, the directory has is dirty
-func (env *wikiEnv) gitIsClean() error {
-	gitBehind := []byte("Your branch is behind")
-	gitAhead := []byte("Your branch is ahead")
-	gitDiverged := []byte("have diverged")
-
-	// Check for untracked files first
-	u := env.gitCommand("ls-files", "--exclude-standard", "--others")
-	uo, err := u.Output()
-	if len(uo) != 0 {
-		return errors.New(string(uo))
+// Untracked files, which would otherwise be missed by everything else
+// git ls-files --exclude-standard --others
+func (s *execStore) Untracked() ([]string, error) {
+	o, err := s.gitCommand("ls-files", "-z", "--exclude-standard", "--others").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error during `git ls-files`: %s\n%s", err.Error(), string(o))
 	}
-
-	// Fetch changes from remote
-	// Commented out for now; adds a solid second to load times!
-	/*
-		err = gitCommand("fetch").Run()
-		if err != nil {
-			return err
+	var untracked []string
+	for _, f := range bytes.Split(o, []byte("\x00")) {
+		if len(f) != 0 {
+			untracked = append(untracked, string(f))
 		}
-	*/
+	}
+	return untracked, nil
+}
 
-	// Now check the status, minus untracked files
-	c := env.gitCommand("status", "-uno")
+// Execute `git status -uno`, to compare the wiki with the remote repo
+func (s *execStore) Status() error {
+	gitBehind := []byte("Your branch is behind")
+	gitAhead := []byte("Your branch is ahead")
+	gitDiverged := []byte("have diverged")
 
-	o, err := c.Output()
+	o, err := s.gitCommand("status", "-uno").Output()
 	if err != nil {
 		return err
 	}
 
 	if bytes.Contains(o, gitBehind) {
-		//return gitPull()
-		//return errors.New(string(o))
 		return errGitBehind
 	}
 
 	if bytes.Contains(o, gitAhead) {
-		//return gitPush()
-		//return errors.New(string(o))
 		return errGitAhead
 	}
 
 	if bytes.Contains(o, gitDiverged) {
-		//return errors.New(string(o))
 		return errGitDiverged
 	}
 
 	return nil
 }
 
-func (env *wikiEnv) gitIsCleanStartup() error {
-	gitBehind := []byte("Your branch is behind")
-	gitAhead := []byte("Your branch is ahead")
-	gitDiverged := []byte("have diverged")
-
-	// Check for untracked files first
-	u := env.gitCommand("ls-files", "--exclude-standard", "--others")
-	uo, err := u.Output()
-	if len(uo) != 0 {
-		return errors.New("Untracked files: " + string(uo))
-	}
-
-	if env.cfg.RemoteGitRepo != "" {
-		// Fetch changes from remote
-		err = env.gitCommand("fetch").Run()
-		if err != nil {
-			return err
-		}
-	}
-
-	// Now check the status, minus untracked files
-	c := env.gitCommand("status", "-uno")
-
-	o, err := c.Output()
+// Execute `git fetch` in workingDirectory
+func (s *execStore) Fetch() error {
+	o, err := s.gitCommand("fetch").CombinedOutput()
 	if err != nil {
-		return err
-	}
-
-	if bytes.Contains(o, gitBehind) {
-		log.Debugln("gitIsCleanStartup: Pulling git repo...")
-		return env.gitPull()
-		//return errors.New(string(o))
-		//return ErrGitBehind
-	}
-
-	if bytes.Contains(o, gitAhead) {
-		if env.cfg.PushOnSave {
-			log.Debugln("gitIsCleanStartup: Pushing git repo...")
-			return env.gitPush()
-		}
-		return nil
-		//return errors.New(string(o))
-		//return ErrGitAhead
-	}
-
-	if bytes.Contains(o, gitDiverged) {
-		return errors.New(string(o))
-		//return ErrGitDiverged
+		return fmt.Errorf("error during `git fetch`: %s\n%s", err.Error(), string(o))
 	}
-
 	return nil
 }
 
 // Execute `git add {filepath}` in workingDirectory
-func (env *wikiEnv) gitAddFilepath(filepath string) error {
-	o, err := env.gitCommand("add", filepath).CombinedOutput()
+func (s *execStore) Add(filepath string) error {
+	o, err := s.gitCommand("add", filepath).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("error during `git add`: %s\n%s", err.Error(), string(o))
 	}
@@ -161,27 +120,48 @@ func (env *wikiEnv) gitAddFilepath(filepath string) error {
 }
 
 // Execute `git rm {filepath}` in workingDirectory
-func (env *wikiEnv) gitRmFilepath(filepath string) error {
-	o, err := env.gitCommand("rm", filepath).CombinedOutput()
+func (s *execStore) Remove(filepath string) error {
+	o, err := s.gitCommand("rm", filepath).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("error during `git rm`: %s\n%s", err.Error(), string(o))
 	}
 	return nil
 }
 
-// Execute `git commit -m {msg}` in workingDirectory
-func (env *wikiEnv) gitCommitWithMessage(msg string) error {
-	o, err := env.gitCommand("commit", "--author", "'Golang Wiki <golangwiki@jba.io>'", "-m", msg).CombinedOutput()
+// Execute `git mv {src} {dst}` in workingDirectory
+// The directory being moved into is created first, as git does not
+func (s *execStore) Move(src, dst string) error {
+	if dir := path.Dir(dst); dir != "." {
+		err := s.fs.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	o, err := s.gitCommand("mv", src, dst).CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("error during `git commit`: %s\n%s", err.Error(), string(o))
+		return fmt.Errorf("error during `git mv`: %s\n%s", err.Error(), string(o))
 	}
+	return nil
+}
 
+// Execute `git restore --source=HEAD --staged --worktree {names}` in workingDirectory
+func (s *execStore) Restore(names ...string) error {
+	args := append([]string{"restore", "--source=HEAD", "--staged", "--worktree", "--"}, names...)
+	o, err := s.gitCommand(args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error during `git restore`: %s\n%s", err.Error(), string(o))
+	}
 	return nil
 }
 
-// Execute `git commit -m "commit from GoWiki"` in workingDirectory
-func (env *wikiEnv) gitCommitEmpty() error {
-	o, err := env.gitCommand("commit", "--author", "'Golang Wiki <golangwiki@jba.io>'", "-m", "commit from GoWiki").CombinedOutput()
+// Execute `git commit --author {author} -m {msg}` in workingDirectory
+// author is in the form "Name <email>"; if blank, the wiki's own identity is used
+// The committer is always the wiki's own identity
+func (s *execStore) Commit(author, msg string) error {
+	if author == "" {
+		author = s.cfg.GitCommitName + " <" + s.cfg.GitCommitEmail + ">"
+	}
+	o, err := s.gitCommand("commit", "--author", author, "-m", msg).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("error during `git commit`: %s\n%s", err.Error(), string(o))
 	}
@@ -190,8 +170,8 @@ func (env *wikiEnv) gitCommitEmpty() error {
 }
 
 // Execute `git push` in workingDirectory
-func (env *wikiEnv) gitPush() error {
-	o, err := env.gitCommand("push", "-u", "origin", "master").CombinedOutput()
+func (s *execStore) Push() error {
+	o, err := s.gitCommand("push", "-u", "origin", "master").CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("error during `git push`: %s\n%s", err.Error(), string(o))
 	}
@@ -199,9 +179,9 @@ func (env *wikiEnv) gitPush() error {
 	return nil
 }
 
-// Execute `git push` in workingDirectory
-func (env *wikiEnv) gitPull() error {
-	o, err := env.gitCommand("pull").CombinedOutput()
+// Execute `git pull` in workingDirectory
+func (s *execStore) Pull() error {
+	o, err := s.gitCommand("pull").CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("error during `git pull`: %s\n%s", err.Error(), string(o))
 	}
@@ -211,9 +191,9 @@ func (env *wikiEnv) gitPull() error {
 
 // File creation time, output to UNIX time
 // git log --diff-filter=A --follow --format=%at -1 -- [filename]
-func (env *wikiEnv) gitGetCtime(filename string) (int64, error) {
+func (s *execStore) Ctime(filename string) (int64, error) {
 	//var ctime int64
-	o, err := env.gitCommand("log", "--diff-filter=A", "--follow", "--format=%at", "-1", "--", filename).Output()
+	o, err := s.gitCommand("log", "--diff-filter=A", "--follow", "--format=%at", "-1", "--", filename).Output()
 	if err != nil {
 		return 0, fmt.Errorf("error during `git log --diff-filter=A --follow --format=at -1 --`: %s\n%s", err.Error(), string(o))
 	}
@@ -233,9 +213,9 @@ func (env *wikiEnv) gitGetCtime(filename string) (int64, error) {
 
 // File modification time, output to UNIX time
 // git log -1 --format=%at -- [filename]
-func (env *wikiEnv) gitGetMtime(filename string) (int64, error) {
+func (s *execStore) Mtime(filename string) (int64, error) {
 	//var mtime int64
-	o, err := env.gitCommand("log", "--format=%at", "-1", "--", filename).Output()
+	o, err := s.gitCommand("log", "--format=%at", "-1", "--", filename).Output()
 	if err != nil {
 		return 0, fmt.Errorf("error during `git log -1 --format=at --`: %s\n%s", err.Error(), string(o))
 	}
@@ -253,29 +233,51 @@ func (env *wikiEnv) gitGetMtime(filename string) (int64, error) {
 	return mtime, err
 }
 
-type commitLog struct {
-	Filename string
-	Commit   string
-	Date     int64
-	Message  string
-}
-
 // File history
 // git log --pretty=format:"commit:%H date:%at message:%s" [filename]
-// git log --pretty=format:"%H,%at,%s" [filename]
-func (env *wikiEnv) gitGetFileLog(filename string) ([]commitLog, error) {
-	o, err := env.gitCommand("log", "--pretty=format:%H,%at,%s", filename).Output()
+// git log --follow -M90% --name-only -z --pretty=format:"%x1e%H%x1f%at%x1f%an%x1f%s" [filename]
+// --follow keeps the history of pages from before they were moved
+// -M90% stops it from mistaking new, short pages for copies of similar ones
+// --name-only lists each commit under the file's path at that commit, which differs from before a move
+func (s *execStore) FileLog(filename string) ([]commitLog, error) {
+	o, err := s.gitCommand("log", "--follow", "-M90%", "--name-only", "-z", "--pretty=format:%x1e%H%x1f%at%x1f%an%x1f%s", "--", filename).Output()
 	if err != nil {
 		return nil, fmt.Errorf("error during `git log`: %s\n%s", err.Error(), string(o))
 	}
+	return parseNamedCommitLog(o), nil
+}
+
+// Commit which deleted a file, or nil if it was never deleted
+// git log -1 --diff-filter=D --pretty=format:"%H%x1f%at%x1f%an%x1f%s" -- [filename]
+func (s *execStore) FileDeletion(filename string) (*commitLog, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+	o, err := s.gitCommand("log", "-1", "--diff-filter=D", "--pretty=format:%H%x1f%at%x1f%an%x1f%s", "--", filename).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error during `git log --diff-filter=D`: %s\n%s", err.Error(), string(o))
+	}
+	commits := parseCommitLog(filename, o)
+	if len(commits) == 0 {
+		return nil, nil
+	}
+	return &commits[0], nil
+}
+
+// parseCommitLog parses `git log --pretty=format:"%H%x1f%at%x1f%an%x1f%s"` output for the given file
+func parseCommitLog(filename string, o []byte) []commitLog {
 	// split each commit onto it's own line
 	logsplit := strings.Split(string(o), "\n")
 	// now split each commit-line into it's slice
-	// format should be: [sha1],[date],[message]
+	// format should be: [sha1]\x1f[date]\x1f[author]\x1f[message]
+	//  using the unit separator, as author names and messages may contain commas
 	var commits []commitLog
 	for _, v := range logsplit {
 		//var theCommit *commitLog
-		var vs = strings.SplitN(v, ",", 3)
+		var vs = strings.SplitN(v, "\x1f", 4)
+		if len(vs) != 4 {
+			continue
+		}
 		// Convert date to int64
 		var mtime, err = strconv.ParseInt(vs[1], 10, 64)
 		if err != nil {
@@ -284,45 +286,148 @@ func (env *wikiEnv) gitGetFileLog(filename string) ([]commitLog, error) {
 		// Now shortening the SHA1 to 7 digits, supposed to be the default git short sha output
 		shortsha := vs[0][0:7]
 
-		// vs[0] = commit, vs[1] = date, vs[2] = message
+		// vs[0] = commit, vs[1] = date, vs[2] = author, vs[3] = message
 		theCommit := commitLog{
 			Filename: filename,
 			Commit:   shortsha,
 			Date:     mtime,
-			Message:  vs[2],
+			Author:   vs[2],
+			Message:  vs[3],
 		}
 		commits = append(commits, theCommit)
 	}
-	return commits, nil
+	return commits
+}
+
+// Files deleted throughout history, newest first, with the commit deleting each
+// git log --diff-filter=D --name-only -z --pretty=format:"%x1e%H%x1f%at%x1f%an%x1f%s" HEAD
+func (s *execStore) DeletedFiles() ([]commitLog, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+	o, err := s.gitCommand("log", "--diff-filter=D", "--name-only", "-z", "--pretty=format:%x1e%H%x1f%at%x1f%an%x1f%s", "HEAD").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error during `git log --diff-filter=D`: %s\n%s", err.Error(), string(o))
+	}
+
+	return parseNamedCommitLog(o), nil
+}
+
+// parseNamedCommitLog parses `git log --name-only -z --pretty=format:"%x1e%H%x1f%at%x1f%an%x1f%s"` output,
+// listing each commit once for every file it names
+func parseNamedCommitLog(o []byte) []commitLog {
+	// Same layout as gitHistory(): a record separator, the header line, then NUL-separated files
+	var commits []commitLog
+	for _, v := range bytes.Split(o, []byte("\x1e")) {
+		commit := bytes.SplitN(v, []byte("\n"), 2)
+		if len(commit) != 2 {
+			continue
+		}
+		for _, f := range bytes.Split(commit[1], []byte("\x00")) {
+			if len(f) == 0 {
+				continue
+			}
+			commits = append(commits, parseCommitLog(string(f), commit[0])...)
+		}
+	}
+	return commits
+}
+
+// Author and commit of each line of a file
+// git blame --porcelain -- [filename]
+func (s *execStore) Blame(filename string) ([]blameLine, error) {
+	o, err := s.gitCommand("blame", "--porcelain", "--", filename).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error during `git blame`: %s\n%s", err.Error(), string(o))
+	}
+
+	// Each line starts with a header of [sha1] [original line] [final line],
+	//  followed by details of the commit the first time it appears, then the line itself after a tab
+	commits := make(map[string]*blameLine)
+	var lines []blameLine
+	var current *blameLine
+	for _, v := range strings.Split(string(o), "\n") {
+		if strings.HasPrefix(v, "\t") {
+			line := *current
+			line.Text = v[1:]
+			lines = append(lines, line)
+			continue
+		}
+		fields := strings.SplitN(v, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if len(fields[0]) == 40 {
+			header := strings.Fields(fields[1])
+			if len(header) < 2 {
+				continue
+			}
+			num, err := strconv.Atoi(header[1])
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := commits[fields[0]]; !ok {
+				commits[fields[0]] = &blameLine{Commit: fields[0]}
+			}
+			current = commits[fields[0]]
+			current.Num = num
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		switch fields[0] {
+		case "author":
+			current.Author = fields[1]
+		case "author-time":
+			current.Date, err = strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		case "summary":
+			current.Summary = fields[1]
+		}
+	}
+	return lines, nil
+}
+
+// Latest commit touching a file, as a full SHA1
+// git log -1 --format=%H -- [filename]
+func (s *execStore) LastCommit(filename string) (string, error) {
+	if s.IsEmpty() {
+		return "", nil
+	}
+	o, err := s.gitCommand("log", "-1", "--format=%H", "--", filename).Output()
+	if err != nil {
+		return "", fmt.Errorf("error during `git log -1 --format=%%H --`: %s\n%s", err.Error(), string(o))
+	}
+	return strings.TrimSpace(string(o)), nil
 }
 
 // Get file as it existed at specific commit
-// git show [commit sha1]:[filename]
-func (env *wikiEnv) gitGetFileCommit(filename, commit string) ([]byte, error) {
+// git show --end-of-options [commit sha1]:[filename]
+func (s *execStore) FileAt(filename, commit string) ([]byte, error) {
 	// Combine these into one
 	fullcommit := commit + ":" + filename
-	o, err := env.gitCommand("show", fullcommit).CombinedOutput()
+	// --end-of-options keeps a revision starting with a dash from being read as an option
+	o, err := s.gitCommand("show", "--end-of-options", fullcommit).CombinedOutput()
 	if err != nil {
 		return []byte{}, fmt.Errorf("error during `git show`: %s\n%s", err.Error(), string(o))
 	}
 	return o, nil
 }
 
-// Get diff for entire commit
-// git show [commit sha1]
-func (env *wikiEnv) gitGetFileCommitDiff(filename, commit string) ([]byte, error) {
-	o, err := env.gitCommand("show", commit).CombinedOutput()
-	if err != nil {
-		return []byte{}, fmt.Errorf("error during `git show`: %s\n%s", err.Error(), string(o))
-	}
-	return o, nil
+// Check whether a revision names an existing commit
+// git rev-parse --verify --quiet [revision]^{commit}
+func (s *execStore) RevisionExists(revision string) bool {
+	return s.gitCommand("rev-parse", "--verify", "--quiet", revision+"^{commit}").Run() == nil
 }
 
 // File modification time for specific commit, output to UNIX time
 // git log -1 --format=%at [commit sha1]
-func (env *wikiEnv) gitGetFileCommitMtime(commit string) (int64, error) {
+func (s *execStore) CommitTime(commit string) (int64, error) {
 	//var mtime int64
-	o, err := env.gitCommand("log", "--format=%at", "-1", commit).Output()
+	o, err := s.gitCommand("log", "--format=%at", "-1", commit).Output()
 	if err != nil {
 		return 0, fmt.Errorf("error during `git log -1 --format=at --`: %s\n%s", err.Error(), string(o))
 	}
@@ -335,21 +440,9 @@ func (env *wikiEnv) gitGetFileCommitMtime(commit string) (int64, error) {
 	return mtime, err
 }
 
-// git ls-files
-func (env *wikiEnv) gitLs() ([]string, error) {
-	o, err := env.gitCommand("ls-files", "-z").Output()
-	if err != nil {
-		return nil, fmt.Errorf("error during `git ls-files`: %s\n%s", err.Error(), string(o))
-	}
-	nul := bytes.Replace(o, []byte("\x00"), []byte("\n"), -1)
-	// split each commit onto it's own line
-	lssplit := strings.Split(string(nul), "\n")
-	return lssplit, nil
-}
-
 // git ls-tree -r -t HEAD
-func (env *wikiEnv) gitLsTree() ([]*gitDirList, error) {
-	o, err := env.gitCommand("ls-tree", "-r", "-t", "-z", "HEAD").Output()
+func (s *execStore) LsTree() ([]*gitDirList, error) {
+	o, err := s.gitCommand("ls-tree", "-r", "-t", "-z", "HEAD").Output()
 	if err != nil {
 		return nil, fmt.Errorf("error during `git ls-files`: %s\n%s", err.Error(), string(o))
 	}
@@ -373,170 +466,220 @@ func (env *wikiEnv) gitLsTree() ([]*gitDirList, error) {
 	return dirList, nil
 }
 
-// git ls-tree HEAD:[dirname]
-func (env *wikiEnv) gitLsTreeDir(dir string) ([]*gitDirList, error) {
-	o, err := env.gitCommand("ls-tree", "-z", "HEAD:"+dir).Output()
-	if err != nil {
-		return nil, fmt.Errorf("error during `git ls-files`: %s\n%s", err.Error(), string(o))
-	}
-	nul := bytes.Replace(o, []byte("\x00"), []byte("\n"), -1)
-	// split each commit onto it's own line
-	ostring := strings.TrimSpace(string(nul))
-	lssplit := strings.Split(ostring, "\n")
-	var dirList []*gitDirList
-	for _, v := range lssplit {
-		var vs = strings.Fields(v)
-		theGitDirListing := &gitDirList{
-			Type:     vs[1],
-			Filename: vs[3],
-		}
-		dirList = append(dirList, theGitDirListing)
-	}
-	return dirList, nil
-}
-
-// git log --name-only --pretty=format:"%at %H" -z HEAD
-func (env *wikiEnv) gitHistory() ([]string, error) {
-	o, err := env.gitCommand("log", "--name-only", "--pretty=format:_END %at %H", "-z", "HEAD").Output()
+// git log --name-only --pretty=format:"%x1e%at%x1f%H%x1f%an%x1f%s" -z HEAD
+func (s *execStore) History() ([]recent, error) {
+	o, err := s.gitCommand("log", "--name-only", "--pretty=format:%x1e%at%x1f%H%x1f%an%x1f%s", "-z", "HEAD").Output()
 	if err != nil {
 		return nil, fmt.Errorf("error during `git history`: %s\n%s", err.Error(), string(o))
 	}
-
-	// Get rid of first _END
-	o = bytes.Replace(o, []byte("_END"), []byte(""), 1)
-	o = bytes.Replace(o, []byte("\x00"), []byte("\n"), -1)
-
-	// Now remove all _END tags
-	b := bytes.SplitAfter(o, []byte("_END"))
-	var s []string
-	//var s *[]recent
-	for _, v := range b {
-		v = bytes.Replace(v, []byte("_END"), []byte(""), -1)
-		s = append(s, string(v))
-	}
-
-	return s, nil
+	return parseHistory(o)
 }
 
-// File creation time, output to UNIX time
-// git log --diff-filter=A --follow --format=%at -1 -- [filename]
-// File modification time, output to UNIX time
-// git log -1 --format=%at -- [filename]
-func (env *wikiEnv) gitGetTimes(filename string, ctime, mtime chan<- int64) {
-
-	go func() {
-		co, err := env.gitCommand("log", "--diff-filter=A", "--follow", "--format=%at", "-1", "--", filename).Output()
-		if err != nil {
-			log.Println(filename, err)
-			ctime <- 0
-			return
-		}
-		costring := strings.TrimSpace(string(co))
-		// If output is blank, no point in wasting CPU doing the rest
-		if costring == "" {
-			log.Println(filename + " is not checked into Git")
-			ctime <- 0
-			return
+// parseHistory reads the output of `git log --name-only -z`, in the format used by History
+// Each commit starts with a record separator, followed by the header line,
+// then the NUL-separated list of changed files
+func parseHistory(o []byte) ([]recent, error) {
+	var recents []recent
+	for _, v := range bytes.Split(o, []byte("\x1e")) {
+		commit := bytes.SplitN(v, []byte("\n"), 2)
+		if len(commit) != 2 {
+			continue
 		}
-		ctimeI, err := strconv.ParseInt(costring, 10, 64)
-		if err != nil {
-			ctime <- 0
-			return
+		header := strings.SplitN(string(commit[0]), "\x1f", 4)
+		if len(header) != 4 {
+			continue
 		}
-		ctime <- ctimeI
-	}()
-
-	go func() {
-		mo, err := env.gitCommand("log", "--format=%at", "-1", "--", filename).Output()
+		date, err := strconv.ParseInt(header[0], 10, 64)
 		if err != nil {
-			log.Println(filename, err)
-			mtime <- 0
-			return
+			return nil, err
 		}
-		mostring := strings.TrimSpace(string(mo))
-		// If output is blank, no point in wasting CPU doing the rest
-		if mostring == "" {
-			log.Println(filename + " is not checked into Git")
-			mtime <- 0
-			return
+		var filenames []string
+		for _, f := range bytes.Split(commit[1], []byte("\x00")) {
+			if len(f) != 0 {
+				filenames = append(filenames, string(f))
+			}
 		}
-		mtimeI, err := strconv.ParseInt(mostring, 10, 64)
-		if err != nil {
-			mtime <- 0
-			return
+		// Skip commits without any files, such as the initial one
+		if len(filenames) == 0 {
+			continue
 		}
-		mtime <- mtimeI
-	}()
+		recents = append(recents, recent{
+			Date:      date,
+			Commit:    header[1],
+			Author:    header[2],
+			Message:   header[3],
+			Filenames: filenames,
+		})
+	}
 
+	return recents, nil
 }
 
-func (env *wikiEnv) gitIsEmpty() bool {
+// Pickaxe finds the commits where the number of times a term appears in a file changed,
+// so the term was added to or removed from that file, newest first
+// git log -i -S [term] [--pickaxe-regex] --name-only
+func (s *execStore) Pickaxe(term string, regex bool) ([]commitLog, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+	args := []string{"log", "--name-only", "--pretty=format:%x1e%at%x1f%H%x1f%an%x1f%s", "-z", "-i", "-S", term}
+	if regex {
+		args = append(args, "--pickaxe-regex")
+	}
+	o, err := s.gitCommand(append(args, "HEAD", "--")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error during `git log -S`: %s\n%s", err.Error(), string(o))
+	}
+	recents, err := parseHistory(o)
+	if err != nil {
+		return nil, err
+	}
+	var commits []commitLog
+	for _, v := range recents {
+		for _, filename := range v.Filenames {
+			commits = append(commits, commitLog{
+				Filename: filename,
+				Commit:   v.Commit[0:7],
+				Date:     v.Date,
+				Author:   v.Author,
+				Message:  v.Message,
+			})
+		}
+	}
+	return commits, nil
+}
+
+func (s *execStore) IsEmpty() bool {
 	// Run git rev-parse HEAD on the repo
 	// If it errors out, should mean it's empty
-	err := env.gitCommand("rev-parse", "HEAD").Run()
+	err := s.gitCommand("rev-parse", "HEAD").Run()
 	if err != nil {
 		return true
 	}
 	return false
 }
 
-// Search results, via git
-// git grep --break 'searchTerm'
-func (env *wikiEnv) gitSearch(searchTerm, fileSpec string) []result {
-	var results []result
-	quotedSearchTerm := `'` + searchTerm + `'`
-	cmd := exec.Command("/bin/sh", "-c", env.cfg.GitPath+" grep -i "+quotedSearchTerm+" -- "+fileSpec)
-	//o := gitCommand("grep", "omg -- 'index'")
-	cmd.Dir = env.cfg.WikiDir
-	o, err := cmd.CombinedOutput()
+// SHA1 of the current HEAD
+// git rev-parse HEAD
+func (s *execStore) Head() (string, error) {
+	o, err := s.gitCommand("rev-parse", "HEAD").CombinedOutput()
 	if err != nil {
-		return nil
+		return "", fmt.Errorf("error during `git rev-parse HEAD`: %s\n%s", err.Error(), string(o))
 	}
+	return strings.TrimSpace(string(o)), nil
+}
 
-	// split each result onto it's own line
-	logsplit := strings.Split(string(o), "\n")
-	// now split each search result line into it's slice
-	// format should be: filename:searchresult
-
-	for _, v := range logsplit {
-		//var theCommit *commitLog
-		var vs = strings.SplitN(v, ":", 2)
-		//log.Println(len(vs))
+// ChangedFiles lists the files added, modified, deleted or renamed between two commits
+// git diff-tree -r -z -M --name-status [from] [to]
+func (s *execStore) ChangedFiles(from, to string) ([]fileChange, error) {
+	o, err := s.gitCommand("diff-tree", "-r", "-z", "-M", "--name-status", from, to).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error during `git diff-tree`: %s\n%s", err.Error(), string(o))
+	}
+	return parseNameStatus(string(o))
+}
 
-		// vs[0] = commit, vs[1] = date, vs[2] = message
-		if len(vs) == 2 {
-			theResult := result{
-				Name:   vs[0],
-				Result: vs[1],
-			}
-			results = append(results, theResult)
+// parseNameStatus reads the output of `git diff-tree --name-status -z` and `git log --name-status -z`
+// Each change is its status, then its name, or old and new names for renames and copies, all NUL-separated
+func parseNameStatus(o string) ([]fileChange, error) {
+	var changes []fileChange
+	o = strings.TrimRight(o, "\x00")
+	if o == "" {
+		return nil, nil
+	}
+	fields := strings.Split(o, "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		change := fileChange{
+			Status: fields[i][0],
+			Name:   fields[i+1],
 		}
-	}
-	// Check for matching filenames
-	listOfFiles := strings.Fields(fileSpec)
-	for _, v := range listOfFiles {
-		if strings.Contains(v, searchTerm) {
-			cleanV := strings.TrimPrefix(v, "\"")
-			cleanV = strings.TrimSuffix(cleanV, "\"")
-			theResult := result{
-				Name: cleanV,
+		switch change.Status {
+		case 'R', 'C':
+			if i+2 >= len(fields) {
+				return nil, fmt.Errorf("unexpected --name-status output: %q", o)
 			}
-			results = append(results, theResult)
+			change.From, change.Name = fields[i+1], fields[i+2]
+			i++
+		case 'A', 'D':
+		default:
+			// Type changes are just modifications here
+			change.Status = 'M'
 		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// FileTimes finds the creation and modification times and authors of every file at once, in a single walk through history
+// Unlike `git log --follow`, only files changed by the same commit are taken as the source of a copy, as in goGitStore.Ctime
+// So a new page is never dated back to an older, untouched page which happens to have the same content
+// git log -C --name-status -z --pretty=format:%x1e%at%x1f%an HEAD
+func (s *execStore) FileTimes() (map[string]fileTimes, error) {
+	walk := newTimesWalk()
+	if s.IsEmpty() {
+		return walk.times, nil
+	}
+	o, err := s.gitCommand("log", "-C", "--name-status", "-z", "--pretty=format:%x1e%at%x1f%an", "HEAD").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error during `git log --name-status`: %s\n%s", err.Error(), string(o))
 	}
 
-	return results
+	// Each commit starts with a record separator, followed by its date and author, then its changes
+	for _, v := range strings.Split(string(o), "\x1e") {
+		commit := strings.SplitN(v, "\n", 2)
+		if len(commit) != 2 {
+			continue
+		}
+		dateS, author, _ := strings.Cut(commit[0], "\x1f")
+		date, err := strconv.ParseInt(dateS, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		changes, err := parseNameStatus(commit[1])
+		if err != nil {
+			return nil, err
+		}
+		walk.commit(date, author, changes)
+	}
+	return walk.times, nil
 }
 
-func (env *wikiEnv) gitIsCleanURLs(token string) template.HTML {
-	switch env.gitIsClean() {
-	case errGitAhead:
-		return template.HTML(`<form method="post" action="/admin/git/push" id="git_push"><input type="hidden" name="csrf_token" value="` + token + `"><i class="fa fa-cloud-upload" aria-hidden="true"></i><button type="submit" class="button">Push git</button></form>`)
-	case errGitBehind:
-		return template.HTML(`<form method="post" action="/admin/git/pull" id="git_pull"><input type="hidden" name="csrf_token" value="` + token + `"><i class="fa fa-cloud-download" aria-hidden="true"></i><button type="submit" class="button">Pull git</button></form>`)
-	case errGitDiverged:
-		return template.HTML(`<a href="/admin/git"><i class="fa fa-exclamation-triangle" aria-hidden="true"></i>Issue with git:wiki!</a>`)
-	default:
-		return template.HTML(`Git repo is clean.`)
+// Search results, via git
+// git grep -I -i --null [-F|-E] -e [searchTerm] -- [names]
+// The term and names are passed straight to git, never through a shell
+func (s *execStore) Grep(searchTerm string, names []string, regex bool) ([]result, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	mode := "-F"
+	if regex {
+		mode = "-E"
+	}
+	args := []string{"grep", "-I", "-i", "--null", mode, "-e", searchTerm, "--"}
+	for _, name := range names {
+		// Keep git from reading wildcards or other magic in filenames
+		args = append(args, ":(literal)"+name)
+	}
+	o, err := s.gitCommand(args...).Output()
+	if err != nil {
+		// git grep exits with 1 when nothing matched
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error during `git grep`: %s", err.Error())
 	}
+
+	// format should be: filename\x00searchresult
+	var results []result
+	for _, v := range strings.Split(string(o), "\n") {
+		var vs = strings.SplitN(v, "\x00", 2)
+		if len(vs) == 2 {
+			results = append(results, result{
+				Name:   vs[0],
+				Result: vs[1],
+			})
+		}
+	}
+
+	return results, nil
 }
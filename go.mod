@@ -5,9 +5,12 @@ go 1.25.0
 require (
 	git.sr.ht/~aqtrans/goauth/v2 v2.0.0
 	git.sr.ht/~aqtrans/gohttputils v0.0.0-20180127041929-921d30347ce2
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/go-chi/chi/v5 v5.2.3
+	github.com/go-git/go-billy/v5 v5.6.2
 	github.com/justinas/nosurf v1.2.0
 	github.com/lithammer/fuzzysearch v1.1.8
+	github.com/microcosm-cc/bluemonday v1.0.27
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
 	github.com/pelletier/go-toml v1.9.5
 	github.com/ppaanngggg/chi-prometheus v0.0.0-20221028102310-98bfe0c05e89
@@ -15,6 +18,7 @@ require (
 	github.com/russross/blackfriday v1.6.0
 	github.com/sirupsen/logrus v1.9.3
 	github.com/tevjef/go-runtime-metrics v0.0.0-20170326170900-527a54029307
+	github.com/yuin/goldmark v1.7.13
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -22,12 +26,14 @@ require (
 	dario.cat/mergo v1.0.2 // indirect
 	github.com/Microsoft/go-winio v0.6.2 // indirect
 	github.com/ProtonMail/go-crypto v1.3.0 // indirect
+	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/cloudflare/circl v1.6.1 // indirect
 	github.com/cyphar/filepath-securejoin v0.6.0 // indirect
 	github.com/go-git/gcfg v1.5.1-0.20230307220236-3a3c6141e376 // indirect
-	github.com/go-git/go-billy/v5 v5.6.2 // indirect
 	github.com/golang/groupcache v0.0.0-20241129210726-2c02b8208cf8 // indirect
+	github.com/gorilla/css v1.0.1 // indirect
 	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/pjbgf/sha1cd v0.5.0 // indirect
 	github.com/skeema/knownhosts v1.3.2 // indirect
 	go.yaml.in/yaml/v2 v2.4.3 // indirect
@@ -49,7 +55,7 @@ require (
 	github.com/prometheus/client_model v0.6.2 // indirect
 	github.com/prometheus/common v0.67.2 // indirect
 	github.com/prometheus/procfs v0.19.2 // indirect
-	github.com/sergi/go-diff v1.4.0 // indirect
+	github.com/sergi/go-diff v1.4.0
 	github.com/xanzy/ssh-agent v0.3.3 // indirect
 	go.etcd.io/bbolt v1.4.3 // indirect
 	golang.org/x/crypto v0.54.0 // indirect
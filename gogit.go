@@ -0,0 +1,985 @@
+package main
+
+/*
+	This is the go-git Store, which needs no git binary at all
+	It also keeps in-memory wikis, with the repo and files both held in memory
+
+	It is meant to behave just like execStore, with a few differences:
+	- Pull is only able to fast-forward
+	- Blame does not follow pages across moves
+	- Grep takes Go regular expressions, rather than POSIX extended ones
+*/
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+	log "github.com/sirupsen/logrus"
+)
+
+// goGitStore is the Store using go-git for everything
+// The repo is opened the first time it is needed, as it may not have been initialized yet
+type goGitStore struct {
+	worktree
+	cfg  config
+	m    sync.Mutex
+	repo *git.Repository
+}
+
+func newGoGitStore(cfg config) *goGitStore {
+	return &goGitStore{
+		worktree: newWorktree(cfg.WikiDir),
+		cfg:      cfg,
+	}
+}
+
+// newMemoryStore returns a goGitStore kept entirely in memory, for tests and throwaway demo wikis
+// Everything in it is lost once the wiki is stopped
+func newMemoryStore(cfg config) (*goGitStore, error) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		return nil, err
+	}
+	return &goGitStore{
+		worktree: worktree{fs: fs},
+		cfg:      cfg,
+		repo:     repo,
+	}, nil
+}
+
+func (s *goGitStore) open() (*git.Repository, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.repo == nil {
+		repo, err := git.PlainOpen(s.cfg.WikiDir)
+		if err != nil {
+			return nil, err
+		}
+		s.repo = repo
+	}
+	return s.repo, nil
+}
+
+func (s *goGitStore) Init() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	// In-memory repos are initialized as soon as they are created
+	if s.repo != nil {
+		return nil
+	}
+	repo, err := git.PlainInit(s.cfg.WikiDir, false)
+	if err != nil {
+		return err
+	}
+	s.repo = repo
+	return nil
+}
+
+func (s *goGitStore) Add(name string) error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	_, err = w.Add(name)
+	return err
+}
+
+func (s *goGitStore) Remove(name string) error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	_, err = w.Remove(name)
+	return err
+}
+
+func (s *goGitStore) Move(src, dst string) error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if dir := path.Dir(dst); dir != "." {
+		err = s.fs.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Move(src, dst)
+	return err
+}
+
+func (s *goGitStore) Restore(names ...string) error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Restore(&git.RestoreOptions{
+		Staged:   true,
+		Worktree: true,
+		Files:    names,
+	})
+}
+
+// Commit everything added so far
+// author is in the form "Name <email>"; if blank, the wiki's own identity is used
+// The committer is always the wiki's own identity
+func (s *goGitStore) Commit(author, msg string) error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	committer := &object.Signature{
+		Name:  s.cfg.GitCommitName,
+		Email: s.cfg.GitCommitEmail,
+		When:  now,
+	}
+	signature := committer
+	if author != "" {
+		name, email := splitAuthor(author)
+		signature = &object.Signature{
+			Name:  name,
+			Email: email,
+			When:  now,
+		}
+	}
+
+	_, err = w.Commit(msg, &git.CommitOptions{
+		Author:    signature,
+		Committer: committer,
+	})
+	return err
+}
+
+func (s *goGitStore) Fetch() error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	err = repo.Fetch(&git.FetchOptions{RemoteName: "origin"})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// Push master to origin, as with `git push -u origin master`
+func (s *goGitStore) Push() error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	err = repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []gitconfig.RefSpec{"refs/heads/master:refs/heads/master"},
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// Pull from origin; go-git is only able to fast-forward
+func (s *goGitStore) Pull() error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	err = w.Pull(&git.PullOptions{RemoteName: "origin"})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+func (s *goGitStore) Untracked() ([]string, error) {
+	repo, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := w.Status()
+	if err != nil {
+		return nil, err
+	}
+	var untracked []string
+	for name, file := range status {
+		if file.Worktree == git.Untracked {
+			untracked = append(untracked, name)
+		}
+	}
+	sort.Strings(untracked)
+	return untracked, nil
+}
+
+// Status compares HEAD with the branch it tracks on origin, as fetched last
+func (s *goGitStore) Status() error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		// Nothing to compare yet
+		return nil
+	}
+	remote, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err != nil || remote.Hash() == head.Hash() {
+		return nil
+	}
+
+	local, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	upstream, err := repo.CommitObject(remote.Hash())
+	if err != nil {
+		return err
+	}
+	behind, err := local.IsAncestor(upstream)
+	if err != nil {
+		return err
+	}
+	if behind {
+		return errGitBehind
+	}
+	ahead, err := upstream.IsAncestor(local)
+	if err != nil {
+		return err
+	}
+	if ahead {
+		return errGitAhead
+	}
+	return errGitDiverged
+}
+
+func (s *goGitStore) IsEmpty() bool {
+	repo, err := s.open()
+	if err != nil {
+		return true
+	}
+	_, err = repo.Head()
+	return err != nil
+}
+
+func (s *goGitStore) Head() (string, error) {
+	repo, err := s.open()
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
+// resolve finds the commit a revision such as HEAD, abc1234 or abc1234^ points at
+func (s *goGitStore) resolve(revision string) (*object.Commit, error) {
+	repo, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, err
+	}
+	return repo.CommitObject(*hash)
+}
+
+func (s *goGitStore) RevisionExists(revision string) bool {
+	_, err := s.resolve(revision)
+	return err == nil
+}
+
+// Get file as it existed at specific commit
+func (s *goGitStore) FileAt(name, revision string) ([]byte, error) {
+	commit, err := s.resolve(revision)
+	if err != nil {
+		return nil, err
+	}
+	file, err := commit.File(name)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(contents), nil
+}
+
+// errStopWalk ends walkFile early
+var errStopWalk = storer.ErrStop
+
+// walkFile calls fn with each commit changing the given file, newest first, like `git log -- [filename]`
+// If follow is set, the file is followed back across moves, like `git log --follow -M90% -- [filename]`
+// fn is given the file's path in each commit, which is its earlier name for commits from before a move
+// Moves are passed to fn as modifications, so only the commit first creating a file is an insert
+// Merge commits are skipped, as their changes are found on the branches they merge
+func (s *goGitStore) walkFile(name string, follow bool, fn func(*object.Commit, string, merkletrie.Action) error) error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	commits, err := repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return err
+	}
+	defer commits.Close()
+
+	return commits.ForEach(func(commit *object.Commit) error {
+		if commit.NumParents() > 1 {
+			return nil
+		}
+		tree, parentTree, err := commitTrees(commit)
+		if err != nil {
+			return err
+		}
+
+		current := fileHash(tree, name)
+		previous := fileHash(parentTree, name)
+		switch {
+		case current == previous:
+			return nil
+		case previous.IsZero():
+			if follow {
+				from, err := movedFrom(parentTree, tree, name)
+				if err != nil {
+					return err
+				}
+				if from != "" {
+					moved := name
+					name = from
+					return fn(commit, moved, merkletrie.Modify)
+				}
+			}
+			return fn(commit, name, merkletrie.Insert)
+		case current.IsZero():
+			return fn(commit, name, merkletrie.Delete)
+		}
+		return fn(commit, name, merkletrie.Modify)
+	})
+}
+
+// movedFrom finds where a file added between two trees was moved from, or "" if it is new
+// Like --follow, files which were only changed are candidates too, so moves leaving a redirect stub behind are found
+func movedFrom(parentTree, tree *object.Tree, name string) (string, error) {
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return "", err
+	}
+	var candidates object.Changes
+	var added *object.Change
+	for _, change := range changes {
+		if change.From.Name == "" {
+			if change.To.Name == name {
+				added = change
+			}
+			continue
+		}
+		// The earlier version of every changed file is treated as deleted, so it can be paired up with the added one
+		candidates = append(candidates, &object.Change{From: change.From})
+	}
+	if added == nil || len(candidates) == 0 {
+		return "", nil
+	}
+
+	paired, err := object.DetectRenames(append(candidates, added), &object.DiffTreeOptions{
+		DetectRenames: true,
+		RenameScore:   90,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, change := range paired {
+		if change.To.Name == name && change.From.Name != "" {
+			return change.From.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// commitTrees returns the tree of a commit, and the tree of its first parent
+// The parent tree is nil for the first commit
+func commitTrees(commit *object.Commit) (*object.Tree, *object.Tree, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	if commit.NumParents() == 0 {
+		return tree, nil, nil
+	}
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree, parentTree, nil
+}
+
+// fileHash returns the blob hash of a file within a tree, or a zero hash if it is not there
+func fileHash(tree *object.Tree, name string) plumbing.Hash {
+	if tree == nil {
+		return plumbing.ZeroHash
+	}
+	entry, err := tree.FindEntry(name)
+	if err != nil || !entry.Mode.IsFile() {
+		return plumbing.ZeroHash
+	}
+	return entry.Hash
+}
+
+// commitSubject returns the first paragraph of a commit message on one line, like %s
+func commitSubject(msg string) string {
+	paragraph := strings.SplitN(strings.TrimSpace(msg), "\n\n", 2)[0]
+	return strings.Join(strings.Fields(paragraph), " ")
+}
+
+func commitLogFor(filename string, commit *object.Commit) commitLog {
+	return commitLog{
+		Filename: filename,
+		Commit:   commit.Hash.String()[0:7],
+		Date:     commit.Author.When.Unix(),
+		Author:   commit.Author.Name,
+		Message:  commitSubject(commit.Message),
+	}
+}
+
+// File history, following the file across moves
+// Each commit is listed under the file's path at that commit
+func (s *goGitStore) FileLog(name string) ([]commitLog, error) {
+	var commits []commitLog
+	err := s.walkFile(name, true, func(commit *object.Commit, path string, action merkletrie.Action) error {
+		commits = append(commits, commitLogFor(path, commit))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// Commit which deleted a file, or nil if it was never deleted
+func (s *goGitStore) FileDeletion(name string) (*commitLog, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+	var deletion *commitLog
+	err := s.walkFile(name, false, func(commit *object.Commit, path string, action merkletrie.Action) error {
+		if action != merkletrie.Delete {
+			return nil
+		}
+		c := commitLogFor(name, commit)
+		deletion = &c
+		return errStopWalk
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
+
+// Latest commit touching a file, as a full SHA1
+func (s *goGitStore) LastCommit(name string) (string, error) {
+	if s.IsEmpty() {
+		return "", nil
+	}
+	var last string
+	err := s.walkFile(name, false, func(commit *object.Commit, path string, action merkletrie.Action) error {
+		last = commit.Hash.String()
+		return errStopWalk
+	})
+	return last, err
+}
+
+// File creation time, output to UNIX time
+func (s *goGitStore) Ctime(name string) (int64, error) {
+	var ctime int64
+	err := s.walkFile(name, true, func(commit *object.Commit, path string, action merkletrie.Action) error {
+		if action != merkletrie.Insert {
+			return nil
+		}
+		ctime = commit.Author.When.Unix()
+		return errStopWalk
+	})
+	if err != nil {
+		return 0, err
+	}
+	if ctime == 0 {
+		log.Println(name + " is not checked into Git")
+		return 0, errNotInGit
+	}
+	return ctime, nil
+}
+
+// File modification time, output to UNIX time
+func (s *goGitStore) Mtime(name string) (int64, error) {
+	var mtime int64
+	err := s.walkFile(name, false, func(commit *object.Commit, path string, action merkletrie.Action) error {
+		mtime = commit.Author.When.Unix()
+		return errStopWalk
+	})
+	if err != nil {
+		return 0, err
+	}
+	if mtime == 0 {
+		log.Println(name + " is not checked into Git")
+	}
+	return mtime, nil
+}
+
+// FileTimes finds the creation and modification times and authors of every file at once, in a single walk through history
+// Moves and copies are found the same way as in Ctime, but only for the commits adding files
+func (s *goGitStore) FileTimes() (map[string]fileTimes, error) {
+	walk := newTimesWalk()
+	if s.IsEmpty() {
+		return walk.times, nil
+	}
+	repo, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	commits, err := repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return nil, err
+	}
+	defer commits.Close()
+
+	err = commits.ForEach(func(commit *object.Commit) error {
+		if commit.NumParents() > 1 {
+			return nil
+		}
+		tree, parentTree, err := commitTrees(commit)
+		if err != nil {
+			return err
+		}
+		diff, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return err
+		}
+		changes, err := copiedFiles(diff)
+		if err != nil {
+			return err
+		}
+		walk.commit(commit.Author.When.Unix(), commit.Author.Name, changes)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return walk.times, nil
+}
+
+// copiedFiles converts the changes between two trees, pairing up added files with those they were moved or copied from
+// Like movedFrom, the earlier version of every changed file is a candidate, but all the added files are paired up at once
+func copiedFiles(diff object.Changes) ([]fileChange, error) {
+	var changes []fileChange
+	var candidates, added object.Changes
+	for _, change := range diff {
+		switch {
+		case change.From.Name == "":
+			added = append(added, change)
+			continue
+		case change.To.Name == "":
+			changes = append(changes, fileChange{Status: 'D', Name: change.From.Name})
+		default:
+			changes = append(changes, fileChange{Status: 'M', Name: change.To.Name})
+		}
+		candidates = append(candidates, &object.Change{From: change.From})
+	}
+	if len(added) == 0 {
+		return changes, nil
+	}
+
+	from := make(map[string]string)
+	if len(candidates) != 0 {
+		paired, err := object.DetectRenames(append(candidates, added...), &object.DiffTreeOptions{
+			DetectRenames: true,
+			RenameScore:   90,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range paired {
+			if change.From.Name != "" && change.To.Name != "" {
+				from[change.To.Name] = change.From.Name
+			}
+		}
+	}
+	for _, change := range added {
+		if name, ok := from[change.To.Name]; ok {
+			changes = append(changes, fileChange{Status: 'C', Name: change.To.Name, From: name})
+			continue
+		}
+		changes = append(changes, fileChange{Status: 'A', Name: change.To.Name})
+	}
+	return changes, nil
+}
+
+// File modification time for specific commit, output to UNIX time
+func (s *goGitStore) CommitTime(revision string) (int64, error) {
+	commit, err := s.resolve(revision)
+	if err != nil {
+		return 0, err
+	}
+	return commit.Author.When.Unix(), nil
+}
+
+// ChangedFiles lists the files added, modified, deleted or renamed between two commits
+func (s *goGitStore) ChangedFiles(from, to string) ([]fileChange, error) {
+	var trees [2]*object.Tree
+	for i, revision := range []string{from, to} {
+		commit, err := s.resolve(revision)
+		if err != nil {
+			return nil, err
+		}
+		trees[i], err = commit.Tree()
+		if err != nil {
+			return nil, err
+		}
+	}
+	diff, err := object.DiffTreeWithOptions(context.Background(), trees[0], trees[1], object.DefaultDiffTreeOptions)
+	if err != nil {
+		return nil, err
+	}
+	var changes []fileChange
+	for _, change := range diff {
+		switch {
+		case change.From.Name == "":
+			changes = append(changes, fileChange{Status: 'A', Name: change.To.Name})
+		case change.To.Name == "":
+			changes = append(changes, fileChange{Status: 'D', Name: change.From.Name})
+		case change.From.Name != change.To.Name:
+			changes = append(changes, fileChange{Status: 'R', Name: change.To.Name, From: change.From.Name})
+		default:
+			changes = append(changes, fileChange{Status: 'M', Name: change.To.Name})
+		}
+	}
+	return changes, nil
+}
+
+// walkChanges calls fn with each commit, newest first, and the files it changed
+// Moves are detected as git does by default, so a moved file is not seen as deleted
+func (s *goGitStore) walkChanges(fn func(*object.Commit, object.Changes) error) error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	commits, err := repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return err
+	}
+	defer commits.Close()
+
+	return commits.ForEach(func(commit *object.Commit) error {
+		// Merges do not list any files in `git log` either
+		if commit.NumParents() > 1 {
+			return fn(commit, nil)
+		}
+		tree, parentTree, err := commitTrees(commit)
+		if err != nil {
+			return err
+		}
+		changes, err := object.DiffTreeWithOptions(context.Background(), parentTree, tree, object.DefaultDiffTreeOptions)
+		if err != nil {
+			return err
+		}
+		return fn(commit, changes)
+	})
+}
+
+// Files deleted throughout history, newest first, with the commit deleting each
+func (s *goGitStore) DeletedFiles() ([]commitLog, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+	var deleted []commitLog
+	err := s.walkChanges(func(commit *object.Commit, changes object.Changes) error {
+		var names []string
+		for _, change := range changes {
+			if change.To.Name == "" {
+				names = append(names, change.From.Name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			deleted = append(deleted, commitLogFor(name, commit))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Every commit, with the files it changed
+func (s *goGitStore) History() ([]recent, error) {
+	var recents []recent
+	err := s.walkChanges(func(commit *object.Commit, changes object.Changes) error {
+		var filenames []string
+		for _, change := range changes {
+			if change.To.Name != "" {
+				filenames = append(filenames, change.To.Name)
+			} else {
+				filenames = append(filenames, change.From.Name)
+			}
+		}
+		// Skip commits without any files, such as the initial one
+		if len(filenames) == 0 {
+			return nil
+		}
+		sort.Strings(filenames)
+		recents = append(recents, recent{
+			Date:      commit.Author.When.Unix(),
+			Commit:    commit.Hash.String(),
+			Author:    commit.Author.Name,
+			Message:   commitSubject(commit.Message),
+			Filenames: filenames,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recents, nil
+}
+
+// Pickaxe finds the commits where the number of times a term appears in a file changed,
+// so the term was added to or removed from that file, newest first, like `git log -i -S`
+func (s *goGitStore) Pickaxe(term string, regex bool) ([]commitLog, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+	if !regex {
+		term = regexp.QuoteMeta(term)
+	}
+	pattern, err := regexp.Compile("(?i)" + term)
+	if err != nil {
+		return nil, err
+	}
+	count := func(file *object.File) (int, error) {
+		if file == nil {
+			return 0, nil
+		}
+		contents, err := file.Contents()
+		if err != nil {
+			return 0, err
+		}
+		return len(pattern.FindAllStringIndex(contents, -1)), nil
+	}
+
+	var commits []commitLog
+	err = s.walkChanges(func(commit *object.Commit, changes object.Changes) error {
+		var filenames []string
+		for _, change := range changes {
+			from, to, err := change.Files()
+			if err != nil {
+				return err
+			}
+			before, err := count(from)
+			if err != nil {
+				return err
+			}
+			after, err := count(to)
+			if err != nil {
+				return err
+			}
+			if before == after {
+				continue
+			}
+			if change.To.Name != "" {
+				filenames = append(filenames, change.To.Name)
+			} else {
+				filenames = append(filenames, change.From.Name)
+			}
+		}
+		sort.Strings(filenames)
+		for _, filename := range filenames {
+			commits = append(commits, commitLogFor(filename, commit))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// Author and commit of each line of a file, as of HEAD
+func (s *goGitStore) Blame(name string) ([]blameLine, error) {
+	head, err := s.resolve("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	blame, err := git.Blame(head, name)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make(map[plumbing.Hash]string)
+	var lines []blameLine
+	for i, line := range blame.Lines {
+		summary, ok := summaries[line.Hash]
+		if !ok {
+			commit, err := repo.CommitObject(line.Hash)
+			if err != nil {
+				return nil, err
+			}
+			summary = commitSubject(commit.Message)
+			summaries[line.Hash] = summary
+		}
+		lines = append(lines, blameLine{
+			Commit:  line.Hash.String(),
+			Author:  line.AuthorName,
+			Date:    line.Date.Unix(),
+			Summary: summary,
+			Num:     i + 1,
+			Text:    line.Text,
+		})
+	}
+	return lines, nil
+}
+
+// Every file and directory in HEAD, like `git ls-tree -r -t HEAD`
+func (s *goGitStore) LsTree() ([]*gitDirList, error) {
+	head, err := s.resolve("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	tree, err := head.Tree()
+	if err != nil {
+		return nil, err
+	}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	dirList := []*gitDirList{}
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		gitType := "blob"
+		switch entry.Mode {
+		case filemode.Dir:
+			gitType = "tree"
+		case filemode.Submodule:
+			gitType = "commit"
+		}
+		dirList = append(dirList, &gitDirList{
+			Type:     gitType,
+			Filename: name,
+		})
+	}
+	return dirList, nil
+}
+
+// Search the given files as they are in the worktree, case insensitively, like `git grep -I -i`
+// The term is a regular expression if regex is set, otherwise it is matched literally
+// Each matching line is a result, and binary files are skipped
+func (s *goGitStore) Grep(term string, names []string, regex bool) ([]result, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	if !regex {
+		term = regexp.QuoteMeta(term)
+	}
+	pattern, err := regexp.Compile("(?i)" + term)
+	if err != nil {
+		return nil, err
+	}
+
+	// git grep lists files in the order they are kept in the index
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	var results []result
+	for _, name := range sorted {
+		content, err := s.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		// git takes a NUL in the first few KB to mean the file is binary
+		if bytes.IndexByte(content[:min(len(content), 8000)], 0) != -1 {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			if pattern.MatchString(line) {
+				results = append(results, result{
+					Name:   name,
+					Result: line,
+				})
+			}
+		}
+	}
+	return results, nil
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"git.sr.ht/~aqtrans/gohttputils"
+	"git.sr.ht/~aqtrans/gowiki/search"
 	"github.com/go-chi/chi/v5"
 	fuzzy2 "github.com/lithammer/fuzzysearch/fuzzy"
 	"github.com/sirupsen/logrus"
@@ -30,14 +34,17 @@ func (env *wikiEnv) setFavoriteHandler(w http.ResponseWriter, r *http.Request) {
 	p := env.loadWikiPage(r, name)
 	if p.Wiki.Frontmatter.Favorite {
 		p.Wiki.Frontmatter.Favorite = false
+		p.Wiki.Message = name + " has been un-favorited."
 		env.authState.SetFlash(name+" has been un-favorited.", r)
 		log.Println(name + " page un-favorited!")
 	} else {
 		p.Wiki.Frontmatter.Favorite = true
+		p.Wiki.Message = name + " has been favorited."
 		env.authState.SetFlash(name+" has been favorited.", r)
 		log.Println(name + " page favorited!")
 	}
 
+	p.Wiki.Author = env.commitAuthor(env.authState.GetUser(r))
 	err := p.Wiki.save(env)
 	if err != nil {
 		log.WithFields(logrus.Fields{
@@ -60,7 +67,7 @@ func (env *wikiEnv) deleteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/"+name, http.StatusFound)
 		return
 	}
-	err := env.gitRmFilepath(name)
+	err := env.store.Remove(name)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"page":  name,
@@ -69,7 +76,7 @@ func (env *wikiEnv) deleteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
 
-	err = env.gitCommitWithMessage(name + " has been removed from git repo.")
+	err = env.store.Commit(env.commitAuthor(env.authState.GetUser(r)), name+" has been removed from git repo.")
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"page":  name,
@@ -83,6 +90,161 @@ func (env *wikiEnv) deleteHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (env *wikiEnv) moveHandler(w http.ResponseWriter, r *http.Request) {
+	defer httputils.TimeTrack(time.Now(), "moveHandler")
+	name := nameFromContext(r.Context())
+
+	if !wikiExistsFromContext(r.Context()) {
+		http.Redirect(w, r, "/"+name, http.StatusFound)
+		return
+	}
+
+	newname := r.FormValue("newname")
+	err := env.checkMoveTarget(&newname)
+	if err != nil {
+		env.authState.SetFlash("Unable to move "+name+": "+err.Error(), r)
+		http.Redirect(w, r, "/edit/"+name, http.StatusSeeOther)
+		return
+	}
+
+	author := env.commitAuthor(env.authState.GetUser(r))
+	err = env.moveWiki(name, newname, author, r.FormValue("updatelinks") == "on", r.FormValue("redirect") == "on")
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"page":    name,
+			"newname": newname,
+			"error":   err,
+		}).Errorln("error moving wiki page")
+		http.Error(w, "error moving wiki page. check logs for more information", http.StatusInternalServerError)
+		return
+	}
+
+	env.authState.SetFlash(name+" has been moved to "+newname+".", r)
+	http.Redirect(w, r, "/"+newname, http.StatusSeeOther)
+}
+
+func (env *wikiEnv) revertHandler(w http.ResponseWriter, r *http.Request) {
+	defer httputils.TimeTrack(time.Now(), "revertHandler")
+	name := nameFromContext(r.Context())
+	revision := r.FormValue("commit")
+
+	user := env.authState.GetUser(r)
+
+	message := "Revert " + name + " to " + shortRevision(revision)
+	if !wikiExistsFromContext(r.Context()) {
+		message = "Restore " + name + " from " + shortRevision(revision)
+
+		// Deleted pages are only checked against their old permission here
+		fm, err := env.revisionFront(name, revision)
+		if err == nil && !permissionListed(fm.Permission, env.authState.IsLoggedIn(r), user.IsAdmin()) {
+			mitigateWiki(false, env, r, w)
+			return
+		}
+	}
+
+	err := env.restoreWiki(name, revision, env.commitAuthor(user), message, user.IsAdmin())
+	if err == errBadRevision || err == errNotWiki {
+		env.authState.SetFlash("Unable to restore "+name+": "+err.Error(), r)
+		http.Redirect(w, r, "/history/"+name, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"page":     name,
+			"revision": revision,
+			"error":    err,
+		}).Errorln("error restoring wiki page")
+		http.Error(w, "error restoring wiki page. check logs for more information", http.StatusInternalServerError)
+		return
+	}
+
+	env.authState.SetFlash(message+".", r)
+	http.Redirect(w, r, "/"+name, http.StatusSeeOther)
+}
+
+type trashEntry struct {
+	commitLog
+	Permission string
+	Preview    string
+}
+
+type trashPage struct {
+	page
+	Trash []trashEntry
+}
+
+// trashHandler lists deleted pages the user would be able to see, most recently deleted first
+func (env *wikiEnv) trashHandler(w http.ResponseWriter, r *http.Request) {
+	defer httputils.TimeTrack(time.Now(), "trashHandler")
+
+	p := make(chan page, 1)
+	go env.loadPage(r, p)
+
+	user := env.authState.GetUser(r)
+
+	deleted, err := env.store.DeletedFiles()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorln("error getting deleted files")
+		http.Error(w, "Unable to fetch deleted files", 500)
+		return
+	}
+
+	seen := make(map[string]struct{})
+	var trash []trashEntry
+	for _, d := range deleted {
+		// Only the latest deletion of each file is of interest
+		if _, ok := seen[d.Filename]; ok {
+			continue
+		}
+		seen[d.Filename] = struct{}{}
+
+		// Skip files that have since been recreated or restored
+		if _, err := env.store.Stat(d.Filename); err == nil {
+			continue
+		}
+
+		body, err := env.store.FileAt(d.Filename, d.Commit+"^")
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"file":   d.Filename,
+				"commit": d.Commit,
+				"error":  err,
+			}).Errorln("error getting last version of deleted file")
+			continue
+		}
+		fm, content := readWikiPage(bytes.NewReader(body))
+		if fm.Permission == "" {
+			fm.Permission = privatePermission
+		}
+		if !permissionListed(fm.Permission, env.authState.IsLoggedIn(r), user.IsAdmin()) {
+			continue
+		}
+
+		// Only preview the start of wiki pages, not uploaded files
+		var preview string
+		if isWikiContent(d.Filename, body) {
+			runes := []rune(string(content))
+			if len(runes) > 300 {
+				runes = append(runes[:300], []rune("...")...)
+			}
+			preview = string(runes)
+		}
+		trash = append(trash, trashEntry{
+			commitLog:  d,
+			Permission: fm.Permission,
+			Preview:    preview,
+		})
+	}
+
+	tp := trashPage{
+		page:  <-p,
+		Trash: trash,
+	}
+	renderTemplate(r.Context(), env, w, "trash.tmpl", tp)
+}
+
 type result struct {
 	Name   string
 	Result string
@@ -90,61 +252,327 @@ type result struct {
 
 type searchPage struct {
 	page
-	Results []result
+	pagination
+	Query string
+	// QueryPath is the query escaped for use in links back to /search/
+	QueryPath string
+	Regex     bool
+	Error     string
+	Results   []searchHit
+}
+
+type historySearchPage struct {
+	page
+	pagination
+	Query     string
+	QueryPath string
+	Regex     bool
+	Error     string
+	Results   []commitLog
+}
+
+// How many search results are shown on each page
+const searchPageSize = 20
+
+// pagination splits search results into pages, picking the one given by ?page=
+// Results[Start:End] are the ones on the current page
+type pagination struct {
+	Total    int
+	PageNum  int
+	Pages    int
+	PrevPage int
+	NextPage int
+	Start    int
+	End      int
+}
+
+func paginate(r *http.Request, total int) pagination {
+	pageNum, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	p := pagination{
+		Total: total,
+		Pages: (total + searchPageSize - 1) / searchPageSize,
+	}
+	if pageNum > p.Pages {
+		pageNum = p.Pages
+	}
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	p.PageNum = pageNum
+	if pageNum > 1 {
+		p.PrevPage = pageNum - 1
+	}
+	if pageNum < p.Pages {
+		p.NextPage = pageNum + 1
+	}
+	p.Start = (pageNum - 1) * searchPageSize
+	p.End = p.Start + searchPageSize
+	if p.End > total {
+		p.End = total
+	}
+	return p
 }
 
 func (env *wikiEnv) searchHandler(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "*")
+	// Routes are matched against the escaped path if there is one, as for queries with a slash in them
+	if r.URL.RawPath != "" {
+		if unescaped, err := url.PathUnescape(name); err == nil {
+			name = unescaped
+		}
+	}
 
 	// If this is a POST request, and searchwiki form is not blank,
 	//  redirect to /search/$(searchform)
 	if r.Method == "POST" {
 		r.ParseForm()
 		if r.PostFormValue("searchwiki") != "" {
-			http.Redirect(w, r, "/search/"+r.PostFormValue("searchwiki"), http.StatusSeeOther)
+			http.Redirect(w, r, "/search/"+url.PathEscape(r.PostFormValue("searchwiki")), http.StatusSeeOther)
 			return
 			//name = r.PostFormValue("searchwiki")
 		}
 	}
 
+	// Regular expressions are only understood by git grep
+	regex := r.URL.Query().Get("mode") == "regex"
+
+	if r.URL.Query().Get("history") != "" {
+		env.historySearch(w, r, name, regex)
+		return
+	}
+
 	p := make(chan page, 1)
 	go env.loadPage(r, p)
 
 	user := env.authState.GetUser(r)
+	isLoggedIn := env.authState.IsLoggedIn(r)
+	var results []searchHit
+	var queryErr string
+	terms := searchTerms(name)
+	query, err := search.Parse(name)
+	switch {
+	case regex:
+	case err != nil:
+		queryErr = err.Error()
+	case !query.Simple():
+		results = env.queryWiki(query, isLoggedIn, user.IsAdmin())
+		terms = searchTerms(strings.Join(query.Words(), " "))
+	default:
+		results = env.searchWiki(name, isLoggedIn, user.IsAdmin())
+	}
 
-	var fileList string
+	// The index only knows whole words, so fall back to git grep to find parts of words
+	if len(results) == 0 && queryErr == "" && (regex || query.Simple()) {
+		var fileList []string
+		theCache := env.loadCache()
+		for _, v := range theCache.Cache {
+			if permissionListed(v.Permission, isLoggedIn, user.IsAdmin()) {
+				fileList = append(fileList, v.Filename)
+			}
+		}
+		seen := make(map[string]bool)
+		for _, v := range env.gitSearch(name, fileList, regex) {
+			if seen[v.Name] {
+				continue
+			}
+			seen[v.Name] = true
+			results = append(results, searchHit{
+				Name:    v.Name,
+				Snippet: grepSnippet(v.Result, name, regex),
+			})
+		}
+	}
 
-	theCache := env.loadCache()
+	s := &searchPage{
+		pagination: paginate(r, len(results)),
+		Query:      name,
+		QueryPath:  url.PathEscape(name),
+		Regex:      regex,
+		Error:      queryErr,
+	}
+	s.Results = results[s.Start:s.End]
+
+	// Only the pages being shown need snippets
+	for i, v := range s.Results {
+		if s.Results[i].Snippet == "" {
+			_, content := env.readPage(v.Name)
+			s.Results[i].Snippet = snippet(content, terms)
+		}
+	}
+
+	s.page = <-p
+	renderTemplate(r.Context(), env, w, "search_results.tmpl", s)
+}
+
+// historySearch finds the commits where the search term was added to or removed from a page
+// As with viewing past versions of a page, only logged in users are allowed, in case information had to be redacted
+// Pages are listed according to their current permission; pages which have since been deleted are treated as private
+func (env *wikiEnv) historySearch(w http.ResponseWriter, r *http.Request, name string, regex bool) {
+	if !env.authState.IsLoggedIn(r) {
+		mitigateWiki(true, env, r, w)
+		return
+	}
+
+	p := make(chan page, 1)
+	go env.loadPage(r, p)
 
+	user := env.authState.GetUser(r)
+
+	permissions := make(map[string]string)
+	theCache := env.loadCache()
 	for _, v := range theCache.Cache {
-		if env.authState.IsLoggedIn(r) {
-			if v.Permission == privatePermission {
-				//log.Println("priv", v.Filename)
-				fileList = fileList + " " + `"` + v.Filename + `"`
+		permissions[v.Filename] = v.Permission
+	}
+
+	var queryErr string
+	var results []commitLog
+	commits, err := env.store.Pickaxe(name, regex)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"term":  name,
+			"error": err,
+		}).Errorln("Error searching wiki history")
+		queryErr = "Unable to search history for " + name
+	}
+	for _, v := range commits {
+		permission, ok := permissions[v.Filename]
+		if !ok {
+			permission = env.deletedPermission(v.Filename)
+			permissions[v.Filename] = permission
+		}
+		if permissionListed(permission, true, user.IsAdmin()) {
+			results = append(results, v)
+		}
+	}
+
+	s := &historySearchPage{
+		pagination: paginate(r, len(results)),
+		Query:      name,
+		QueryPath:  url.PathEscape(name),
+		Regex:      regex,
+		Error:      queryErr,
+	}
+	s.Results = results[s.Start:s.End]
+	s.page = <-p
+	renderTemplate(r.Context(), env, w, "search_history.tmpl", s)
+}
+
+// deletedPermission finds the permission a page had before it was deleted
+// Pages whose last version cannot be found are taken to be admin-only
+func (env *wikiEnv) deletedPermission(name string) string {
+	deletion, err := env.store.FileDeletion(name)
+	if err != nil || deletion == nil {
+		return adminPermission
+	}
+	fm, err := env.revisionFront(name, deletion.Commit+"^")
+	if err != nil {
+		return adminPermission
+	}
+	if fm.Permission == "" {
+		return privatePermission
+	}
+	return fm.Permission
+}
+
+type suggestion struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+}
+
+type suggestions struct {
+	Pages []suggestion `json:"pages"`
+	Tags  []string     `json:"tags"`
+}
+
+// How many of each kind of suggestion are returned
+const suggestLimit = 10
+
+// suggestHandler returns the pages and tags matching ?q= as JSON, for autocompletion
+// Only pages the user is allowed to see are suggested, along with the tags used on them
+func (env *wikiEnv) suggestHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	user := env.authState.GetUser(r)
+	isLoggedIn := env.authState.IsLoggedIn(r)
+
+	s := suggestions{
+		Pages: []suggestion{},
+		Tags:  []string{},
+	}
+
+	if q != "" {
+		idx := env.loadIndex()
+		titles := make(map[string]string)
+		env.indexLock.Lock()
+		for name, p := range idx.Pages {
+			titles[name] = p.Title
+		}
+		env.indexLock.Unlock()
+
+		// Closest matches first, by the closer of the filename and title
+		distances := make(map[string]int)
+		listed := make(map[string]bool)
+		theCache := env.loadCache()
+		for _, v := range theCache.Cache {
+			if v.Type != "blob" || !permissionListed(v.Permission, isLoggedIn, user.IsAdmin()) {
+				continue
 			}
-			if user.IsAdmin() {
-				if v.Permission == adminPermission {
-					//log.Println("admin", v.Filename)
-					fileList = fileList + " " + `"` + v.Filename + `"`
-				}
+			listed[v.Filename] = true
+			distance := fuzzy2.RankMatchFold(q, v.Filename)
+			if d := fuzzy2.RankMatchFold(q, titles[v.Filename]); d != -1 && (distance == -1 || d < distance) {
+				distance = d
+			}
+			if distance == -1 {
+				continue
 			}
+			distances[v.Filename] = distance
+			s.Pages = append(s.Pages, suggestion{
+				Name:  v.Filename,
+				Title: titles[v.Filename],
+			})
+		}
+		sort.Slice(s.Pages, func(i, j int) bool {
+			a, b := s.Pages[i].Name, s.Pages[j].Name
+			if distances[a] != distances[b] {
+				return distances[a] < distances[b]
+			}
+			return a < b
+		})
+		if len(s.Pages) > suggestLimit {
+			s.Pages = s.Pages[:suggestLimit]
 		}
 
-		if v.Permission == publicPermission {
-			//log.Println("pubic", v.Filename)
-			fileList = fileList + " " + `"` + v.Filename + `"`
+		env.tags.RLock()
+		for tag, pages := range env.tags.List {
+			if fuzzy2.RankMatchFold(q, tag) == -1 {
+				continue
+			}
+			for _, page := range pages {
+				if listed[page] {
+					s.Tags = append(s.Tags, tag)
+					break
+				}
+			}
+		}
+		env.tags.RUnlock()
+		sort.Slice(s.Tags, func(i, j int) bool {
+			a, b := fuzzy2.RankMatchFold(q, s.Tags[i]), fuzzy2.RankMatchFold(q, s.Tags[j])
+			if a != b {
+				return a < b
+			}
+			return s.Tags[i] < s.Tags[j]
+		})
+		if len(s.Tags) > suggestLimit {
+			s.Tags = s.Tags[:suggestLimit]
 		}
 	}
 
-	//log.Println(fileList)
-
-	results := env.gitSearch(name, strings.TrimSpace(fileList))
-
-	s := &searchPage{
-		page:    <-p,
-		Results: results,
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorln("Error encoding suggestions")
 	}
-	renderTemplate(r.Context(), env, w, "search_results.tmpl", s)
 }
 
 func (env *wikiEnv) loginPageHandler(w http.ResponseWriter, r *http.Request) {
@@ -319,11 +747,11 @@ func (env *wikiEnv) gitCheckinPostHandler(w http.ResponseWriter, r *http.Request
 		path = "."
 	}
 
-	err := env.gitAddFilepath(path)
+	err := env.store.Add(path)
 	if err != nil {
 		panic(err)
 	}
-	err = env.gitCommitEmpty()
+	err = env.store.Commit(env.commitAuthor(env.authState.GetUser(r)), "commit from GoWiki")
 	if err != nil {
 		panic(err)
 	}
@@ -338,7 +766,7 @@ func (env *wikiEnv) gitCheckinPostHandler(w http.ResponseWriter, r *http.Request
 func (env *wikiEnv) gitPushPostHandler(w http.ResponseWriter, r *http.Request) {
 	defer httputils.TimeTrack(time.Now(), "gitPushPostHandler")
 
-	err := env.gitPush()
+	err := env.store.Push()
 	if err != nil {
 		panic(err)
 	}
@@ -350,7 +778,7 @@ func (env *wikiEnv) gitPushPostHandler(w http.ResponseWriter, r *http.Request) {
 func (env *wikiEnv) gitPullPostHandler(w http.ResponseWriter, r *http.Request) {
 	defer httputils.TimeTrack(time.Now(), "gitPullPostHandler")
 
-	err := env.gitPull()
+	err := env.store.Pull()
 	if err != nil {
 		panic(err)
 	}
@@ -435,6 +863,11 @@ func (env *wikiEnv) tagHandler(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(r.Context(), env, w, "tag_view.tmpl", tagpage)
 }
 
+type createPage struct {
+	wikiPage
+	Deleted *commitLog
+}
+
 func (env *wikiEnv) createWiki(w http.ResponseWriter, r *http.Request, name string) {
 
 	w.WriteHeader(404)
@@ -442,15 +875,31 @@ func (env *wikiEnv) createWiki(w http.ResponseWriter, r *http.Request, name stri
 	p := make(chan page, 1)
 	go env.loadPage(r, p)
 
-	wp := &wikiPage{
-		page: <-p,
-		Wiki: wiki{
-			Title:    name,
-			Filename: name,
-			Frontmatter: frontmatter{
-				Title: name,
+	// If the page was deleted, let logged in users know, and offer to restore it
+	var deleted *commitLog
+	if env.authState.IsLoggedIn(r) {
+		var err error
+		deleted, err = env.store.FileDeletion(name)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"page":  name,
+				"error": err,
+			}).Errorln("error checking if page was deleted")
+		}
+	}
+
+	wp := &createPage{
+		wikiPage: wikiPage{
+			page: <-p,
+			Wiki: wiki{
+				Title:    name,
+				Filename: name,
+				Frontmatter: frontmatter{
+					Title: name,
+				},
 			},
 		},
+		Deleted: deleted,
 	}
 	renderTemplate(r.Context(), env, w, "wiki_create.tmpl", wp)
 	return
@@ -467,12 +916,87 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, `{"alive": true}`)
 }
 
+type editPage struct {
+	wikiPage
+	Conflict []diffLine
+}
+
 func (env *wikiEnv) editHandler(w http.ResponseWriter, r *http.Request) {
 	defer httputils.TimeTrack(time.Now(), "editHandler")
 	name := chi.URLParam(r, "*")
 
 	p := env.loadWikiPage(r, name)
-	renderTemplate(r.Context(), env, w, "wiki_edit.tmpl", p)
+
+	// Embed the revision editing started from, so saveHandler can detect conflicting edits
+	if wikiExistsFromContext(r.Context()) {
+		baseCommit, err := env.store.LastCommit(name)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"page":  name,
+				"error": err,
+			}).Errorln("error retrieving last commit of wiki page")
+		}
+		p.Wiki.BaseCommit = baseCommit
+	} else {
+		p.Wiki.NewPage = true
+	}
+
+	ep := &editPage{
+		wikiPage: p,
+	}
+	renderTemplate(r.Context(), env, w, "wiki_edit.tmpl", ep)
+}
+
+// editConflictHandler is used when a page was saved by someone else while it was being edited,
+// and the edits could not be merged automatically
+// The merged text, with conflict markers, is handed back in the editor alongside a diff against the current version
+func (env *wikiEnv) editConflictHandler(w http.ResponseWriter, r *http.Request, submitted *wiki) {
+	name := submitted.Filename
+
+	p := make(chan page, 1)
+	go env.loadPage(r, p)
+
+	current, err := env.store.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(logrus.Fields{
+			"page":  name,
+			"error": err,
+		}).Errorln("error reading current version of wiki page")
+		http.Error(w, "error reading wiki page. check logs for more information", http.StatusInternalServerError)
+		return
+	}
+
+	submittedBytes, err := submitted.encode()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"page":  name,
+			"error": err,
+		}).Errorln("error encoding wiki page")
+		http.Error(w, "error encoding wiki page. check logs for more information", http.StatusInternalServerError)
+		return
+	}
+
+	// Saving again from the conflict page is based on the current version
+	baseCommit, err := env.store.LastCommit(name)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"page":  name,
+			"error": err,
+		}).Errorln("error retrieving last commit of wiki page")
+	}
+	submitted.BaseCommit = baseCommit
+	submitted.NewPage = submitted.NewPage && baseCommit == ""
+
+	w.WriteHeader(http.StatusConflict)
+
+	ep := &editPage{
+		wikiPage: wikiPage{
+			page: <-p,
+			Wiki: *submitted,
+		},
+		Conflict: diffLines(string(current), string(submittedBytes)),
+	}
+	renderTemplate(r.Context(), env, w, "wiki_edit.tmpl", ep)
 }
 
 func (env *wikiEnv) saveHandler(w http.ResponseWriter, r *http.Request) {
@@ -492,6 +1016,17 @@ func (env *wikiEnv) saveHandler(w http.ResponseWriter, r *http.Request) {
 
 	content := r.FormValue("editor")
 
+	// The base commit is handed to git, so only a full SHA1 is accepted
+	baseCommit := r.FormValue("basecommit")
+	if baseCommit != "" && !fullRevision.MatchString(baseCommit) {
+		log.WithFields(logrus.Fields{
+			"page":       name,
+			"basecommit": baseCommit,
+		}).Warnln("invalid base commit while saving wiki page")
+		http.Error(w, errBadRevision.Error(), http.StatusBadRequest)
+		return
+	}
+
 	/*
 		// Strip out CRLF here,
 		// as I cannot figure out if it's the browser or what inserting them...
@@ -508,6 +1043,9 @@ func (env *wikiEnv) saveHandler(w http.ResponseWriter, r *http.Request) {
 	tags := r.FormValue("tags_all")
 	favorite := r.FormValue("favorite")
 	permission := r.FormValue("permission")
+	redirect := strings.Trim(r.FormValue("redirect"), " /")
+	// Pages saved by anyone else are always sanitized, even if an admin turned it off before
+	rawHTML := r.FormValue("rawhtml") == "on" && env.authState.GetUser(r).IsAdmin()
 
 	favoritebool := false
 	if favorite == "on" {
@@ -528,6 +1066,8 @@ func (env *wikiEnv) saveHandler(w http.ResponseWriter, r *http.Request) {
 		Tags:       tagsA,
 		Favorite:   favoritebool,
 		Permission: permission,
+		Redirect:   redirect,
+		RawHTML:    rawHTML,
 	}
 
 	thewiki := &wiki{
@@ -535,9 +1075,21 @@ func (env *wikiEnv) saveHandler(w http.ResponseWriter, r *http.Request) {
 		Filename:    name,
 		Frontmatter: fm,
 		Content:     []byte(content),
+		BaseCommit:  baseCommit,
+		NewPage:     baseCommit == "" && r.FormValue("newpage") == "on",
+		Author:      env.commitAuthor(env.authState.GetUser(r)),
+		Message:     strings.TrimSpace(r.FormValue("message")),
 	}
 
 	err = thewiki.save(env)
+	if err == errEditConflict {
+		log.WithFields(logrus.Fields{
+			"page":       name,
+			"basecommit": thewiki.BaseCommit,
+		}).Warnln("edit conflict while saving wiki page")
+		env.editConflictHandler(w, r, thewiki)
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"page":  name,
@@ -564,6 +1116,92 @@ func (env *wikiEnv) indexHandler(w http.ResponseWriter, r *http.Request) {
 	//viewHandler(w, r, "index")
 }
 
+// serveFile serves a file which is not a wiki page, such as an image, straight from the Store
+// Files have no frontmatter, so like private pages they are only cached by the browser
+func (env *wikiEnv) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	content, err := env.store.ReadFile(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	env.cacheHeaders(w, r, blobHash(content), false)
+	// ServeContent takes care of If-None-Match and If-Modified-Since itself
+	http.ServeContent(w, r, name, env.pageMtime(name), bytes.NewReader(content))
+}
+
+// permissionClass is what a user is allowed to see; everyone in the same class is shown the same page
+func (env *wikiEnv) permissionClass(r *http.Request) string {
+	switch {
+	case env.authState.GetUser(r).IsAdmin():
+		return adminPermission
+	case env.authState.IsLoggedIn(r):
+		return "user"
+	}
+	return "anonymous"
+}
+
+// cacheHeaders sets the ETag and Cache-Control headers for a page or file, from the git blob hash of its content
+// Proxies may only keep public pages seen by anonymous users; anything else is only cached by the browser
+// Browsers always have to check their copy is current, as pages can change at any time
+func (env *wikiEnv) cacheHeaders(w http.ResponseWriter, r *http.Request, hash string, public bool) {
+	class := env.permissionClass(r)
+	w.Header().Set("Etag", `"`+hash+"-"+class+`"`)
+	if public && class == "anonymous" {
+		w.Header().Set("Cache-Control", "public, no-cache")
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+}
+
+// pageMtime returns when a page or file was last changed, from the cache if it is listed there
+// The zero time is returned if it cannot be found at all
+func (env *wikiEnv) pageMtime(name string) time.Time {
+	for _, v := range env.loadCache().Cache {
+		if v.Filename == name && v.ModTime != 0 {
+			return time.Unix(v.ModTime, 0)
+		}
+	}
+	mtime, err := env.store.Mtime(name)
+	if err != nil || mtime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(mtime, 0)
+}
+
+// notModified sets Last-Modified, then replies with 304 Not Modified if If-None-Match lists the ETag already set
+// If-Modified-Since alone is not enough, unlike in http.ServeContent: a rendered page also depends on its backlinks,
+// which pages exist and who is looking, none of which change the page's own mtime, but all of which are in the ETag
+func notModified(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+	if !modtime.IsZero() {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if !etagMatch(r.Header.Get("If-None-Match"), w.Header().Get("Etag")) {
+		return false
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch reports whether an If-None-Match header lists the given ETag, using the weak comparison it calls for
+func etagMatch(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (env *wikiEnv) viewHandler(w http.ResponseWriter, r *http.Request) {
 	defer httputils.TimeTrack(time.Now(), "viewHandler")
 
@@ -589,19 +1227,16 @@ func (env *wikiEnv) viewHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	*/
 
-	wikiExists := wikiExistsFromContext(r.Context())
-	if !wikiExists {
-		httputils.Debugln("wikiExists false: No such file...creating one.")
-		//http.Redirect(w, r, "/edit/"+name, http.StatusTemporaryRedirect)
-		env.createWiki(w, r, name)
-		return
-	}
-
 	// If this is a commit, pass along the SHA1 to that function
+	// Checked before existence, so deleted pages can still be viewed
 	if r.URL.Query().Get("commit") != "" {
 		// Only allow logged in users to view past pages, in case information had to be redacted on a now-public page
 		if env.authState.IsLoggedIn(r) {
 			commit := r.URL.Query().Get("commit")
+			if !validRevision.MatchString(commit) {
+				httpErrorHandler(w, r, errBadRevision)
+				return
+			}
 			//utils.Debugln(r.URL.Query().Get("commit"))
 			env.viewCommitHandler(w, r, commit, name)
 			return
@@ -610,19 +1245,63 @@ func (env *wikiEnv) viewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !isWiki(filepath.Join(env.cfg.WikiDir, name)) {
-		http.ServeFile(w, r, filepath.Join(env.cfg.WikiDir, name))
+	wikiExists := wikiExistsFromContext(r.Context())
+	if !wikiExists {
+		httputils.Debugln("wikiExists false: No such file...creating one.")
+		//http.Redirect(w, r, "/edit/"+name, http.StatusTemporaryRedirect)
+		env.createWiki(w, r, name)
+		return
+	}
+
+	if !env.isWiki(name) {
+		env.serveFile(w, r, name)
+		return
+	}
+
+	raw, err := env.store.ReadFile(name)
+	if err != nil {
+		httpErrorHandler(w, r, err)
+		return
+	}
+	fm := readFront(bytes.NewReader(raw))
+
+	// Pages that have been moved leave a stub behind, pointing to the new name
+	// ?redirect=no allows viewing the stub itself
+	if r.URL.Query().Get("redirect") != "no" && fm.Redirect != "" {
+		// Escape the target, so it always stays a path on this site
+		target := &url.URL{Path: "/" + strings.TrimLeft(fm.Redirect, "/")}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return
+	}
+
+	// Loaded first, as which pages exist is part of the ETag, for links to missing pages
+	theCache := env.loadCache()
+	user := env.authState.GetUser(r)
+	backlinks := theCache.listedBacklinks(name, env.authState.IsLoggedIn(r), user.IsAdmin())
+
+	// Pages are only loaded and rendered if the browser's copy is out of date
+	// The renderer version is part of the ETag, so pages rendered differently are not kept either
+	// So are the pages linking here, as they are listed on the page
+	etag := blobHash(raw) + "-" + env.renderID()
+	if len(backlinks) != 0 {
+		etag += "-" + blobHash([]byte(strings.Join(backlinks, "\n")))[:8]
+	}
+	env.cacheHeaders(w, r, etag, fm.Permission == publicPermission)
+	// Pages for logged in users also show their name, favorites and the git status, none of which are in the ETag,
+	// and flashes are only shown once, so neither are ever answered from the browser's copy
+	if env.authState.IsLoggedIn(r) || flashFromContext(r.Context()) != "" {
+		w.Header().Del("Etag")
+	}
+	if notModified(w, r, env.pageMtime(name)) {
 		return
 	}
 
 	// Get Wiki
 	p := env.loadWikiPage(r, name)
+	p.Backlinks = backlinks
 
 	// Build a list of filenames to be fed to closestmatch, for similarity matching
 	var filelist []string
-	user := env.authState.GetUser(r)
-
-	theCache := env.loadCache()
 
 	// TODO: Replace this with a call to listDir() somehow
 	for _, v := range theCache.Cache {
@@ -694,7 +1373,7 @@ func (env *wikiEnv) historyHandler(w http.ResponseWriter, r *http.Request) {
 
 	wikip := env.loadWikiPage(r, name)
 
-	history, err := env.gitGetFileLog(name)
+	history, err := env.store.FileLog(name)
 	if err != nil {
 		panic(err)
 	}
@@ -717,7 +1396,7 @@ type commitPage struct {
 	Wiki     wiki
 	Commit   string
 	Rendered string
-	Diff     string
+	Hunks    []diffHunk
 }
 
 func (env *wikiEnv) viewCommitHandler(w http.ResponseWriter, r *http.Request, commit, name string) {
@@ -729,38 +1408,40 @@ func (env *wikiEnv) viewCommitHandler(w http.ResponseWriter, r *http.Request, co
 	p := make(chan page, 1)
 	go env.loadPage(r, p)
 
-	body, err := env.gitGetFileCommit(name, commit)
+	// Revisions which do not exist are refused, while pages missing from one that does are not found
+	mtime, err := env.store.CommitTime(commit)
 	if err != nil {
-		panic(err)
-	}
-	ctime, err := env.gitGetCtime(name)
-	if err != nil && err != errNotInGit {
-		panic(err)
+		http.Error(w, errBadRevision.Error(), http.StatusBadRequest)
+		return
 	}
-	mtime, err := env.gitGetFileCommitMtime(commit)
+	body, err := env.store.FileAt(env.revisionPath(name, commit), commit)
 	if err != nil {
-		panic(err)
+		http.NotFound(w, r)
+		return
+	}
+	ctime, err := env.store.Ctime(name)
+	if err != nil && err != errNotInGit {
+		log.WithFields(logrus.Fields{
+			"page":  name,
+			"error": err,
+		}).Errorln("error retrieving creation time of wiki page")
 	}
-	diff, err := env.gitGetFileCommitDiff(name, commit)
+	// Diff against the version before this commit; if there is none, the page was created here
+	before, err := env.fileAtRevision(name, commit+"^")
 	if err != nil {
-		panic(err)
+		before = ""
 	}
 
 	// Read YAML frontmatter into fm
 	reader := bytes.NewReader(body)
 	fm, content := readWikiPage(reader)
-	if err != nil {
-		panic(err)
-	}
 
 	// Render remaining content after frontmatter
-	md := markdownRender(content)
+	md := env.renderMarkdown(content, fm.RawHTML, env.permissionClass(r))
 	//md := commonmarkRender(content)
 
 	pagetitle := setPageTitle(fm.Title, name)
 
-	diffstring := string(diff)
-
 	pageContent = md
 
 	cp := &commitPage{
@@ -775,16 +1456,149 @@ func (env *wikiEnv) viewCommitHandler(w http.ResponseWriter, r *http.Request, co
 		},
 		Commit:   commit,
 		Rendered: pageContent,
-		Diff:     diffstring,
+		Hunks:    fileDiff(before, string(body)),
 	}
 
 	renderTemplate(r.Context(), env, w, "wiki_commit.tmpl", cp)
 
 }
 
+type diffPage struct {
+	page
+	Wiki  wiki
+	From  string
+	To    string
+	Split bool
+	Hunks []diffHunk
+}
+
+// diffHandler compares a page between two revisions, given as ?from= and ?to=
+// The history page submits the two revisions as ?rev=, newest first
+func (env *wikiEnv) diffHandler(w http.ResponseWriter, r *http.Request) {
+	defer httputils.TimeTrack(time.Now(), "diffHandler")
+	name := nameFromContext(r.Context())
+
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if revs := q["rev"]; from == "" && len(revs) == 2 {
+		from, to = revs[1], revs[0]
+	}
+	if to == "" {
+		to = "HEAD"
+	}
+	if !validRevision.MatchString(from) || (to != "HEAD" && !validRevision.MatchString(to)) {
+		env.authState.SetFlash("Select two revisions to compare.", r)
+		http.Redirect(w, r, "/history/"+name, http.StatusSeeOther)
+		return
+	}
+
+	p := make(chan page, 1)
+	go env.loadPage(r, p)
+
+	fromContent, err := env.fileAtRevision(name, from)
+	if err != nil {
+		httpErrorHandler(w, r, err)
+		return
+	}
+	toContent, err := env.fileAtRevision(name, to)
+	if err != nil {
+		httpErrorHandler(w, r, err)
+		return
+	}
+
+	dp := &diffPage{
+		page: <-p,
+		Wiki: wiki{
+			Title:    name,
+			Filename: name,
+		},
+		From:  from,
+		To:    to,
+		Split: q.Get("view") == "split",
+		Hunks: fileDiff(fromContent, toContent),
+	}
+	renderTemplate(r.Context(), env, w, "wiki_diff.tmpl", dp)
+}
+
+// blameChunk is a run of consecutive lines last changed by the same commit
+type blameChunk struct {
+	Filename string
+	Commit   string
+	Author   string
+	Date     int64
+	Summary  string
+	Lines    []blameLine
+}
+
+type blamePage struct {
+	page
+	Wiki        wiki
+	Frontmatter []blameChunk
+	Chunks      []blameChunk
+}
+
+// groupBlame groups consecutive lines of a file by commit
+func groupBlame(filename string, lines []blameLine) []blameChunk {
+	var chunks []blameChunk
+	for _, l := range lines {
+		if n := len(chunks); n > 0 && chunks[n-1].Commit == l.Commit[:7] {
+			chunks[n-1].Lines = append(chunks[n-1].Lines, l)
+			continue
+		}
+		chunks = append(chunks, blameChunk{
+			Filename: filename,
+			Commit:   l.Commit[:7],
+			Author:   l.Author,
+			Date:     l.Date,
+			Summary:  l.Summary,
+			Lines:    []blameLine{l},
+		})
+	}
+	return chunks
+}
+
+// blameHandler shows who last changed each line of a page, and when
+func (env *wikiEnv) blameHandler(w http.ResponseWriter, r *http.Request) {
+	defer httputils.TimeTrack(time.Now(), "blameHandler")
+	name := nameFromContext(r.Context())
+
+	if !wikiExistsFromContext(r.Context()) {
+		http.Redirect(w, r, "/"+name, http.StatusSeeOther)
+		return
+	}
+
+	wikip := env.loadWikiPage(r, name)
+
+	lines, err := env.store.Blame(name)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"page":  name,
+			"error": err,
+		}).Errorln("error getting git blame")
+		http.Error(w, "Unable to fetch git blame", 500)
+		return
+	}
+
+	// Frontmatter is shown separately, collapsed
+	fmLines := env.frontmatterLines(name)
+	if fmLines > len(lines) {
+		fmLines = len(lines)
+	}
+
+	bp := &blamePage{
+		page:        wikip.page,
+		Wiki:        wikip.Wiki,
+		Frontmatter: groupBlame(name, lines[:fmLines]),
+		Chunks:      groupBlame(name, lines[fmLines:]),
+	}
+	renderTemplate(r.Context(), env, w, "wiki_blame.tmpl", bp)
+}
+
 type recent struct {
 	Date      int64
 	Commit    string
+	Author    string
+	Message   string
 	Filenames []string
 }
 
@@ -793,13 +1607,12 @@ type recentsPage struct {
 	Recents []recent
 }
 
-// TODO: Fix this
 func (env *wikiEnv) recentHandler(w http.ResponseWriter, r *http.Request) {
 
 	p := make(chan page, 1)
 	go env.loadPage(r, p)
 
-	gh, err := env.gitHistory()
+	gh, err := env.store.History()
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"error": err,
@@ -808,38 +1621,9 @@ func (env *wikiEnv) recentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	/*
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(200)
-	*/
-	var split []string
-	var split2 []string
-	var recents []recent
-
-	for _, v := range gh {
-		split = strings.Split(strings.TrimSpace(v), " ")
-		date, err := strconv.ParseInt(split[0], 0, 64)
-		if err != nil {
-			panic(err)
-		}
-
-		// If there is a filename (initial one will not have it)...
-		split2 = strings.Split(split[1], "\n")
-		if len(split2) >= 2 {
-
-			r := recent{
-				Date:      date,
-				Commit:    split2[0],
-				Filenames: strings.Split(split2[1], "\n"),
-			}
-			//w.Write([]byte(v + "<br>"))
-			recents = append(recents, r)
-		}
-	}
-
 	s := recentsPage{
 		page:    <-p,
-		Recents: recents,
+		Recents: gh,
 	}
 	renderTemplate(r.Context(), env, w, "recents.tmpl", s)
 
@@ -906,7 +1690,6 @@ func (env *wikiEnv) wikiMiddle(next http.HandlerFunc) http.HandlerFunc {
 		user := env.authState.GetUser(r)
 
 		pageExists, relErr := env.checkName(&name)
-		fullfilename := filepath.Join(env.cfg.WikiDir, name)
 
 		//wikiDir := filepath.Join(dataDir, "wikidata")
 
@@ -928,7 +1711,7 @@ func (env *wikiEnv) wikiMiddle(next http.HandlerFunc) http.HandlerFunc {
 				//    If name/index exists, redirect to it
 				if r.URL.Path[:len("/"+name)] == "/"+name {
 					// Check if name/index exists, and if it does, serve it
-					_, err := os.Stat(filepath.Join(env.cfg.WikiDir, name, "index"))
+					_, err := env.store.Stat(path.Join(name, "index"))
 					if err == nil {
 						http.Redirect(w, r, "/"+path.Join(name, "index"), http.StatusFound)
 						return
@@ -948,7 +1731,7 @@ func (env *wikiEnv) wikiMiddle(next http.HandlerFunc) http.HandlerFunc {
 		ctx := newWikiExistsContext(nameCtx, pageExists)
 		r = r.WithContext(ctx)
 
-		if wikiRejected(fullfilename, pageExists, user.IsAdmin(), env.authState.IsLoggedIn(r)) {
+		if env.wikiRejected(name, pageExists, user.IsAdmin(), env.authState.IsLoggedIn(r)) {
 			mitigateWiki(true, env, r, w)
 		} else {
 			next.ServeHTTP(w, r)
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/gob"
+	"html"
+	"html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"git.sr.ht/~aqtrans/gohttputils"
+	"git.sr.ht/~aqtrans/gowiki/search"
+	log "github.com/sirupsen/logrus"
+)
+
+// Search result weights; a match in a title counts for more than one in the tags, which counts for more than one in the body
+const (
+	titleWeight = 10
+	tagWeight   = 5
+	bodyWeight  = 1
+)
+
+// How much of the page is shown around the first match
+const snippetLength = 200
+
+// searchIndex is an inverted index of every wiki page, kept in DataDir/search.gob next to the cache
+// SHA1 is the commit it was built from, so it can be brought up to date with just the files changed since
+type searchIndex struct {
+	SHA1  string
+	Pages map[string]indexedPage
+	Terms map[string]map[string]termCount
+}
+
+type indexedPage struct {
+	Title      string
+	Permission string
+	// Terms lists every term the page is filed under, so it can be removed again
+	Terms []string
+}
+
+// termCount is how often a term appears in each part of a page
+type termCount struct {
+	Title int
+	Tags  int
+	Body  int
+}
+
+func (c termCount) score() int {
+	return c.Title*titleWeight + c.Tags*tagWeight + c.Body*bodyWeight
+}
+
+type searchHit struct {
+	Name    string
+	Title   string
+	Score   int
+	Snippet template.HTML
+}
+
+// tokenize splits text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchTerms tokenizes a query, dropping repeated words
+func searchTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, term := range tokenize(query) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func newSearchIndex() searchIndex {
+	return searchIndex{
+		Pages: make(map[string]indexedPage),
+		Terms: make(map[string]map[string]termCount),
+	}
+}
+
+// add files the given page under each of its terms
+// The filename is indexed along with the title, since pages are often found by their name
+func (idx *searchIndex) add(name string, fm frontmatter, content []byte) {
+	counts := make(map[string]termCount)
+	for _, term := range tokenize(fm.Title + " " + name) {
+		c := counts[term]
+		c.Title++
+		counts[term] = c
+	}
+	for _, term := range tokenize(strings.Join(fm.Tags, " ")) {
+		c := counts[term]
+		c.Tags++
+		counts[term] = c
+	}
+	for _, term := range tokenize(string(content)) {
+		c := counts[term]
+		c.Body++
+		counts[term] = c
+	}
+
+	p := indexedPage{
+		Title:      fm.Title,
+		Permission: fm.Permission,
+	}
+	for term, c := range counts {
+		if idx.Terms[term] == nil {
+			idx.Terms[term] = make(map[string]termCount)
+		}
+		idx.Terms[term][name] = c
+		p.Terms = append(p.Terms, term)
+	}
+	idx.Pages[name] = p
+}
+
+func (idx *searchIndex) remove(name string) {
+	p, ok := idx.Pages[name]
+	if !ok {
+		return
+	}
+	for _, term := range p.Terms {
+		delete(idx.Terms[term], name)
+		if len(idx.Terms[term]) == 0 {
+			delete(idx.Terms, term)
+		}
+	}
+	delete(idx.Pages, name)
+}
+
+// search returns the pages containing every term, best match first
+// listed decides which pages the user is allowed to see
+func (idx *searchIndex) search(terms []string, listed func(indexedPage) bool) []searchHit {
+	if len(terms) == 0 {
+		return nil
+	}
+	var hits []searchHit
+	for name, c := range idx.Terms[terms[0]] {
+		score := c.score()
+		for _, term := range terms[1:] {
+			other, ok := idx.Terms[term][name]
+			if !ok {
+				score = 0
+				break
+			}
+			score += other.score()
+		}
+		if score == 0 || !listed(idx.Pages[name]) {
+			continue
+		}
+		hits = append(hits, searchHit{
+			Name:  name,
+			Title: idx.Pages[name].Title,
+			Score: score,
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Name < hits[j].Name
+	})
+	return hits
+}
+
+// candidates returns the pages which could hold every one of the given words and phrases, or nil if any page could
+// They are matched anywhere in a page, so their first and last words may only be part of a term in the index,
+// but any words in between must be whole terms
+func (idx *searchIndex) candidates(words []string) map[string]bool {
+	var pages map[string]bool
+	for _, word := range words {
+		terms := tokenize(word)
+		for i, term := range terms {
+			var match func(string) bool
+			switch {
+			case len(terms) == 1:
+				match = func(t string) bool { return strings.Contains(t, term) }
+			case i == 0:
+				match = func(t string) bool { return strings.HasSuffix(t, term) }
+			case i == len(terms)-1:
+				match = func(t string) bool { return strings.HasPrefix(t, term) }
+			}
+
+			found := make(map[string]bool)
+			if match == nil {
+				for name := range idx.Terms[term] {
+					found[name] = true
+				}
+			} else {
+				for t, names := range idx.Terms {
+					if !match(t) {
+						continue
+					}
+					for name := range names {
+						found[name] = true
+					}
+				}
+			}
+
+			if pages == nil {
+				pages = found
+				continue
+			}
+			for name := range pages {
+				if !found[name] {
+					delete(pages, name)
+				}
+			}
+		}
+	}
+	return pages
+}
+
+// indexPage reads the given file and files it in the index, if it is a wiki page
+func (env *wikiEnv) indexPage(idx *searchIndex, name string) {
+	idx.remove(name)
+	if !env.isWiki(name) {
+		return
+	}
+	fm, content := env.readPage(name)
+	idx.add(name, fm, content)
+}
+
+func (env *wikiEnv) buildIndex(head string) searchIndex {
+	defer httputils.TimeTrack(time.Now(), "buildIndex")
+
+	idx := newSearchIndex()
+	if head == "" {
+		return idx
+	}
+	fileList, err := env.store.LsTree()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorln("Error listing files to index")
+		return idx
+	}
+	for _, file := range fileList {
+		if file.Type == "blob" {
+			env.indexPage(&idx, file.Filename)
+		}
+	}
+	idx.SHA1 = head
+	return idx
+}
+
+// loadIndex brings the search index up to date with HEAD and returns it
+// Only the files changed since the index was last saved are read again, unless that commit can no longer be found
+func (env *wikiEnv) loadIndex() *searchIndex {
+	env.indexLock.Lock()
+	defer env.indexLock.Unlock()
+
+	indexPath := filepath.Join(env.cfg.DataDir, "search.gob")
+
+	if env.index.Pages == nil && env.cfg.CacheEnabled {
+		indexFile, err := os.Open(indexPath)
+		if err == nil {
+			err = gob.NewDecoder(indexFile).Decode(&env.index)
+			indexFile.Close()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Errorln("Error loading search index. Rebuilding it.")
+				env.index = searchIndex{}
+			}
+		}
+	}
+
+	head := env.headHash()
+	if env.index.Pages != nil && env.index.SHA1 == head {
+		return &env.index
+	}
+
+	var changed []fileChange
+	var err error
+	if env.index.Pages != nil && env.index.SHA1 != "" && head != "" {
+		changed, err = env.store.ChangedFiles(env.index.SHA1, head)
+	}
+	if env.index.Pages == nil || env.index.SHA1 == "" || head == "" || err != nil {
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorln("Unable to update search index. Rebuilding it.")
+		}
+		log.Println("Building search index...")
+		env.index = env.buildIndex(head)
+	} else {
+		for _, change := range changed {
+			env.indexPage(&env.index, change.Name)
+			if change.From != "" {
+				env.indexPage(&env.index, change.From)
+			}
+		}
+		env.index.SHA1 = head
+	}
+
+	if env.cfg.CacheEnabled {
+		indexFile, err := os.Create(indexPath)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorln("Error creating search index file")
+			return &env.index
+		}
+		err = gob.NewEncoder(indexFile).Encode(&env.index)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorln("Error encoding search index in gob")
+		}
+		indexFile.Close()
+	}
+
+	return &env.index
+}
+
+// searchWiki searches the index for the given query, keeping to the pages the user is allowed to see
+func (env *wikiEnv) searchWiki(query string, isLoggedIn, isAdmin bool) []searchHit {
+	terms := searchTerms(query)
+	idx := env.loadIndex()
+	env.indexLock.Lock()
+	hits := idx.search(terms, func(p indexedPage) bool {
+		return permissionListed(p.Permission, isLoggedIn, isAdmin)
+	})
+	env.indexLock.Unlock()
+	return hits
+}
+
+// queryWiki finds the pages matching a query with operators, phrases or exclusions, best match first
+// Pages are matched against the cache, and only read when the query needs their content
+// and the index shows they could hold every word in it
+func (env *wikiEnv) queryWiki(q search.Query, isLoggedIn, isAdmin bool) []searchHit {
+	theCache := env.loadCache()
+	pageTags := make(map[string][]string)
+	for tag, names := range theCache.Tags {
+		for _, name := range names {
+			pageTags[name] = append(pageTags[name], tag)
+		}
+	}
+
+	// Take what is needed from the index, so it is not locked while pages are read
+	terms := searchTerms(strings.Join(q.Words(), " "))
+	idx := env.loadIndex()
+	titles := make(map[string]string)
+	scores := make(map[string]int)
+	env.indexLock.Lock()
+	candidates := idx.candidates(q.Words())
+	for name, p := range idx.Pages {
+		titles[name] = p.Title
+		for _, term := range terms {
+			scores[name] += idx.Terms[term][name].score()
+		}
+	}
+	env.indexLock.Unlock()
+
+	var hits []searchHit
+	modified := make(map[string]int64)
+	for _, v := range theCache.Cache {
+		title, ok := titles[v.Filename]
+		// Only wiki pages are in the index
+		if v.Type != "blob" || !ok || !permissionListed(v.Permission, isLoggedIn, isAdmin) {
+			continue
+		}
+		if candidates != nil && !candidates[v.Filename] {
+			continue
+		}
+		name := v.Filename
+		doc := &search.Doc{
+			Name:       name,
+			Title:      title,
+			Tags:       pageTags[name],
+			Permission: v.Permission,
+			Created:    time.Unix(v.CreateTime, 0),
+			Modified:   time.Unix(v.ModTime, 0),
+			Content: func() string {
+				_, content := env.readPage(name)
+				return string(content)
+			},
+			Authors: func() []string {
+				return v.Authors
+			},
+		}
+		if !q.Match(doc) {
+			continue
+		}
+		modified[name] = v.ModTime
+		hits = append(hits, searchHit{
+			Name:  name,
+			Title: title,
+			Score: scores[name],
+		})
+	}
+
+	// Without words to rank by, the most recently changed pages come first
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if modified[hits[i].Name] != modified[hits[j].Name] {
+			return modified[hits[i].Name] > modified[hits[j].Name]
+		}
+		return hits[i].Name < hits[j].Name
+	})
+	return hits
+}
+
+// snippet cuts out the part of content around the first of the terms, with every term highlighted
+func snippet(content []byte, terms []string) template.HTML {
+	if len(terms) == 0 {
+		return ""
+	}
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return highlight(string(content), regexp.MustCompile(`(?i)`+strings.Join(quoted, "|")))
+}
+
+// grepSnippet highlights a line found by git grep
+// Regular expressions git understands but Go does not are left unhighlighted
+func grepSnippet(line, term string, regex bool) template.HTML {
+	if !regex {
+		term = regexp.QuoteMeta(term)
+	}
+	pattern, err := regexp.Compile(`(?i)` + term)
+	if err != nil {
+		return template.HTML(html.EscapeString(line))
+	}
+	return highlight(line, pattern)
+}
+
+// highlight cuts out the part of content around the first match of pattern, with every match marked
+func highlight(content string, pattern *regexp.Regexp) template.HTML {
+	text := strings.Join(strings.Fields(content), " ")
+	if text == "" {
+		return ""
+	}
+
+	start := 0
+	if loc := pattern.FindStringIndex(text); loc != nil {
+		start = loc[0] - snippetLength/4
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetLength
+	if end > len(text) {
+		end = len(text)
+	}
+	// Keep to whole words
+	if start > 0 {
+		if i := strings.IndexByte(text[start:end], ' '); i != -1 {
+			start += i + 1
+		}
+	}
+	if end < len(text) {
+		if i := strings.LastIndexByte(text[start:end], ' '); i != -1 {
+			end = start + i
+		}
+	}
+	// Never cut a character in half
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	window := text[start:end]
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	last := 0
+	for _, loc := range pattern.FindAllStringIndex(window, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		b.WriteString(html.EscapeString(window[last:loc[0]]))
+		b.WriteString("<mark>" + html.EscapeString(window[loc[0]:loc[1]]) + "</mark>")
+		last = loc[1]
+	}
+	b.WriteString(html.EscapeString(window[last:]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
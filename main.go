@@ -50,6 +50,7 @@ import (
 	"regexp"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -62,12 +63,15 @@ import (
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 
+	"github.com/microcosm-cc/bluemonday"
 	"github.com/oxtoacart/bpool"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/russross/blackfriday"
 	_ "github.com/tevjef/go-runtime-metrics/expvar"
 
 	auth "git.sr.ht/~aqtrans/goauth/v2"
 	httputils "git.sr.ht/~aqtrans/gohttputils"
+	"git.sr.ht/~aqtrans/gowiki/render"
 	"github.com/justinas/nosurf"
 )
 
@@ -114,19 +118,23 @@ var assetsfs embed.FS
 var templatefs embed.FS
 
 var (
-	debugMode      bool
-	errNotInGit    = errors.New("given file not in Git repo")
-	errNoFile      = errors.New("no such file")
-	errNoDirIndex  = errors.New("no such directory index")
-	errBaseNotDir  = errors.New("cannot create subdirectory of a file")
-	errGitDirty    = errors.New("directory is dirty")
-	errBadPath     = errors.New("given path is invalid")
-	errGitAhead    = errors.New("wiki git repo is ahead; Need to push")
-	errGitBehind   = errors.New("wiki git repo is behind; Need to pull")
-	errGitDiverged = errors.New("wiki git repo has diverged; Need to intervene manually")
-	errIsDir       = errors.New("file is a directory")
-	sha1ver        string // git commit to be set when built
-	buildTime      string // date+time to be set when built
+	debugMode       bool
+	errNotInGit     = errors.New("given file not in Git repo")
+	errNoFile       = errors.New("no such file")
+	errNoDirIndex   = errors.New("no such directory index")
+	errBaseNotDir   = errors.New("cannot create subdirectory of a file")
+	errGitDirty     = errors.New("directory is dirty")
+	errBadPath      = errors.New("given path is invalid")
+	errGitAhead     = errors.New("wiki git repo is ahead; Need to push")
+	errGitBehind    = errors.New("wiki git repo is behind; Need to pull")
+	errGitDiverged  = errors.New("wiki git repo has diverged; Need to intervene manually")
+	errIsDir        = errors.New("file is a directory")
+	errEditConflict = errors.New("page was modified since editing began, and edits overlap")
+	errPageExists   = errors.New("a page with that name already exists")
+	errBadRevision  = errors.New("given revision is invalid")
+	errNotWiki      = errors.New("only wiki pages can be restored")
+	sha1ver         string // git commit to be set when built
+	buildTime       string // date+time to be set when built
 )
 
 type renderer struct {
@@ -154,6 +162,10 @@ type frontmatter struct {
 	Tags       []string `yaml:"tags,omitempty"`
 	Favorite   bool     `yaml:"favorite,omitempty"`
 	Permission string   `yaml:"permission,omitempty"`
+	// Redirect is set on the stub left behind when a page is moved, and holds the new name
+	Redirect string `yaml:"redirect,omitempty"`
+	// RawHTML turns off sanitizing for the page; only admins can set it
+	RawHTML bool `yaml:"rawhtml,omitempty"`
 	//Public     bool     `yaml:"public,omitempty"`
 	//Admin      bool     `yaml:"admin,omitempty"`
 }
@@ -165,6 +177,16 @@ type wiki struct {
 	Content     []byte
 	CreateTime  int64
 	ModTime     int64
+	// BaseCommit is the last commit touching the page when editing began
+	//  save() merges in any changes made since then, instead of overwriting them
+	BaseCommit string
+	// NewPage is set if the page did not exist when editing began
+	//  If someone else has created it by the time it is saved, save() merges with theirs as it would with BaseCommit
+	NewPage bool
+	// Author and Message are used for the commit created by save()
+	//  Author is in the form "Name <email>"; if blank, the wiki's own identity is used
+	Author  string
+	Message string
 }
 
 type genPage struct {
@@ -191,12 +213,18 @@ type gitDirList struct {
 	CreateTime int64
 	ModTime    int64
 	Permission string
+	// Wiki is set for wiki pages, rather than uploads and other files kept alongside them
+	Wiki bool
+	// Authors is everyone who has changed the file, for author: searches
+	Authors []string
 }
 
 type config struct {
 	GitPath        string `yaml:"GitPath,omitempty"`
 	GitCommitEmail string `yaml:"GitCommitEmail,omitempty"`
 	GitCommitName  string `yaml:"GitCommitName,omitempty"`
+	GitAuthorEmail string `yaml:"GitAuthorEmail,omitempty"`
+	Storage        string `yaml:"Storage,omitempty"`
 	DataDir        string `yaml:"DataDir,omitempty"`
 	WikiDir        string `yaml:"WikiDir,omitempty"`
 	Port           string `yaml:"Port,omitempty"`
@@ -209,6 +237,19 @@ type config struct {
 	DebugMode      bool   `yaml:"DebugMode,omitempty"`
 	Prometheus     bool   `yaml:"Prometheus,omitempty"`
 	PrometheusPort string `yaml:"PrometheusPort,omitempty"`
+	// The render cache holds up to RenderCacheEntries pages, and RenderCacheBytes of HTML; -1 disables it
+	RenderCacheEntries int `yaml:"RenderCacheEntries,omitempty"`
+	RenderCacheBytes   int `yaml:"RenderCacheBytes,omitempty"`
+	// Watch picks up changes made to WikiDir outside the wiki straight away; WatchCommit commits them too
+	Watch              bool   `yaml:"Watch,omitempty"`
+	WatchCommit        bool   `yaml:"WatchCommit,omitempty"`
+	WatchCommitMessage string `yaml:"WatchCommitMessage,omitempty"`
+	// Sanitize is the policy rendered pages are cleaned up with; see newSanitizer
+	Sanitize                string   `yaml:"Sanitize,omitempty"`
+	SanitizeAllowElements   []string `yaml:"SanitizeAllowElements,omitempty"`
+	SanitizeAllowAttributes []string `yaml:"SanitizeAllowAttributes,omitempty"`
+	// Renderer picks the Markdown engine pages are rendered with; see newRenderer
+	Renderer string `yaml:"Renderer,omitempty"`
 }
 
 // Env wrapper to hold app-specific configs, to pass to handlers
@@ -216,22 +257,40 @@ type config struct {
 // pageWriteLock locks the entire repo upon wiki page saving
 type wikiEnv struct {
 	cfg           config
+	store         Store
 	authState     auth.State
 	cache         wikiCache
 	templates     map[string]*template.Template
 	pageWriteLock sync.Mutex
 	cacheLock     sync.Mutex
+	index         searchIndex
+	indexLock     sync.Mutex
+	renders       *renderCache
+	sanitizer     *bluemonday.Policy
+	goldmark      *render.Renderer
 	pool          *bpool.BufferPool
 	favs
 	tags
 	testing bool
 }
 
+// cacheVersion is saved along with the cache; caches saved with another version are rebuilt
+// Bump it whenever the cache gains something which has to be read from every page
+const cacheVersion = 3
+
 type wikiCache struct {
-	SHA1  string
-	Cache []gitDirList
-	Tags  map[string][]string
-	Favs  map[string]struct{}
+	Version int
+	SHA1    string
+	Cache   []gitDirList
+	Tags    map[string][]string
+	Favs    map[string]struct{}
+	// Links and Images hold the pages each page links to and the images it shows, as written; see pageLinks
+	Links  map[string][]string
+	Images map[string][]string
+	// names, namesID and backlinks are built from the above by index, rather than saved
+	names     map[string]string
+	namesID   string
+	backlinks map[string][]string
 }
 
 type favs struct {
@@ -318,11 +377,19 @@ func loadConfig(confFile string) config {
 		cfg.Port = "5000"
 	}
 
+	if cfg.Storage == "" {
+		cfg.Storage = "git"
+	}
+
 	// Look for git, if GitPath is not defined in the config file
-	if cfg.GitPath == "" {
+	// Only the default storage backend needs it
+	if cfg.Storage == "memory" {
+		log.Println("Storage is set to \"memory\"; all pages will be lost when the wiki is stopped.")
+	}
+	if cfg.GitPath == "" && cfg.Storage == "git" {
 		gitPath, err := exec.LookPath("git")
 		if err != nil {
-			log.Fatalln("Git executable was not found in PATH. Git must be installed. Install Git or define it as GitPath in", confFile)
+			log.Fatalln("Git executable was not found in PATH. Git must be installed, or Storage set to \"gogit\". Install Git or define it as GitPath in", confFile)
 		}
 		if err == nil {
 			cfg.GitPath = gitPath
@@ -338,13 +405,57 @@ func markdownRender(input []byte) string {
 
 	unsanitized := blackfriday.MarkdownOptions(input, renderer, blackfriday.Options{
 		Extensions: commonExtensions})
-	//p := bluemonday.UGCPolicy()
-	//p.AllowElements("nav", "input", "li")
-	//return string(p.SanitizeBytes(unsanitized))
+	// Sanitized afterwards by env.sanitize, as the policy depends on the config
 
 	return string(unsanitized)
 }
 
+// newRenderer returns the goldmark renderer if it is selected by Renderer in the config
+//
+//	"blackfriday", the default, renders pages as the wiki always has
+//	"goldmark" renders them as CommonMark, with the same extensions; see the render package
+//
+// nil is returned for blackfriday, while both are around during the move to goldmark
+func newRenderer(cfg config) (*render.Renderer, error) {
+	switch cfg.Renderer {
+	case "", "blackfriday":
+		return nil, nil
+	case "goldmark":
+		return render.New(render.Options{TaskIcon: taskIcon}), nil
+	}
+	return nil, errors.New("unknown renderer: " + cfg.Renderer)
+}
+
+// markdownRender renders a page with the Markdown engine set in the config
+// [[wikilinks]] are resolved for a viewer of the given permissionClass, so pages they cannot see are linked as missing
+func (env *wikiEnv) markdownRender(input []byte, class string) string {
+	if env.goldmark == nil {
+		return env.wikiLinks(markdownRender(input), class)
+	}
+	defer httputils.TimeTrack(time.Now(), "markdownRender")
+	html, err := env.goldmark.Render(input, env.linkResolver(class))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorln("Error rendering Markdown")
+		return ""
+	}
+	return string(html)
+}
+
+// renderID identifies how pages are rendered, for the render cache and ETags
+// It includes which pages exist, as links to missing pages are rendered differently
+func (env *wikiEnv) renderID() string {
+	id := renderVersion
+	if env.goldmark != nil {
+		id += "-goldmark"
+	}
+	if pages := env.pageSetID(); pages != "" {
+		id += "-" + pages
+	}
+	return id
+}
+
 func svg(iconName string) template.HTML {
 	// MAJOR TODO:
 	// Check for file existence before trying to read the file; if non-existent return ""
@@ -367,21 +478,31 @@ func svgByte(iconName string) []byte {
 	return []byte(`<div class="svg-icon">` + string(iconFile) + `</div>`)
 }
 
+// taskIcon returns the SVG shown for a task list checkbox
+func taskIcon(checked bool) []byte {
+	if checked {
+		return svgByte("checkbox-checked")
+	}
+	return svgByte("checkbox-unchecked")
+}
+
 // Task List support, replacing checkboxs with an SVG for more visibility
 func (r *renderer) ListItem(out *bytes.Buffer, text []byte, flags int) {
 	switch {
 	case bytes.HasPrefix(text, []byte("[ ] ")):
-		text = append(svgByte("checkbox-unchecked"), text[3:]...)
+		text = append(taskIcon(false), text[3:]...)
 	case bytes.HasPrefix(text, []byte("[x] ")) || bytes.HasPrefix(text, []byte("[X] ")):
-		text = append(svgByte("checkbox-checked"), text[3:]...)
+		text = append(taskIcon(true), text[3:]...)
 	}
 	r.Html.ListItem(out, text, flags)
 }
 
+// linkPattern matches inter-wiki links, [PageName]() and [/PageName]()
+var linkPattern = regexp.MustCompile(`\[(?:\/|)(?P<Name>[0-9a-zA-Z-_\.\/]+)\]\(\)`)
+
 // Inter-wiki linking, [PageName]() and [/PageName]()
+// [[Page Name]] links are handled by wikiLinks, once the page is rendered
 func (r *renderer) NormalText(out *bytes.Buffer, text []byte) {
-	linkPattern := regexp.MustCompile(`\[(?:\/|)(?P<Name>[0-9a-zA-Z-_\.\/]+)\]\(\)`)
-
 	switch {
 	case linkPattern.Match(text):
 		//joinedText := path.Join(viper.GetString("Domain"), string(text))
@@ -687,6 +808,19 @@ func readFileAndFront(filename string) (frontmatter, []byte) {
 	return fm, content
 }
 
+// readPage reads a page from the Store, split into frontmatter and content
+func (env *wikiEnv) readPage(name string) (frontmatter, []byte) {
+	f, err := env.store.Open(name)
+	if err != nil {
+		log.Debugln("Error in readPage:", err)
+		return frontmatter{}, []byte("")
+	}
+
+	fm, content := readWikiPage(f)
+	f.Close()
+	return fm, content
+}
+
 func readWikiPage(reader io.Reader) (frontmatter, []byte) {
 	topbuf := new(bytes.Buffer)
 	bottombuf := new(bytes.Buffer)
@@ -695,6 +829,23 @@ func readWikiPage(reader io.Reader) (frontmatter, []byte) {
 	return marshalFrontmatter(topbuf.Bytes()), bottombuf.Bytes()
 }
 
+// frontmatterLines counts the lines of a page taken up by frontmatter, as parsed by scanWikiPage
+func (env *wikiEnv) frontmatterLines(name string) int {
+	f, err := env.store.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	topbuf := new(bytes.Buffer)
+	scanWikiPage(f, topbuf)
+	if topbuf.Len() == 0 {
+		return 0
+	}
+	// The opening separator is not kept in the buffer, but the closing one is
+	return bytes.Count(topbuf.Bytes(), []byte("\n")) + 1
+}
+
 func readFront(reader io.Reader) frontmatter {
 	topbuf := new(bytes.Buffer)
 	scanWikiPage(reader, topbuf)
@@ -931,13 +1082,13 @@ func parseBool(value string) bool {
 
 // doesPageExist checks if the given name exists, and is a regular file
 // If there is anything wrong, it panics
-func doesPageExist(name string) (bool, error) {
+func (env *wikiEnv) doesPageExist(name string) (bool, error) {
 	defer httputils.TimeTrack(time.Now(), "doesPageExist")
 
 	var exists bool
 	var finError error
 
-	fileInfo, err := os.Stat(name)
+	fileInfo, err := env.store.Stat(name)
 	if err == nil {
 		fileMode := fileInfo.Mode()
 		if fileMode.IsRegular() {
@@ -968,6 +1119,15 @@ func doesPageExist(name string) (bool, error) {
 func (env *wikiEnv) relativePathCheck(name string) error {
 	defer httputils.TimeTrack(time.Now(), "relativePathCheck")
 	fullfilename := filepath.Join(env.cfg.WikiDir, name)
+
+	rel, err := filepath.Rel(env.cfg.WikiDir, fullfilename)
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errBadPath
+	}
+
 	dir, _ := filepath.Split(name)
 	if dir != "" {
 		dirErr := env.checkDir(dir)
@@ -976,8 +1136,7 @@ func (env *wikiEnv) relativePathCheck(name string) error {
 		}
 	}
 
-	_, err := filepath.Rel(env.cfg.WikiDir, fullfilename)
-	return err
+	return nil
 }
 
 // This does various checks to see if an existing page exists or not
@@ -990,9 +1149,6 @@ func (env *wikiEnv) relativePathCheck(name string) error {
 func (env *wikiEnv) checkName(name *string) (bool, error) {
 	defer httputils.TimeTrack(time.Now(), "checkName")
 
-	separators := regexp.MustCompile(`[ &_=+:]`)
-	dashes := regexp.MustCompile(`[\-]+`)
-
 	// Rely on httptreemux's Clean function to clean up ../ and other potential path-escaping sequences;
 	//  stripping off the / so we can pass it along to git
 	//*name = httptreemux.Clean(*name)
@@ -1024,21 +1180,16 @@ func (env *wikiEnv) checkName(name *string) (bool, error) {
 		return false, relErr
 	}
 
-	// Build the full path
-
-	fullfilename := filepath.Join(env.cfg.WikiDir, *name)
-
-	exists, err := doesPageExist(fullfilename)
+	exists, err := env.doesPageExist(*name)
 	if err == errIsDir {
 		return false, errIsDir
 	}
 
 	// If name doesn't exist, and there is no file extension given, try .page and then .md
 	if !exists {
-		possbileExts := []string{".md", ".page"}
-		for _, ext := range possbileExts {
+		for _, ext := range pageExtensions {
 			if !exists && (filepath.Ext(*name) == "") {
-				existsWithExt, _ := doesPageExist(fullfilename + ext)
+				existsWithExt, _ := env.doesPageExist(*name + ext)
 				if existsWithExt {
 					*name = *name + ext
 					log.Debugln(*name + " found!")
@@ -1052,13 +1203,10 @@ func (env *wikiEnv) checkName(name *string) (bool, error) {
 	// If original filename does not exist, normalize the filename, and check if that exists
 	if !exists {
 		// Normalize the name if the original name doesn't exist
-		normalName := strings.ToLower(*name)
-		normalName = separators.ReplaceAllString(normalName, "-")
-		normalName = dashes.ReplaceAllString(normalName, "-")
-		fullnewfilename := filepath.Join(env.cfg.WikiDir, normalName)
+		normalName := normalizeName(*name)
 		// Only check for the existence of the normalized name if anything changed
 		if normalName != *name {
-			exists, err = doesPageExist(fullnewfilename)
+			exists, err = env.doesPageExist(normalName)
 			if err == errIsDir {
 				return false, errIsDir
 			}
@@ -1084,53 +1232,45 @@ func (env *wikiEnv) checkDir(dir string) error {
 	for _, v := range dirs {
 		// relpath progressively builds up the /path/to/file, element by element
 		relpath = filepath.Join(relpath, v)
-		// We combine that with the configured WikiDir to get the fullpath
-		fullpath := filepath.Join(env.cfg.WikiDir, relpath)
-		// Then try and open the fullpath to the element in question
-		file, fileOpenErr := os.Open(fullpath)
+		// Then try and stat the element in question
+		fileInfo, fileInfoErr := env.store.Stat(relpath)
 		// If it doesn't exist, move on
-		if os.IsNotExist(fileOpenErr) {
+		if os.IsNotExist(fileInfoErr) {
 			err = nil
-		} else if fileOpenErr != nil && !os.IsNotExist(fileOpenErr) {
-			err = fileOpenErr
+		} else if fileInfoErr != nil {
+			log.Println("Unhandled checkDir/fileInfo error: ")
+			err = fileInfoErr
 			break
-		} else if fileOpenErr == nil {
-			fileInfo, fileInfoErr := file.Stat()
-			// If there is an error, and it's not just a non-existent file, panic
-			if fileInfoErr != nil && !os.IsNotExist(fileInfoErr) {
-				log.Println("Unhandled checkDir/fileInfo error: ")
-				err = fileInfoErr
+		} else {
+			// If the 'file' exists, now determine if it's a file or a directory
+			fileMode := fileInfo.Mode()
+			// I believe this should be the only path to success...
+			if fileMode.IsDir() {
+				err = nil
+			} else {
+				err = errBaseNotDir
 				break
 			}
-			if fileInfoErr == nil {
-				// If the 'file' can be opened, now determine if it's a file or a directory
-				fileMode := fileInfo.Mode()
-				// I believe this should be the only path to success...
-				if fileMode.IsDir() {
-					err = nil
-				} else {
-					err = errBaseNotDir
-					break
-				}
-			}
 		}
 	}
 	return err
 }
 
-func isWiki(fullFilename string) bool {
-	var isWiki bool
-	file, err := os.Open(fullFilename)
+func (env *wikiEnv) isWiki(name string) bool {
+	file, err := env.store.Open(name)
 	if err != nil {
-		isWiki = false
+		return false
 	}
 
 	defer file.Close()
 	buff := make([]byte, 512)
-	_, err = file.Read(buff)
-	if err != nil {
-		isWiki = false
-	}
+	file.Read(buff)
+	return isWikiContent(name, buff)
+}
+
+// isWikiContent checks whether the start of a file's content looks like a wiki page
+func isWikiContent(filename string, buff []byte) bool {
+	var isWiki bool
 	filetype := http.DetectContentType(buff)
 	if filetype == "application/octet-stream" {
 		// Definitely wiki page...but others probably
@@ -1139,7 +1279,7 @@ func isWiki(fullFilename string) bool {
 		}
 
 		// Account for .page files from gitit
-		if filepath.Ext(fullFilename) == ".page" || filepath.Ext(fullFilename) == ".md" {
+		if filepath.Ext(filename) == ".page" || filepath.Ext(filename) == ".md" {
 			isWiki = true
 		}
 		// TODO Fixes gitit-created files, until I can figure out a better way
@@ -1161,7 +1301,7 @@ func (env *wikiEnv) loadWiki(name string, w chan<- wiki) {
 	mtime := make(chan int64, 1)
 	go env.gitGetTimes(name, ctime, mtime)
 
-	fm, content := readFileAndFront(filepath.Join(env.cfg.WikiDir, name))
+	fm, content := env.readPage(name)
 
 	pagetitle := setPageTitle(fm.Title, name)
 
@@ -1189,6 +1329,7 @@ type wikiPage struct {
 	Wiki         wiki
 	Rendered     string
 	SimilarPages []string
+	Backlinks    []string
 }
 
 func (env *wikiEnv) loadWikiPage(r *http.Request, name string) wikiPage {
@@ -1216,7 +1357,7 @@ func (env *wikiEnv) loadWikiPage(r *http.Request, name string) wikiPage {
 		wc := make(chan wiki, 1)
 		go env.loadWiki(name, wc)
 		theWiki = <-wc
-		md = markdownRender(theWiki.Content)
+		md = env.renderMarkdown(theWiki.Content, theWiki.Frontmatter.RawHTML, env.permissionClass(r))
 	}
 
 	//md := commonmarkRender(wikip.Content)
@@ -1230,79 +1371,78 @@ func (env *wikiEnv) loadWikiPage(r *http.Request, name string) wikiPage {
 	return wp
 }
 
+// encode builds the on-disk representation of a wiki page; YAML frontmatter followed by the content
+func (wiki *wiki) encode() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteString(yamlSeparator + "\n")
+	yamlBuffer, err := yaml.Marshal(wiki.Frontmatter)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(yamlBuffer)
+	buf.WriteString(yamlSeparator + "\n")
+	buf.Write(wiki.Content)
+
+	return buf.Bytes(), nil
+}
+
+// commitAuthor returns the git author, in the form "Name <email>", for commits made by the given user
+// If there is no user, it returns "" so the wiki's own identity is used
+func (env *wikiEnv) commitAuthor(user *auth.User) string {
+	if !user.IsValid() {
+		return ""
+	}
+	email := env.cfg.GitCommitEmail
+	if env.cfg.GitAuthorEmail != "" {
+		email = strings.Replace(env.cfg.GitAuthorEmail, "{username}", user.GetName(), -1)
+	}
+	return user.GetName() + " <" + email + ">"
+}
+
 func (wiki *wiki) save(env *wikiEnv) error {
 	env.pageWriteLock.Lock()
 	defer httputils.TimeTrack(time.Now(), "wiki.save()")
 
 	dir, filename := filepath.Split(wiki.Filename)
-	fullfilename := filepath.Join(env.cfg.WikiDir, dir, filename)
 
-	// If directory doesn't exist, create it
-	// - Check if dir is null first
-	if dir != "" {
-		dirpath := filepath.Join(env.cfg.WikiDir, dir)
-		if _, err := os.Stat(dirpath); os.IsNotExist(err) {
-			err := os.MkdirAll(dirpath, 0755)
-			if err != nil {
-				env.pageWriteLock.Unlock()
-				return err
-			}
-		}
-	}
 	/*
 		originalFile, err := ioutil.ReadFile(fullfilename)
 		checkErr("wiki.save()/ReadFile", err)
 	*/
 
-	// Create a buffer where we build the content of the file
-	var f *os.File
-	var err error
-	f, err = os.OpenFile(fullfilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		env.pageWriteLock.Unlock()
-		return err
-	}
-
-	//buffer := new(bytes.Buffer)
-	wb := bufio.NewWriter(f)
-
-	_, err = wb.WriteString("---\n")
-	if err != nil {
-		env.pageWriteLock.Unlock()
-		return err
-	}
-
-	yamlBuffer, err := yaml.Marshal(wiki.Frontmatter)
-	if err != nil {
-		env.pageWriteLock.Unlock()
-		return err
-	}
-
-	_, err = wb.Write(yamlBuffer)
-	if err != nil {
-		env.pageWriteLock.Unlock()
-		return err
-	}
+	gitfilename := dir + filename
 
-	_, err = wb.WriteString("---\n")
-	if err != nil {
-		env.pageWriteLock.Unlock()
-		return err
+	// If someone else has saved or created the page since editing began, try to merge both edits
+	changed := false
+	if wiki.BaseCommit != "" {
+		lastCommit, err := env.store.LastCommit(gitfilename)
+		if err != nil {
+			env.pageWriteLock.Unlock()
+			return err
+		}
+		changed = lastCommit != "" && lastCommit != wiki.BaseCommit
+	} else if wiki.NewPage {
+		_, err := env.store.Stat(gitfilename)
+		changed = err == nil
 	}
-
-	_, err = wb.Write(wiki.Content)
-	if err != nil {
-		env.pageWriteLock.Unlock()
-		return err
+	if changed {
+		err := env.mergeWiki(wiki, gitfilename)
+		if err != nil {
+			env.pageWriteLock.Unlock()
+			return err
+		}
+		log.Println(gitfilename + " was changed since editing began; edits merged.")
 	}
 
-	err = wb.Flush()
+	pageBytes, err := wiki.encode()
 	if err != nil {
 		env.pageWriteLock.Unlock()
 		return err
 	}
 
-	err = f.Close()
+	// Write the page, creating its directory if need be
+	err = env.store.WriteFile(gitfilename, pageBytes)
 	if err != nil {
 		env.pageWriteLock.Unlock()
 		return err
@@ -1327,29 +1467,30 @@ func (wiki *wiki) save(env *wikiEnv) error {
 		}
 	*/
 
-	gitfilename := dir + filename
-
-	err = env.gitAddFilepath(gitfilename)
+	err = env.store.Add(gitfilename)
 	if err != nil {
 		env.pageWriteLock.Unlock()
 		return err
 	}
 
-	// FIXME: add a message box to edit page, check for it here
-	err = env.gitCommitEmpty()
+	msg := wiki.Message
+	if msg == "" {
+		msg = gitfilename + " has been updated."
+	}
+	err = env.store.Commit(wiki.Author, msg)
 	if err != nil {
 		env.pageWriteLock.Unlock()
 		return err
 	}
 
-	log.Println(fullfilename + " has been saved.")
+	log.Println(gitfilename + " has been saved.")
 	env.pageWriteLock.Unlock()
 
 	//go env.refreshStuff()
 
 	// If PushOnSave is enabled and RemoteGitRepo is configured, push to remote repo after save
 	if env.cfg.PushOnSave && (env.cfg.RemoteGitRepo != "") {
-		err := env.gitPush()
+		err := env.store.Push()
 		if err != nil {
 			//panic(err)
 			log.Println("error pushing to remote git repo:", err)
@@ -1422,6 +1563,11 @@ func initWikiDir(cfg config) error {
 		return errors.New(cfg.DataDir + "is not a directory. This is where wiki data is stored.")
 	}
 
+	// In-memory wikis have nothing more to set up on disk
+	if cfg.Storage == "memory" {
+		return nil
+	}
+
 	//Check for wikiDir directory + git repo existence
 	_, err = os.Stat(cfg.WikiDir)
 	if err != nil && os.IsNotExist(err) {
@@ -1434,10 +1580,11 @@ func initWikiDir(cfg config) error {
 	_, err = os.Stat(filepath.Join(cfg.WikiDir, ".git"))
 	if err != nil && os.IsNotExist(err) {
 		log.Println("Initializing git repository at", cfg.WikiDir)
-		env := &wikiEnv{
-			cfg: cfg,
+		store, err := newStore(cfg)
+		if err != nil {
+			return err
 		}
-		err := env.gitInit()
+		err = store.Init()
 		if err != nil {
 			return err
 		}
@@ -1458,25 +1605,101 @@ func setPageTitle(frontmatterTitle, filename string) string {
 	return onlyFileName
 }
 
+// treeEntry is how directories are listed in the cache; they are just assumed to be private
+func treeEntry(name string) gitDirList {
+	return gitDirList{
+		Type:       "tree",
+		Filename:   name,
+		CreateTime: 0,
+		ModTime:    0,
+		Permission: "private",
+	}
+}
+
+// pageTimes looks up the creation and modification times and authors of a single file
+func (env *wikiEnv) pageTimes(filename string) fileTimes {
+	ctime := make(chan int64, 1)
+	mtime := make(chan int64, 1)
+	go env.gitGetTimes(filename, ctime, mtime)
+	var authors []string
+	commits, err := env.store.FileLog(filename)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"file":  filename,
+			"error": err,
+		}).Errorln("Error loading file history")
+	}
+	for _, commit := range commits {
+		if !slices.Contains(authors, commit.Author) {
+			authors = append(authors, commit.Author)
+		}
+	}
+	return fileTimes{Ctime: <-ctime, Mtime: <-mtime, Authors: authors}
+}
+
+// cacheEntry reads the frontmatter of a file, to be listed in the cache along with its times
+// The other pages it links to and the images it shows are returned too, if it is a wiki page
+func (env *wikiEnv) cacheEntry(filename string, times fileTimes) (gitDirList, frontmatter, []string, []string, error) {
+	content, err := env.store.ReadFile(filename)
+	if err != nil {
+		return gitDirList{}, frontmatter{}, nil, nil, err
+	}
+	// Read YAML frontmatter into fm
+	fm, body := readWikiPage(bytes.NewReader(content))
+
+	var links, images []string
+	isWiki := isWikiContent(filename, content[:min(len(content), 512)])
+	if isWiki {
+		links, images = pageLinks(filename, body)
+	}
+
+	if fm.Title == "" {
+		fm.Title = filename
+	}
+	if fm.Permission == "" {
+		fm.Permission = "private"
+	}
+
+	wp := gitDirList{
+		Type:       "blob",
+		Filename:   filename,
+		CreateTime: times.Ctime,
+		ModTime:    times.Mtime,
+		Permission: fm.Permission,
+		Wiki:       isWiki,
+		Authors:    times.Authors,
+	}
+	return wp, fm, links, images, nil
+}
+
+// addFront files a page under its tags, and in the favorites if it is one
+func (c *wikiCache) addFront(filename string, fm frontmatter) {
+	if fm.Favorite {
+		c.Favs[filename] = struct{}{}
+	}
+	for _, tag := range fm.Tags {
+		c.Tags[tag] = append(c.Tags[tag], filename)
+	}
+}
+
 func (env *wikiEnv) buildCache() wikiCache {
 	defer httputils.TimeTrack(time.Now(), "buildCache")
 
 	var newCache wikiCache
+	newCache.Version = cacheVersion
 	newCache.Tags = make(map[string][]string)
 	newCache.Favs = make(map[string]struct{})
+	newCache.Links = make(map[string][]string)
+	newCache.Images = make(map[string][]string)
 
-	//env.cache.m.Lock()
-	//defer env.cache.m.Unlock()
-	/*
-		cache := new(wikiCache)
-		cache.Tags = make(map[string][]string)
-		cache.Favs = make(map[string]struct{})
-	*/
 	var wps []gitDirList
 
-	if !env.gitIsEmpty() {
+	if !env.store.IsEmpty() {
 
-		fileList, err := env.gitLsTree()
+		// Taken first, so any commits made while the cache is built are picked up next time
+		head := env.headHash()
+
+		fileList, err := env.store.LsTree()
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"error": err,
@@ -1484,145 +1707,264 @@ func (env *wikiEnv) buildCache() wikiCache {
 			return wikiCache{}
 		}
 
-		for _, file := range fileList {
+		// Every file's times are found at once, rather than walking history twice per file
+		times, err := env.store.FileTimes()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Errorln("Error loading file times from git")
+			return wikiCache{}
+		}
 
-			// If using Git, build the full path:
-			fullname := filepath.Join(env.cfg.WikiDir, file.Filename)
+		for _, file := range fileList {
 
 			// If this is a directory, add it to the list for listing
 			//   but just assume it is private
 			if file.Type == "tree" {
-				var wp gitDirList
-				wp = gitDirList{
-					Type:       "tree",
-					Filename:   file.Filename,
-					CreateTime: 0,
-					ModTime:    0,
-					Permission: "private",
-				}
-				wps = append(wps, wp)
+				wps = append(wps, treeEntry(file.Filename))
 			}
 
 			// If not a directory, get frontmatter from file and add to list
 			if file.Type == "blob" {
-
-				// If this is an absolute path, including the cfg.WikiDir, trim it
-				//withoutdotslash := strings.TrimPrefix(viper.GetString("WikiDir"), "./")
-				//fileURL := strings.TrimPrefix(file, withoutdotslash)
-
-				ctime := make(chan int64, 1)
-				mtime := make(chan int64, 1)
-				go env.gitGetTimes(file.Filename, ctime, mtime)
-
-				var wp gitDirList
-
-				// Read YAML frontmatter into fm
-				f, err := os.Open(fullname)
+				wp, fm, links, images, err := env.cacheEntry(file.Filename, times[file.Filename])
 				if err != nil {
 					log.WithFields(logrus.Fields{
 						"error": err,
-						"file":  f.Name(),
+						"file":  file.Filename,
 					}).Errorln("Error opening file")
 					return wikiCache{}
 				}
 
-				fm := readFront(f)
-				//fm, content := readWikiPage(f)
-				f.Close()
-				//checkErr("crawlWiki()/readFront", err)
-
-				if fm.Title == "" {
-					fm.Title = file.Filename
-				}
-				if fm.Permission == "" {
-					fm.Permission = "private"
-				}
-				if fm.Favorite != true {
-					fm.Favorite = false
-				}
-				if fm.Tags == nil {
-					fm.Tags = []string{}
-				}
-
 				// Tags and Favorites building
-				// Replacing readFavs and readTags
-				if fm.Favorite {
-					//cache.Favs.LoadOrStore(file.Filename)
-					if _, ok := newCache.Favs[file.Filename]; !ok {
-						log.Debugln("buildCache.favs: " + file.Filename + " is not already a favorite.")
-						newCache.Favs[file.Filename] = struct{}{}
-					}
-				}
-				if fm.Tags != nil {
-					//cache.Tags.LoadOrStore(fm.Tags, file.Filename)
-					for _, tag := range fm.Tags {
-						newCache.Tags[tag] = append(newCache.Tags[tag], file.Filename)
-					}
-				}
-				/*
-					ctime, err := gitGetCtime(file.Filename)
-					check(err)
-					mtime, err := gitGetMtime(file.Filename)
-					check(err)
-				*/
-
-				wp = gitDirList{
-					Type:       "blob",
-					Filename:   file.Filename,
-					CreateTime: <-ctime,
-					ModTime:    <-mtime,
-					Permission: fm.Permission,
-				}
+				newCache.addFront(file.Filename, fm)
+				newCache.addLinks(file.Filename, links, images)
 				wps = append(wps, wp)
 			}
 		}
-		newCache.SHA1 = env.headHash()
+		newCache.SHA1 = head
 	}
 
 	newCache.Cache = wps
+	newCache.index()
 
-	if env.cfg.CacheEnabled {
-		cacheFile, err := os.Create(filepath.Join(env.cfg.DataDir, "cache.gob"))
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"error": err,
-			}).Errorln("Error creating cache file")
-			return wikiCache{}
+	err := env.saveCache(newCache)
+	if err != nil {
+		return wikiCache{}
+	}
+
+	log.Println("Cache built.")
+	return newCache
+}
+
+// updateCache brings the given cache up to date with HEAD, only reading the files changed since it was built
+// If the commit it was built from can no longer be found, such as after a force push, it is rebuilt from scratch
+func (env *wikiEnv) updateCache(old wikiCache) wikiCache {
+	if old.Cache == nil || old.SHA1 == "" {
+		return env.buildCache()
+	}
+	head := env.headHash()
+	if head == old.SHA1 {
+		return old
+	}
+	changes, err := env.store.ChangedFiles(old.SHA1, head)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"sha1":  old.SHA1,
+			"error": err,
+		}).Errorln("Unable to update cache. Rebuilding it.")
+		return env.buildCache()
+	}
+	defer httputils.TimeTrack(time.Now(), "updateCache")
+
+	changed := make(map[string]bool)
+	for _, change := range changes {
+		changed[change.Name] = true
+		if change.From != "" {
+			changed[change.From] = true
+		}
+	}
+
+	// Everything is copied, as the old cache may still be in use
+	newCache := wikiCache{
+		Version: cacheVersion,
+		SHA1:    head,
+		Tags:    make(map[string][]string),
+		Favs:    make(map[string]struct{}),
+		Links:   make(map[string][]string),
+		Images:  make(map[string][]string),
+	}
+	for tag, names := range old.Tags {
+		for _, name := range names {
+			if !changed[name] {
+				newCache.Tags[tag] = append(newCache.Tags[tag], name)
+			}
 		}
-		cacheEncoder := gob.NewEncoder(cacheFile)
-		err = cacheEncoder.Encode(&newCache)
+	}
+	for name := range old.Favs {
+		if !changed[name] {
+			newCache.Favs[name] = struct{}{}
+		}
+	}
+	for name, links := range old.Links {
+		if !changed[name] {
+			newCache.Links[name] = links
+		}
+	}
+	for name, images := range old.Images {
+		if !changed[name] {
+			newCache.Images[name] = images
+		}
+	}
+	var wps []gitDirList
+	for _, v := range old.Cache {
+		if v.Type == "blob" && !changed[v.Filename] {
+			wps = append(wps, v)
+		}
+	}
+
+	for _, change := range changes {
+		if change.Status == 'D' {
+			continue
+		}
+		// Only a few files usually change, so their times are looked up one by one
+		wp, fm, links, images, err := env.cacheEntry(change.Name, env.pageTimes(change.Name))
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"error": err,
-			}).Errorln("Error encoding cache in gob")
-			return wikiCache{}
+				"file":  change.Name,
+			}).Errorln("Error opening file. Rebuilding cache.")
+			return env.buildCache()
 		}
-		err = cacheFile.Close()
-		if err != nil {
+		newCache.addFront(change.Name, fm)
+		newCache.addLinks(change.Name, links, images)
+		wps = append(wps, wp)
+	}
+
+	// List every directory still holding a file, as `git ls-tree -t` does
+	dirs := make(map[string]bool)
+	for _, v := range wps {
+		for dir := path.Dir(v.Filename); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	for dir := range dirs {
+		wps = append(wps, treeEntry(dir))
+	}
+
+	// Keep everything in the order a full rebuild would have
+	sortTree(wps)
+	for _, names := range newCache.Tags {
+		sort.Strings(names)
+	}
+	newCache.Cache = wps
+	newCache.index()
+
+	err = env.saveCache(newCache)
+	if err != nil {
+		return env.buildCache()
+	}
+
+	log.Println("Cache updated.")
+	return newCache
+}
+
+// sortTree sorts files in the order git lists them, where directories sort as if they end in a slash
+func sortTree(files []gitDirList) {
+	key := func(v gitDirList) string {
+		if v.Type == "tree" {
+			return v.Filename + "/"
+		}
+		return v.Filename
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return key(files[i]) < key(files[j])
+	})
+}
+
+// readCache loads the cache saved in DataDir, or returns an empty one
+func (env *wikiEnv) readCache() wikiCache {
+	var c wikiCache
+	if !env.cfg.CacheEnabled {
+		return c
+	}
+	cacheFile, err := os.Open(filepath.Join(env.cfg.DataDir, "cache.gob"))
+	if err != nil {
+		if !os.IsNotExist(err) {
 			log.WithFields(logrus.Fields{
 				"error": err,
-			}).Errorln("Error closing cache file")
-			return wikiCache{}
+			}).Errorln("Error opening cache file")
 		}
+		return c
 	}
+	defer cacheFile.Close()
 
-	/*
-		// Update env.cache
-		env.cache.m.Lock()
-		defer env.cache.m.Unlock()
-		env.cache = &newCache
-	*/
-	log.Println("Cache built.")
-	return newCache
+	log.Println("Loading cache from gob.")
+	err = gob.NewDecoder(cacheFile).Decode(&c)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorln("Error loading cache. Rebuilding it.")
+		return wikiCache{}
+	}
+	if c.Version != cacheVersion {
+		log.Println("Cache was saved by another version. Rebuilding it.")
+		return wikiCache{}
+	}
+	// Empty maps are left out of gobs
+	if c.Tags == nil {
+		c.Tags = make(map[string][]string)
+	}
+	if c.Favs == nil {
+		c.Favs = make(map[string]struct{})
+	}
+	if c.Links == nil {
+		c.Links = make(map[string][]string)
+	}
+	if c.Images == nil {
+		c.Images = make(map[string][]string)
+	}
+	c.index()
+	return c
+}
+
+// saveCache saves the cache in DataDir, if enabled
+func (env *wikiEnv) saveCache(c wikiCache) error {
+	if !env.cfg.CacheEnabled {
+		return nil
+	}
+	cacheFile, err := os.Create(filepath.Join(env.cfg.DataDir, "cache.gob"))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorln("Error creating cache file")
+		return err
+	}
+	cacheEncoder := gob.NewEncoder(cacheFile)
+	err = cacheEncoder.Encode(&c)
+	if err != nil {
+		cacheFile.Close()
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorln("Error encoding cache in gob")
+		return err
+	}
+	err = cacheFile.Close()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Errorln("Error closing cache file")
+		return err
+	}
+	return nil
 }
 
 func (env *wikiEnv) loadCache() wikiCache {
 
 	env.cacheLock.Lock()
 	defer env.cacheLock.Unlock()
-	// If cache is blank, definitely build it and wait
+	// If cache is blank, start from the one saved in DataDir and wait for it to be brought up to date
 	if env.cache.Cache == nil {
-		env.cache = env.buildCache()
+		env.cache = env.updateCache(env.readCache())
 		return env.cache
 	}
 	// Check if we can just return the cache in memory
@@ -1630,78 +1972,56 @@ func (env *wikiEnv) loadCache() wikiCache {
 		return env.cache
 	}
 
-	// Try to build new cache in the background. Return current cache for now
+	// Bring the cache up to date in the background. Return current cache for now
+	old := env.cache
 	go func() {
+		env.setCache(env.updateCache(old))
+	}()
 
-		var newCache wikiCache
-
-		if env.cfg.CacheEnabled {
-
-			cacheFile, err := os.Open(filepath.Join(env.cfg.DataDir, "cache.gob"))
-			defer cacheFile.Close()
-			if err == nil {
-				log.Println("Loading cache from gob.")
-				cacheDecoder := gob.NewDecoder(cacheFile)
-
-				err = cacheDecoder.Decode(&newCache)
-				//check(err)
-				if err != nil {
-					log.WithFields(logrus.Fields{
-						"error": err,
-					}).Errorln("Error loading cache. Rebuilding it.")
-
-					newCache = env.buildCache()
-				}
-				// Check the cached sha1 versus HEAD sha1, rebuild if they differ
-				if !env.gitIsEmpty() && newCache.SHA1 != env.headHash() {
-					log.Println("Cache SHA1s do not match. Rebuilding cache.")
-					newCache = env.buildCache()
-				}
-			}
-			// If cache does not exist, build it
-			if os.IsNotExist(err) {
-				log.Println("Cache does not exist, building it...")
-				newCache = env.buildCache()
-			}
-		} else {
-			log.Println("Building cache...")
-			newCache = env.buildCache()
-		}
+	return env.cache
+}
 
-		// Update fav and tag lists
-		env.favs.Lock()
-		env.favs.List = newCache.Favs
-		env.favs.Unlock()
+// refreshCache brings the cache up to date with HEAD straight away, rather than on the next page load
+func (env *wikiEnv) refreshCache() {
+	env.cacheLock.Lock()
+	old := env.cache
+	env.cacheLock.Unlock()
+	env.setCache(env.updateCache(old))
+}
 
-		env.tags.Lock()
-		env.tags.List = newCache.Tags
-		env.tags.Unlock()
+// setCache replaces the cache, along with the favorite and tag lists built from it
+func (env *wikiEnv) setCache(newCache wikiCache) {
+	// Update fav and tag lists
+	env.favs.Lock()
+	env.favs.List = newCache.Favs
+	env.favs.Unlock()
 
-		// Update cache
-		env.cacheLock.Lock()
-		env.cache = newCache
-		env.cacheLock.Unlock()
-	}()
+	env.tags.Lock()
+	env.tags.List = newCache.Tags
+	env.tags.Unlock()
 
-	return env.cache
+	// Update cache
+	env.cacheLock.Lock()
+	env.cache = newCache
+	env.cacheLock.Unlock()
 }
 
 func (env *wikiEnv) headHash() string {
-	output, err := env.gitCommand("rev-parse", "HEAD").CombinedOutput()
+	head, err := env.store.Head()
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"error": err,
 		}).Errorln("Error retrieving SHA1 of wikidata")
 		return ""
 	}
-	return string(output)
+	return head
 }
 
 type mdPreviewJSON struct {
 	MD string `json:"md"`
 }
 
-func markdownPreview(w http.ResponseWriter, r *http.Request) {
+func (env *wikiEnv) markdownPreview(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	var md mdPreviewJSON
 	err := dec.Decode(&md)
@@ -1711,25 +2031,25 @@ func markdownPreview(w http.ResponseWriter, r *http.Request) {
 		}).Errorln("error decoding JSON to Markdown")
 		w.Write([]byte(""))
 	}
-	w.Write([]byte(markdownRender([]byte(md.MD))))
+	w.Write([]byte(env.sanitize(env.markdownRender([]byte(md.MD), env.permissionClass(r)), false)))
 }
 
 // return false if request should be allowed
 // return true if request should be rejected
-func wikiRejected(fullPath string, wikiExists, isAdmin, isLoggedIn bool) bool {
+func (env *wikiEnv) wikiRejected(name string, wikiExists, isAdmin, isLoggedIn bool) bool {
 
-	log.Debugln("wikiRejected name", fullPath)
+	log.Debugln("wikiRejected name", name)
 
 	// if wikiExists, read the frontmatter and reject/accept based on frontmatter.Permission
 	if wikiExists {
 
 		// If err, reject, and log that error
-		f, err := os.Open(fullPath)
+		f, err := env.store.Open(name)
 		if err != nil {
 			log.WithFields(logrus.Fields{
-				"full path": fullPath,
-				"error":     err,
-			}).Errorln("error reading full path for wikiRejected check")
+				"name":  name,
+				"error": err,
+			}).Errorln("error reading page for wikiRejected check")
 			return true
 		}
 		fm := readFront(f)
@@ -1763,6 +2083,18 @@ func wikiRejected(fullPath string, wikiExists, isAdmin, isLoggedIn bool) bool {
 
 }
 
+// permissionListed checks whether pages with the given permission are listed for a user, as on /list
+func permissionListed(permission string, isLoggedIn, isAdmin bool) bool {
+	switch permission {
+	case publicPermission:
+		return true
+	case adminPermission:
+		return isAdmin
+	}
+	// Pages without a permission are treated as private
+	return isLoggedIn || isAdmin
+}
+
 // mitigateWiki is a general redirect handler; redirect should be set to true for login mitigations
 func mitigateWiki(redirect bool, env *wikiEnv, r *http.Request, w http.ResponseWriter) {
 	log.Debugln("mitigateWiki: " + r.Host + r.URL.Path)
@@ -1881,15 +2213,36 @@ func main() {
 		SessionLifetimeHours: 1440,
 	}
 
+	store, err := newStore(serverCfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	env := &wikiEnv{
 		cfg:           serverCfg,
+		store:         store,
 		authState:     *auth.NewAuthState(aCfg),
 		templates:     tmplInit(),
 		pageWriteLock: sync.Mutex{},
 		cache:         wikiCache{},
+		renders:       newRenderCache(serverCfg.RenderCacheEntries, serverCfg.RenderCacheBytes),
 		pool:          bpool.NewBufferPool(64),
 	}
 
+	env.sanitizer, err = newSanitizer(serverCfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	env.goldmark, err = newRenderer(serverCfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if serverCfg.Prometheus {
+		prometheus.MustRegister(renderCacheHits, renderCacheMisses)
+	}
+
 	defer env.authState.CloseDB()
 
 	env.cache.Tags = make(map[string][]string)
@@ -1900,8 +2253,32 @@ func main() {
 	env.favs.List = env.cache.Favs
 	env.tags.List = env.cache.Tags
 
+	// Files changed outside the wiki while it was stopped are committed first, so they do not stop it from starting
+	if serverCfg.WatchCommit && !env.store.IsEmpty() {
+		untracked, err := env.store.Untracked()
+		if err == nil {
+			err = env.commitExternal(untracked)
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Errorln("Unable to commit files changed outside the wiki")
+		}
+	}
+
+	if serverCfg.Watch || serverCfg.WatchCommit {
+		w, err := env.watchWiki()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+			}).Errorln("Unable to watch the wiki for changes")
+		} else {
+			defer w.Close()
+		}
+	}
+
 	// Check for unclean Git dir on startup
-	if !env.gitIsEmpty() {
+	if !env.store.IsEmpty() {
 		err := env.gitIsCleanStartup()
 		if err != nil {
 			log.WithFields(logrus.Fields{
@@ -3,19 +3,32 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	auth "git.sr.ht/~aqtrans/goauth/v2"
 	httputils "git.sr.ht/~aqtrans/gohttputils"
+	"git.sr.ht/~aqtrans/gowiki/render"
+	"git.sr.ht/~aqtrans/gowiki/search"
+	"github.com/go-chi/chi/v5"
 	"github.com/oxtoacart/bpool"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -26,7 +39,9 @@ var (
 	server      *httptest.Server
 	reader      io.Reader //Ignore this for now
 	serverURL   string
-	tempDataDir = tempdir()
+	tempDataDir string
+	testStorage string
+	testStore   Store
 	//m         *mux.Router
 	//req       *http.Request
 	//rr        *httptest.ResponseRecorder
@@ -44,6 +59,27 @@ func init() {
 }
 */
 
+// TestMain runs every test once for each storage backend, each in a fresh DataDir
+// The Store is shared between tests, as an in-memory repo only lasts as long as its Store
+func TestMain(m *testing.M) {
+	code := 0
+	for _, storage := range []string{"git", "gogit", "memory"} {
+		testStorage = storage
+		tempDataDir = tempdir()
+		var err error
+		testStore, err = newStore(testConfig())
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintln(os.Stderr, "Testing with storage backend", storage)
+		if c := m.Run(); c != 0 {
+			code = c
+		}
+		os.RemoveAll(tempDataDir)
+	}
+	os.Exit(code)
+}
+
 func checkT(err error, t *testing.T) {
 	if err != nil {
 		t.Errorf("ERROR: %v", err)
@@ -217,27 +253,40 @@ func newState() *auth.AuthState {
 }
 */
 
-func testEnv(authState *auth.State) *wikiEnv {
-	log.SetOutput(io.Discard)
-
+// testConfig returns the config for the storage backend currently being tested
+func testConfig() config {
+	// Only the default storage backend needs git installed
 	gitPath, err := exec.LookPath("git")
-	if err != nil {
+	if err != nil && testStorage == "git" {
 		log.Println(err, gitPath)
 		//log.Fatalln(exec.Command("which","git").Run())
 		log.Fatalln("Git executable was not found in PATH. Git must be installed.")
 	}
 	//gitPath := ""
 
+	return config{
+		DataDir:        tempDataDir,
+		WikiDir:        filepath.Join(tempDataDir, "wikidata"),
+		GitPath:        gitPath,
+		CacheEnabled:   true,
+		GitCommitEmail: "test@test.com",
+		GitCommitName:  "gowiki-tests",
+		Prometheus:     false,
+		Storage:        testStorage,
+	}
+}
+
+func testEnv(authState *auth.State) *wikiEnv {
+	log.SetOutput(io.Discard)
+
+	sanitizer, err := newSanitizer(testConfig())
+	if err != nil {
+		panic(err)
+	}
+
 	return &wikiEnv{
-		cfg: config{
-			DataDir:        tempDataDir,
-			WikiDir:        filepath.Join(tempDataDir, "wikidata"),
-			GitPath:        gitPath,
-			CacheEnabled:   true,
-			GitCommitEmail: "test@test.com",
-			GitCommitName:  "gowiki-tests",
-			Prometheus:     false,
-		},
+		cfg:       testConfig(),
+		store:     testStore,
 		authState: *authState,
 		cache: wikiCache{
 			Tags: make(map[string][]string),
@@ -247,6 +296,7 @@ func testEnv(authState *auth.State) *wikiEnv {
 		pageWriteLock: sync.Mutex{},
 		tags:          newTagsMap(),
 		favs:          newFavsMap(),
+		sanitizer:     sanitizer,
 		pool:          bpool.NewBufferPool(64),
 		testing:       true,
 	}
@@ -1110,6 +1160,39 @@ func TestMarkdownRender5(t *testing.T) {
 	}
 }
 
+// Renders every tests/test*.md page with both engines, against test.html for blackfriday, and test.goldmark.html for goldmark
+func TestMarkdownRenderEngines(t *testing.T) {
+	pages, err := filepath.Glob("./tests/test*.md")
+	checkT(err, t)
+	for _, engine := range []string{"blackfriday", "goldmark"} {
+		cfg := testConfig()
+		cfg.Renderer = engine
+		e := &wikiEnv{cfg: cfg}
+		e.goldmark, err = newRenderer(cfg)
+		checkT(err, t)
+
+		for _, page := range pages {
+			_, rawmd := readFileAndFront(page)
+			rendermdf := strings.TrimSuffix(page, ".md") + ".html"
+			if engine != "blackfriday" {
+				rendermdf = strings.TrimSuffix(page, ".md") + "." + engine + ".html"
+			}
+			rendermd, err := ioutil.ReadFile(rendermdf)
+			checkT(err, t)
+
+			rawmds := e.markdownRender(rawmd, "anonymous")
+			if rawmds != string(rendermd) {
+				//ioutil.WriteFile(rendermdf, []byte(rawmds), 0644)
+				t.Error(engine + " render of " + page + " does not equal " + rendermdf + "\n Output: \n" + rawmds + "Expected: \n" + string(rendermd))
+			}
+		}
+	}
+
+	if _, err := newRenderer(config{Renderer: "nope"}); err == nil {
+		t.Error("expected an error for an unknown renderer")
+	}
+}
+
 func TestYamlRender(t *testing.T) {
 	f, err := os.Open("./tests/yamltest")
 	checkT(err, t)
@@ -1289,7 +1372,7 @@ func BenchmarkGitCtime(b *testing.B) {
 	defer os.Remove(tmpdb)
 
 	for i := 0; i < b.N; i++ {
-		e.gitGetCtime("index")
+		e.store.Ctime("index")
 	}
 }
 
@@ -1298,7 +1381,105 @@ func BenchmarkGitMtime(b *testing.B) {
 	defer os.Remove(tmpdb)
 
 	for i := 0; i < b.N; i++ {
-		e.gitGetMtime("index")
+		e.store.Mtime("index")
+	}
+}
+
+// benchRepo builds a wiki of 5000 pages for the benchmarks, spread over 20 commits, with a few hundred later edits and moves
+func benchRepo(b *testing.B) *wikiEnv {
+	b.Helper()
+	tmpdb, e := testEnvInit()
+	b.Cleanup(func() { os.Remove(tmpdb) })
+	dir := tempdir()
+	b.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := testConfig()
+	cfg.DataDir = dir
+	cfg.WikiDir = filepath.Join(dir, "wikidata")
+	err := os.Mkdir(cfg.WikiDir, 0755)
+	if err != nil {
+		b.Fatal(err)
+	}
+	store, err := newStore(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = store.Init()
+	if err != nil {
+		b.Fatal(err)
+	}
+	e.cfg = cfg
+	e.store = store
+
+	commit := func(msg string) {
+		err := store.Add(".")
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = store.Commit("", msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	page := func(i, rev int) []byte {
+		return []byte(fmt.Sprintf("---\ntitle: Page %d\npermission: public\n---\nRevision %d of page %d.\n", i, rev, i))
+	}
+
+	for c := 0; c < 20; c++ {
+		for i := c * 250; i < (c+1)*250; i++ {
+			err := store.WriteFile(fmt.Sprintf("section%d/page%d", i%10, i), page(i, 0))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		commit(fmt.Sprintf("Pages %d to %d", c*250, (c+1)*250))
+	}
+	for c := 1; c <= 5; c++ {
+		for i := c; i < 5000; i += 50 {
+			err := store.WriteFile(fmt.Sprintf("section%d/page%d", i%10, i), page(i, c))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		commit(fmt.Sprintf("Edit %d", c))
+	}
+	for i := 0; i < 5000; i += 500 {
+		err := store.Move(fmt.Sprintf("section%d/page%d", i%10, i), fmt.Sprintf("moved/page%d", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	commit("Moves")
+	return e
+}
+
+// BenchmarkGitTimesPerFile looks up times the way the cache used to be built, with two walks through history per file
+func BenchmarkGitTimesPerFile(b *testing.B) {
+	e := benchRepo(b)
+	fileList, err := e.store.LsTree()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, file := range fileList {
+			if file.Type == "blob" {
+				e.pageTimes(file.Filename)
+			}
+		}
+	}
+}
+
+func BenchmarkGitFileTimes(b *testing.B) {
+	e := benchRepo(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := e.store.FileTimes()
+		if err != nil {
+			b.Fatal(err)
+		}
 	}
 }
 
@@ -1388,3 +1569,2342 @@ func TestMultipleMapReads(t *testing.T) {
 	wg.Wait()
 }
 */
+
+// TestSaveConflict tests that overlapping edits based on an outdated revision are refused
+func TestSaveConflict(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	page := &wiki{
+		Title:    "conflict",
+		Filename: "conflict",
+		Frontmatter: frontmatter{
+			Title:      "conflict",
+			Permission: publicPermission,
+		},
+		Content: []byte("original content\n"),
+	}
+	err := page.save(e)
+	checkT(err, t)
+
+	baseCommit, err := e.store.LastCommit("conflict")
+	checkT(err, t)
+	if baseCommit == "" {
+		t.Fatal("no commit found for conflict page")
+	}
+
+	// First editor saves, based on the latest revision
+	first := *page
+	first.Content = []byte("first editor\n")
+	first.BaseCommit = baseCommit
+	err = first.save(e)
+	checkT(err, t)
+
+	// Second editor started from the same revision, and should be refused
+	second := *page
+	second.Content = []byte("second editor\n")
+	second.BaseCommit = baseCommit
+	err = second.save(e)
+	if err != errEditConflict {
+		t.Errorf("save based on outdated revision returned %v, want %v", err, errEditConflict)
+	}
+
+	_, content := e.readPage("conflict")
+	if string(content) != "first editor\n" {
+		t.Errorf("page content was overwritten: got %q", content)
+	}
+}
+
+// TestSaveNewPageConflict checks two people creating the same page at once do not overwrite each other
+func TestSaveNewPageConflict(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewUser("newpageuser", "newpageuser")
+
+	page := func(content string) *wiki {
+		return &wiki{
+			Title:       "newpage",
+			Filename:    "newpage",
+			Frontmatter: frontmatter{Title: "newpage", Permission: publicPermission},
+			Content:     []byte(content),
+			NewPage:     true,
+		}
+	}
+	checkT(page("first creator\n").save(e), t)
+	if err := page("second creator\n").save(e); err != errEditConflict {
+		t.Errorf("creating a page which was created since returned %v, want %v", err, errEditConflict)
+	}
+	if _, content := e.readPage("newpage"); string(content) != "first creator\n" {
+		t.Errorf("page content was overwritten: got %q", content)
+	}
+
+	// The editor for a missing page says so, and saving it over a page created since is a conflict
+	w := httptest.NewRecorder()
+	e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.Login("newpageuser", r)
+	})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Header["Set-Cookie"]
+	r := httptest.NewRequest("GET", "/edit/newpage-missing", nil)
+	r.Header["Cookie"] = cookies
+	w = httptest.NewRecorder()
+	router(e).ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `name="newpage" value="on"`) {
+		t.Errorf("expected the editor to record the page is new, got %q", w.Body.String())
+	}
+
+	saveRouter := chi.NewRouter()
+	saveRouter.Use(e.authState.LoadAndSave)
+	saveRouter.Post("/save/*", e.saveHandler)
+	form := url.Values{
+		"title":      {"newpage"},
+		"permission": {publicPermission},
+		"editor":     {"third creator\n"},
+		"newpage":    {"on"},
+	}
+	r = httptest.NewRequest("POST", "/save/newpage", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header["Cookie"] = cookies
+	w = httptest.NewRecorder()
+	saveRouter.ServeHTTP(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected a conflict saving over a page created since, got %d", w.Code)
+	}
+	if _, content := e.readPage("newpage"); string(content) != "first creator\n" {
+		t.Errorf("page content was overwritten: got %q", content)
+	}
+
+	// Deleted pages can still be created again
+	checkT(e.store.Remove("newpage"), t)
+	checkT(e.store.Commit("", "Deleting newpage"), t)
+	checkT(page("created again\n").save(e), t)
+	if _, content := e.readPage("newpage"); string(content) != "created again\n" {
+		t.Errorf("expected the deleted page to be created again, got %q", content)
+	}
+}
+
+// TestSaveBadBaseCommit checks base commits which are not a full SHA1 never reach git
+func TestSaveBadBaseCommit(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewUser("basecommituser", "basecommituser")
+
+	outDir := t.TempDir()
+	pwned := filepath.Join(outDir, "pwned")
+
+	// Whatever the handler lets through, the Store must not take a revision as an option
+	if _, err := e.store.FileAt("index", "--output="+pwned); err == nil {
+		t.Error("expected an option-like revision to be an error")
+	}
+	if files, _ := os.ReadDir(outDir); len(files) != 0 {
+		t.Fatal("expected an option-like revision to not write a file")
+	}
+
+	// Only the save handler itself is under test, so CSRF checks are left out
+	saveRouter := chi.NewRouter()
+	saveRouter.Use(e.authState.LoadAndSave)
+	saveRouter.Post("/save/*", e.saveHandler)
+
+	w := httptest.NewRecorder()
+	e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.Login("basecommituser", r)
+	})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Header["Set-Cookie"]
+
+	for _, base := range []string{"--output=" + pwned, "HEAD", "abc1234"} {
+		form := url.Values{
+			"title":      {"basecommit"},
+			"permission": {publicPermission},
+			"editor":     {"content\n"},
+			"basecommit": {base},
+		}
+		r := httptest.NewRequest("POST", "/save/basecommit", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header["Cookie"] = cookies
+		w := httptest.NewRecorder()
+		saveRouter.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected base commit %q to be refused, got %d", base, w.Code)
+		}
+	}
+	if files, _ := os.ReadDir(outDir); len(files) != 0 {
+		t.Error("expected the save handler to not write a file")
+	}
+	if _, err := e.store.Stat("basecommit"); err == nil {
+		t.Error("expected the page to not be saved")
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	diff := diffLines("one\ntwo\nthree\n", "one\n2\nthree\n")
+
+	expected := []diffLine{
+		{Type: diffContext, Text: "one"},
+		{Type: diffDel, Text: "two"},
+		{Type: diffAdd, Text: "2"},
+		{Type: diffContext, Text: "three"},
+	}
+	if len(diff) != len(expected) {
+		t.Fatalf("unexpected diff: got %v want %v", diff, expected)
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(diff[i], expected[i]) {
+			t.Errorf("unexpected diff line %d: got %v want %v", i, diff[i], expected[i])
+		}
+	}
+}
+
+func TestFileDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\nthe quick brown fox\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	b := "1\n2\n3\n4\n5\nthe quick red fox\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n"
+
+	hunks := fileDiff(a, b)
+	if len(hunks) != 2 {
+		t.Fatalf("expected 2 hunks, got %d: %+v", len(hunks), hunks)
+	}
+	if h := hunks[0].Header(); h != "@@ -3,7 +3,7 @@" {
+		t.Errorf("unexpected first hunk header: %s", h)
+	}
+	if h := hunks[1].Header(); h != "@@ -13,3 +13,4 @@" {
+		t.Errorf("unexpected second hunk header: %s", h)
+	}
+
+	changed := hunks[0].Lines[3:5]
+	expectedDel := []diffSegment{{Text: "the quick "}, {Text: "brown", Changed: true}, {Text: " fox"}}
+	expectedAdd := []diffSegment{{Text: "the quick "}, {Text: "red", Changed: true}, {Text: " fox"}}
+	if changed[0].Type != diffDel || !reflect.DeepEqual(changed[0].Segments, expectedDel) {
+		t.Errorf("unexpected removed line: %+v", changed[0])
+	}
+	if changed[1].Type != diffAdd || !reflect.DeepEqual(changed[1].Segments, expectedAdd) {
+		t.Errorf("unexpected added line: %+v", changed[1])
+	}
+	if changed[0].OldNum != 6 || changed[1].NewNum != 6 {
+		t.Errorf("unexpected line numbers: %d, %d", changed[0].OldNum, changed[1].NewNum)
+	}
+
+	rows := hunks[0].Rows()
+	if len(rows) != 7 || rows[3].Left != &hunks[0].Lines[3] || rows[3].Right != &hunks[0].Lines[4] {
+		t.Errorf("changed lines were not paired side by side: %+v", rows)
+	}
+	rows = hunks[1].Rows()
+	if last := rows[len(rows)-1]; last.Left != nil || last.Right.Text != "16" {
+		t.Errorf("added line should only be on the right: %+v", last)
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+
+	// Non-overlapping changes are combined
+	merged, ok := merge3(base, "ONE\ntwo\nthree\nfour\nfive\n", "one\ntwo\nthree\nfour\nFIVE\n")
+	if !ok {
+		t.Error("non-overlapping changes reported a conflict")
+	}
+	if merged != "ONE\ntwo\nthree\nfour\nFIVE\n" {
+		t.Errorf("unexpected merge result: %q", merged)
+	}
+
+	// Identical changes on both sides are not a conflict
+	merged, ok = merge3(base, "one\n2\nthree\nfour\nfive\n", "one\n2\nthree\nfour\nfive\n")
+	if !ok || merged != "one\n2\nthree\nfour\nfive\n" {
+		t.Errorf("identical changes did not merge cleanly: %q", merged)
+	}
+
+	// Overlapping changes are kept between conflict markers
+	merged, ok = merge3(base, "one\ntwo\n3\nfour\nfive\n", "one\ntwo\ndrei\nfour\nfive\n")
+	if ok {
+		t.Error("overlapping changes did not report a conflict")
+	}
+	expected := "one\ntwo\n" + conflictStart + "\n3\n" + conflictSep + "\ndrei\n" + conflictEnd + "\nfour\nfive\n"
+	if merged != expected {
+		t.Errorf("unexpected conflict result: got %q want %q", merged, expected)
+	}
+}
+
+// TestSaveMerge tests that concurrent edits to different sections of a page are both saved
+func TestSaveMerge(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	page := &wiki{
+		Title:    "runbook",
+		Filename: "runbook",
+		Frontmatter: frontmatter{
+			Title:      "runbook",
+			Permission: publicPermission,
+		},
+		Content: []byte("# Start\nstep one\n\n# Middle\nstep two\n\n# End\nstep three\n"),
+	}
+	err := page.save(e)
+	checkT(err, t)
+
+	baseCommit, err := e.store.LastCommit("runbook")
+	checkT(err, t)
+
+	first := *page
+	first.Content = []byte("# Start\nstep one, carefully\n\n# Middle\nstep two\n\n# End\nstep three\n")
+	first.BaseCommit = baseCommit
+	err = first.save(e)
+	checkT(err, t)
+
+	second := *page
+	second.Content = []byte("# Start\r\nstep one\r\n\r\n# Middle\r\nstep two\r\n\r\n# End\r\nstep three, then celebrate")
+	second.BaseCommit = baseCommit
+	err = second.save(e)
+	checkT(err, t)
+
+	_, content := e.readPage("runbook")
+	expected := "# Start\nstep one, carefully\n\n# Middle\nstep two\n\n# End\nstep three, then celebrate\n"
+	if string(content) != expected {
+		t.Errorf("edits were not merged: got %q want %q", content, expected)
+	}
+
+	history, err := e.store.FileLog("runbook")
+	checkT(err, t)
+	if len(history) != 3 {
+		t.Errorf("expected 3 commits for runbook, got %d", len(history))
+	}
+}
+
+// TestSaveMergeRawHTML tests an admin turning off sanitizing is not merged into another editor's changes
+func TestSaveMergeRawHTML(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	page := &wiki{
+		Title:    "mergeraw",
+		Filename: "mergeraw",
+		Frontmatter: frontmatter{
+			Title:      "mergeraw",
+			Permission: publicPermission,
+		},
+		Content: []byte("first\n\nsecond\n"),
+	}
+	checkT(page.save(e), t)
+
+	baseCommit, err := e.store.LastCommit("mergeraw")
+	checkT(err, t)
+
+	// An admin turns off sanitizing, after someone else has opened the editor
+	admin := *page
+	admin.Frontmatter.RawHTML = true
+	admin.BaseCommit = baseCommit
+	checkT(admin.save(e), t)
+
+	user := *page
+	user.Content = []byte("first\n\n<script>evil()</script>\n")
+	user.BaseCommit = baseCommit
+	checkT(user.save(e), t)
+
+	fm, content := e.readPage("mergeraw")
+	if fm.RawHTML {
+		t.Error("expected sanitizing to be turned back on by an edit from someone who cannot turn it off")
+	}
+	if string(content) != "first\n\n<script>evil()</script>\n" {
+		t.Errorf("expected the edit to be saved, got %q", content)
+	}
+}
+
+// TestSaveAuthorAndMessage tests that pages are committed with the given author and message
+func TestSaveAuthorAndMessage(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	page := &wiki{
+		Title:    "Changelog",
+		Filename: "changelog",
+		Frontmatter: frontmatter{
+			Title:      "Changelog",
+			Permission: publicPermission,
+		},
+		Content: []byte("first entry\n"),
+		Author:  e.commitAuthor(&auth.User{Name: "alice"}),
+		Message: "Start a changelog, with commas",
+	}
+	err := page.save(e)
+	checkT(err, t)
+
+	history, err := e.store.FileLog("changelog")
+	checkT(err, t)
+	if len(history) != 1 {
+		t.Fatalf("expected 1 commit for changelog, got %d", len(history))
+	}
+	if history[0].Author != "alice" {
+		t.Errorf("commit author: got %q want %q", history[0].Author, "alice")
+	}
+	if history[0].Message != "Start a changelog, with commas" {
+		t.Errorf("commit message: got %q", history[0].Message)
+	}
+
+	// Without a user or message, the wiki identity and a default message are used
+	page.Content = []byte("second entry\n")
+	page.Author = ""
+	page.Message = ""
+	err = page.save(e)
+	checkT(err, t)
+
+	recents, err := e.store.History()
+	checkT(err, t)
+	if len(recents) == 0 {
+		t.Fatal("no recent activity found")
+	}
+	if recents[0].Author != e.cfg.GitCommitName || recents[0].Message != "changelog has been updated." {
+		t.Errorf("unexpected latest commit: %+v", recents[0])
+	}
+	if len(recents[0].Filenames) != 1 || recents[0].Filenames[0] != "changelog" {
+		t.Errorf("unexpected filenames in latest commit: %v", recents[0].Filenames)
+	}
+}
+
+func TestRewriteLinks(t *testing.T) {
+	content := []byte("[old.md]() [/old]() [Old](/old#top) [Old](old) [oldie]() [Older](/older) [x](/old/sub)\n")
+	expected := "[new/page]() [/new/page]() [Old](/new/page#top) [Old](new/page) [oldie]() [Older](/older) [x](/old/sub)\n"
+	rewritten := rewriteLinks(content, "old.md", "new/page")
+	if string(rewritten) != expected {
+		t.Errorf("unexpected rewrite: got %q want %q", rewritten, expected)
+	}
+}
+
+// TestMoveWiki tests moving a page, rewriting links to it, and leaving a redirect behind
+func TestMoveWiki(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	pages := map[string]string{
+		"moveme":   "This page is going to be moved somewhere else soon.\nIts history should follow it there.\n",
+		"linksto":  "see [moveme]() and [this](/moveme), but not [that](/movemenot)\n",
+		"afile":    "just a file\n",
+		"unlinked": "nothing to see\n",
+	}
+	for name, content := range pages {
+		page := &wiki{
+			Title:    name,
+			Filename: name,
+			Frontmatter: frontmatter{
+				Title:      name,
+				Permission: publicPermission,
+			},
+			Content: []byte(content),
+		}
+		checkT(page.save(e), t)
+	}
+
+	// Moving outside of the wikidir, under a file, or over an existing page should fail
+	badNames := map[string]error{
+		"../escaped":   errBadPath,
+		"afile/moveme": errBaseNotDir,
+		"unlinked":     errPageExists,
+		".git/config":  errBadPath,
+		"docs/.git":    errBadPath,
+		"a/./.GIT/x":   errBadPath,
+		// Only a .git directory itself is off limits
+		"notes/.github-tips": nil,
+		"my.gitignore-guide": nil,
+	}
+	for newname, expected := range badNames {
+		err := e.checkMoveTarget(&newname)
+		if err != expected {
+			t.Errorf("checkMoveTarget(%q): got %v want %v", newname, err, expected)
+		}
+	}
+
+	newname := "moved/here"
+	checkT(e.checkMoveTarget(&newname), t)
+	checkT(e.moveWiki("moveme", newname, "", true, true), t)
+
+	_, content := e.readPage("moved/here")
+	if string(content) != pages["moveme"] {
+		t.Errorf("moved page has unexpected content: %q", content)
+	}
+	_, content = e.readPage("linksto")
+	expected := "see [moved/here]() and [this](/moved/here), but not [that](/movemenot)\n"
+	if string(content) != expected {
+		t.Errorf("links were not rewritten: got %q want %q", content, expected)
+	}
+	fm, _ := e.readPage("moveme")
+	if fm.Redirect != "moved/here" || fm.Permission != publicPermission {
+		t.Errorf("unexpected redirect stub frontmatter: %+v", fm)
+	}
+
+	// History from before the move should still be there
+	history, err := e.store.FileLog("moved/here")
+	checkT(err, t)
+	if len(history) != 2 {
+		t.Errorf("expected 2 commits for moved/here, got %d", len(history))
+	}
+
+	r := httptest.NewRequest("GET", "/moveme", nil)
+	w := httptest.NewRecorder()
+	router(e).ServeHTTP(w, r)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/moved/here" {
+		t.Errorf("expected redirect to /moved/here, got %v %q", w.Code, w.Header().Get("Location"))
+	}
+
+	r = httptest.NewRequest("GET", "/moveme?redirect=no", nil)
+	w = httptest.NewRecorder()
+	router(e).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the redirect stub to be shown, got %v", w.Code)
+	}
+}
+
+// failingCommitStore is a Store which cannot commit, for testing what is left behind when a commit fails
+type failingCommitStore struct {
+	Store
+}
+
+func (failingCommitStore) Commit(author, msg string) error {
+	return errors.New("commit failed")
+}
+
+// TestMoveWikiFailure checks a move which fails to commit is undone, so the next save does not commit half of it
+func TestMoveWikiFailure(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	pages := map[string]string{
+		"unmoved":          "This page will not be moved after all.\n",
+		"links-to-unmoved": "see [unmoved]()\n",
+	}
+	for name, content := range pages {
+		page := &wiki{
+			Title:       name,
+			Filename:    name,
+			Frontmatter: frontmatter{Title: name, Permission: publicPermission},
+			Content:     []byte(content),
+		}
+		checkT(page.save(e), t)
+	}
+
+	store := e.store
+	e.store = failingCommitStore{store}
+	if err := e.moveWiki("unmoved", "elsewhere/moved", "", true, true); err == nil {
+		t.Fatal("expected the move to fail")
+	}
+	e.store = store
+
+	for name, content := range pages {
+		fm, got := e.readPage(name)
+		if string(got) != content || fm.Redirect != "" {
+			t.Errorf("expected %q to be left as it was, got %q %+v", name, got, fm)
+		}
+	}
+	if _, err := e.store.Stat("elsewhere/moved"); err == nil {
+		t.Error("expected the moved page to be gone")
+	}
+
+	head := e.headHash()
+	other := &wiki{
+		Title:       "unrelated",
+		Filename:    "unrelated",
+		Frontmatter: frontmatter{Title: "unrelated", Permission: publicPermission},
+		Content:     []byte("unrelated\n"),
+	}
+	checkT(other.save(e), t)
+	changed, err := e.store.ChangedFiles(head, e.headHash())
+	checkT(err, t)
+	if len(changed) != 1 || changed[0].Name != "unrelated" {
+		t.Errorf("expected only the saved page to be committed, got %+v", changed)
+	}
+}
+
+// TestRestoreWiki tests reverting a page to an earlier version, and restoring a deleted page
+func TestRestoreWiki(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	page := &wiki{
+		Title:    "recipes",
+		Filename: "recipes",
+		Frontmatter: frontmatter{
+			Title:      "recipes",
+			Permission: publicPermission,
+		},
+		Content: []byte("pancakes\n"),
+	}
+	checkT(page.save(e), t)
+	page.Content = []byte("burnt pancakes\n")
+	checkT(page.save(e), t)
+
+	history, err := e.store.FileLog("recipes")
+	checkT(err, t)
+	first := history[len(history)-1].Commit
+
+	err = e.restoreWiki("recipes", "--output=/tmp/x", "", "nope", false)
+	if err != errBadRevision {
+		t.Errorf("expected errBadRevision for an option-like revision, got %v", err)
+	}
+
+	checkT(e.restoreWiki("recipes", first, "", "Revert recipes to "+first, false), t)
+	_, content := e.readPage("recipes")
+	if string(content) != "pancakes\n" {
+		t.Errorf("page was not reverted: got %q", content)
+	}
+	history, err = e.store.FileLog("recipes")
+	checkT(err, t)
+	if history[0].Message != "Revert recipes to "+first {
+		t.Errorf("unexpected revert commit message: %q", history[0].Message)
+	}
+
+	checkT(e.store.Remove("recipes"), t)
+	checkT(e.store.Commit("", "recipes has been removed from git repo."), t)
+
+	deleted, err := e.store.FileDeletion("recipes")
+	checkT(err, t)
+	if deleted == nil {
+		t.Fatal("deletion of recipes not found")
+	}
+	checkT(e.restoreWiki("recipes", deleted.Commit+"^", "", "Restore recipes", false), t)
+	fm, content := e.readPage("recipes")
+	if string(content) != "pancakes\n" || fm.Permission != publicPermission {
+		t.Errorf("page was not restored: got %+v %q", fm, content)
+	}
+}
+
+// TestRestoreMovedWiki tests restoring a revision from before a page was moved, which is kept under its old name
+func TestRestoreMovedWiki(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewUser("restoreuser", "restoreuser")
+
+	page := &wiki{
+		Title:    "sourdough",
+		Filename: "sourdough",
+		Frontmatter: frontmatter{
+			Title:      "sourdough",
+			Permission: publicPermission,
+		},
+		Content: []byte("Feed the starter twice a day, then leave it somewhere warm overnight.\n"),
+	}
+	checkT(page.save(e), t)
+	page.Content = []byte("Feed the starter twice a day, then leave it somewhere warm overnight.\nBake at 250C.\n")
+	checkT(page.save(e), t)
+	checkT(e.moveWiki("sourdough", "baking/sourdough", "", false, false), t)
+
+	history, err := e.store.FileLog("baking/sourdough")
+	checkT(err, t)
+	if len(history) != 3 {
+		t.Fatalf("expected 3 commits for baking/sourdough, got %d", len(history))
+	}
+	if history[0].Filename != "baking/sourdough" || history[2].Filename != "sourdough" {
+		t.Errorf("expected commits to be listed under the page's name at the time, got %+v", history)
+	}
+	first := history[2].Commit
+
+	// Diffs and commits from before the move are read from the old name, rather than shown as the page being created
+	for _, c := range []struct{ revision, content string }{
+		{first, "Feed the starter twice a day, then leave it somewhere warm overnight.\n"},
+		{history[0].Commit + "^", "Feed the starter twice a day, then leave it somewhere warm overnight.\nBake at 250C.\n"},
+		{first + "^", ""},
+	} {
+		body, err := e.fileAtRevision("baking/sourdough", c.revision)
+		checkT(err, t)
+		if _, content := readWikiPage(strings.NewReader(body)); string(content) != c.content {
+			t.Errorf("expected %q at %s, got %q", c.content, c.revision, body)
+		}
+	}
+	w := httptest.NewRecorder()
+	e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.Login("restoreuser", r)
+	})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Header["Set-Cookie"]
+	r := httptest.NewRequest("GET", "/baking/sourdough?commit="+history[1].Commit, nil)
+	r.Header["Cookie"] = cookies
+	w = httptest.NewRecorder()
+	router(e).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Bake at 250C.") {
+		t.Errorf("expected the commit from before the move to be shown, got %d", w.Code)
+	}
+
+	// The history page restores to the page's current name
+	r = httptest.NewRequest("GET", "/history/baking/sourdough", nil)
+	r.Header["Cookie"] = cookies
+	w = httptest.NewRecorder()
+	router(e).ServeHTTP(w, r)
+	if strings.Contains(w.Body.String(), `action="/revert/sourdough"`) || !strings.Contains(w.Body.String(), `action="/revert/baking/sourdough"`) {
+		t.Errorf("expected every revision to be restored to the current name, got %q", w.Body.String())
+	}
+
+	checkT(e.restoreWiki("baking/sourdough", first, "", "Revert baking/sourdough to "+first, false), t)
+	_, content := e.readPage("baking/sourdough")
+	if string(content) != "Feed the starter twice a day, then leave it somewhere warm overnight.\n" {
+		t.Errorf("expected the page to be restored from before the move, got %q", content)
+	}
+	if _, err := e.store.Stat("sourdough"); err == nil {
+		t.Error("expected the old name to be left alone")
+	}
+}
+
+// TestViewCommitMissing checks asking for a page at a revision it is not in is an error, rather than a panic
+func TestViewCommitMissing(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewUser("commituser", "commituser")
+	page := &wiki{
+		Title:       "commitview",
+		Filename:    "commitview",
+		Frontmatter: frontmatter{Title: "commitview", Permission: publicPermission},
+		Content:     []byte("here\n"),
+	}
+	checkT(page.save(e), t)
+
+	w := httptest.NewRecorder()
+	e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.Login("commituser", r)
+	})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Header["Set-Cookie"]
+
+	for _, c := range []struct {
+		url  string
+		code int
+	}{
+		{"/commitview?commit=" + e.headHash(), http.StatusOK},
+		{"/nonexistent?commit=deadbeef", http.StatusBadRequest},
+		{"/commitview?commit=deadbeef", http.StatusBadRequest},
+		{"/nonexistent?commit=" + e.headHash(), http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Header["Cookie"] = cookies
+		w := httptest.NewRecorder()
+		router(e).ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("expected %d for %s, got %d", c.code, c.url, w.Code)
+		}
+	}
+}
+
+// TestTrash tests that deleted pages show up in the trash, respecting their permission
+func TestTrash(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	// The first user is always an admin
+	e.authState.NewAdmin("admin", "admin")
+	e.authState.NewUser("trashuser", "trashuser")
+
+	// Deleted in order, so secretbinned is the latest deletion
+	for _, binned := range []struct{ name, permission string }{{"binned", privatePermission}, {"secretbinned", adminPermission}} {
+		name, permission := binned.name, binned.permission
+		page := &wiki{
+			Title:    name,
+			Filename: name,
+			Frontmatter: frontmatter{
+				Title:      name,
+				Permission: permission,
+			},
+			Content: []byte("contents of " + name + "\n"),
+		}
+		checkT(page.save(e), t)
+		checkT(e.store.Remove(name), t)
+		checkT(e.store.Commit("trashuser <trashuser@example.lan>", name+" has been removed from git repo."), t)
+	}
+
+	deleted, err := e.store.DeletedFiles()
+	checkT(err, t)
+	if len(deleted) < 2 || deleted[0].Filename != "secretbinned" || deleted[0].Author != "trashuser" {
+		t.Fatalf("unexpected deleted files: %+v", deleted)
+	}
+
+	r := httptest.NewRequest("GET", "/trash", nil)
+	w := httptest.NewRecorder()
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.Login("trashuser", r)
+	})
+	e.authState.LoadAndSave(testHandler).ServeHTTP(w, r)
+	r.Header = http.Header{"Cookie": w.Result().Header["Set-Cookie"]}
+
+	w2 := httptest.NewRecorder()
+	router(e).ServeHTTP(w2, r)
+	if w2.Code != http.StatusOK {
+		t.Fatalf("trash returned wrong status code: got %v want %v", w2.Code, http.StatusOK)
+	}
+	body := w2.Body.String()
+	if !strings.Contains(body, "contents of binned") {
+		t.Error("private page missing from the trash")
+	}
+	if strings.Contains(body, "secretbinned") {
+		t.Error("admin page shown in the trash to a non-admin")
+	}
+}
+
+// TestBlame tests that each line is attributed to the commit that last changed it
+func TestBlame(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	page := &wiki{
+		Title:    "runbook-blame",
+		Filename: "runbook-blame",
+		Frontmatter: frontmatter{
+			Title:      "runbook-blame",
+			Permission: publicPermission,
+		},
+		Content: []byte("step one\nstep two\n"),
+		Author:  "alice <alice@example.lan>",
+		Message: "Write runbook",
+	}
+	checkT(page.save(e), t)
+	page.Content = []byte("step one\nstep two\nstep three\n")
+	page.Author = "bob <bob@example.lan>"
+	page.Message = "Add step three"
+	checkT(page.save(e), t)
+
+	lines, err := e.store.Blame("runbook-blame")
+	checkT(err, t)
+	fmLines := e.frontmatterLines("runbook-blame")
+	if fmLines != 4 {
+		t.Errorf("expected 4 lines of frontmatter, got %d", fmLines)
+	}
+
+	chunks := groupBlame("runbook-blame", lines[fmLines:])
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %+v", chunks)
+	}
+	if chunks[0].Author != "alice" || len(chunks[0].Lines) != 2 || chunks[0].Lines[1].Text != "step two" || chunks[0].Lines[1].Num != 6 {
+		t.Errorf("unexpected first chunk: %+v", chunks[0])
+	}
+	if chunks[1].Author != "bob" || chunks[1].Summary != "Add step three" || chunks[1].Lines[0].Text != "step three" {
+		t.Errorf("unexpected second chunk: %+v", chunks[1])
+	}
+}
+
+// TestMemoryStorage tests that in-memory wikis keep pages and their history without creating the wiki directory
+func TestMemoryStorage(t *testing.T) {
+	if testStorage != "memory" {
+		t.Skip("only applies to in-memory storage")
+	}
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	// A separate, empty wiki, as a demo instance would start with
+	store, err := newStore(e.cfg)
+	checkT(err, t)
+	e.store = store
+	checkT(initWikiDir(e.cfg), t)
+	if !store.IsEmpty() {
+		t.Fatal("new in-memory store is not empty")
+	}
+
+	page := &wiki{
+		Title:    "demo",
+		Filename: "demo/page",
+		Frontmatter: frontmatter{
+			Title:      "demo",
+			Permission: publicPermission,
+		},
+		Content: []byte("first\n"),
+	}
+	checkT(page.save(e), t)
+	page.Content = []byte("second\n")
+	checkT(page.save(e), t)
+
+	_, content := e.readPage("demo/page")
+	if string(content) != "second\n" {
+		t.Errorf("unexpected content: %q", content)
+	}
+	history, err := store.FileLog("demo/page")
+	checkT(err, t)
+	if len(history) != 2 {
+		t.Errorf("expected 2 commits, got %d", len(history))
+	}
+	if _, err := os.Stat(e.cfg.WikiDir); !os.IsNotExist(err) {
+		t.Errorf("wiki directory was created on disk: %v", err)
+	}
+}
+
+// TestSearchIndex tests ranking, permissions, and keeping the search index up to date as pages change
+func TestSearchIndex(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	pages := []struct {
+		name       string
+		title      string
+		tags       []string
+		permission string
+		content    string
+	}{
+		{"search-title", "Failover runbook", nil, publicPermission, "what to do\n"},
+		{"search-tags", "Database notes", []string{"failover"}, publicPermission, "notes\n"},
+		{"search-body", "Misc", nil, publicPermission, "failover failover failover\n"},
+		{"search-admin", "Admin failover", nil, adminPermission, "secret\n"},
+	}
+	for _, v := range pages {
+		page := &wiki{
+			Title:    v.title,
+			Filename: v.name,
+			Frontmatter: frontmatter{
+				Title:      v.title,
+				Tags:       v.tags,
+				Permission: v.permission,
+			},
+			Content: []byte(v.content),
+		}
+		checkT(page.save(e), t)
+	}
+
+	names := func(hits []searchHit) []string {
+		var names []string
+		for _, v := range hits {
+			if strings.HasPrefix(v.Name, "search-") {
+				names = append(names, v.Name)
+			}
+		}
+		return names
+	}
+
+	got := names(e.searchWiki("Failover", false, false))
+	want := []string{"search-title", "search-tags", "search-body"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	got = names(e.searchWiki("failover", true, true))
+	if len(got) != 4 || got[0] != "search-admin" {
+		t.Errorf("expected the admin page first for admins, got %v", got)
+	}
+	if got := names(e.searchWiki("failover notes", false, false)); !reflect.DeepEqual(got, []string{"search-tags"}) {
+		t.Errorf("expected every term to be required, got %v", got)
+	}
+
+	// Changes after the index was built are picked up, without rebuilding the index
+	head := e.headHash()
+	if e.index.SHA1 != head {
+		t.Errorf("expected index to be at %s, got %s", head, e.index.SHA1)
+	}
+	page := &wiki{
+		Title:    "Misc",
+		Filename: "search-body",
+		Frontmatter: frontmatter{
+			Title:      "Misc",
+			Permission: publicPermission,
+		},
+		Content: []byte("nothing to see here\n"),
+	}
+	checkT(page.save(e), t)
+	checkT(e.store.Remove("search-tags"), t)
+	checkT(e.store.Commit("", "search-tags has been removed from git repo."), t)
+
+	changed, err := e.store.ChangedFiles(head, e.headHash())
+	checkT(err, t)
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Name < changed[j].Name })
+	if !reflect.DeepEqual(changed, []fileChange{{Status: 'M', Name: "search-body"}, {Status: 'D', Name: "search-tags"}}) {
+		t.Errorf("unexpected changed files: %v", changed)
+	}
+
+	want = []string{"search-title"}
+	if got := names(e.searchWiki("failover", false, false)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v after changes, got %v", want, got)
+	}
+	if got := names(e.searchWiki("nothing", false, false)); !reflect.DeepEqual(got, []string{"search-body"}) {
+		t.Errorf("expected the new content of search-body to be indexed, got %v", got)
+	}
+
+	// A new env picks up the saved index
+	tmpdb2, e2 := testEnvInit()
+	defer os.Remove(tmpdb2)
+	if got := names(e2.searchWiki("failover", false, false)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v from saved index, got %v", want, got)
+	}
+
+	// An index from a commit that no longer exists is rebuilt
+	e2.index.SHA1 = strings.Repeat("0", 40)
+	if got := names(e2.searchWiki("failover", false, false)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v from rebuilt index, got %v", want, got)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	content := []byte(strings.Repeat("filler words here ", 20) + "the <b>Failover</b> runbook\nsays to fail over " + strings.Repeat("more filler ", 20))
+	s := string(snippet(content, []string{"failover"}))
+	if !strings.Contains(s, "&lt;b&gt;<mark>Failover</mark>&lt;/b&gt; runbook says") {
+		t.Errorf("expected escaped, highlighted match, got %q", s)
+	}
+	if !strings.HasPrefix(s, "…") || !strings.HasSuffix(s, "…") {
+		t.Errorf("expected snippet to be cut at both ends, got %q", s)
+	}
+	if s := snippet([]byte("short"), []string{"missing"}); s != "short" {
+		t.Errorf("expected whole content without a match, got %q", s)
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	for i := 0; i < searchPageSize+5; i++ {
+		page := &wiki{
+			Title:    "paginated",
+			Filename: fmt.Sprintf("paginated-%02d", i),
+			Frontmatter: frontmatter{
+				Title:      "paginated",
+				Permission: publicPermission,
+			},
+			Content: []byte("zebra\n"),
+		}
+		checkT(page.save(e), t)
+	}
+
+	req := httptest.NewRequest("GET", "/search/zebra?page=2", nil)
+	rr := httptest.NewRecorder()
+	router(e).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "Page 2 of 2") || !strings.Contains(body, `href="/search/zebra?page=1"`) {
+		t.Errorf("expected second page of results, got %s", body)
+	}
+	if strings.Contains(body, `href="/paginated-00"`) || !strings.Contains(body, `href="/paginated-24"`) {
+		t.Error("expected only the last results on the second page")
+	}
+	if !strings.Contains(body, "<mark>zebra</mark>") {
+		t.Error("expected highlighted snippets")
+	}
+}
+
+// TestSearchLinks checks links between search modes and pages keep queries with slashes, question marks and hashes whole
+func TestSearchLinks(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	query := "infra/db?x#y 100%"
+	for _, mode := range []string{"", "?mode=regex"} {
+		r := httptest.NewRequest("GET", "/search/"+url.PathEscape(query)+mode, nil)
+		w := httptest.NewRecorder()
+		router(e).ServeHTTP(w, r)
+		body := w.Body.String()
+		if !strings.Contains(body, "<strong>infra/db?x#y 100%</strong>") {
+			t.Errorf("expected the query to be read back whole, got %q", body)
+		}
+		if !strings.Contains(body, `href="/search/infra%2Fdb%3Fx%23y%20100%25`) {
+			t.Errorf("expected links to other search modes to escape the query, got %q", body)
+		}
+	}
+}
+
+// TestSearchShellCharacters makes sure search terms are passed to git as they are, and never run by a shell
+func TestSearchShellCharacters(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	marker := filepath.Join(e.cfg.DataDir, "pwned")
+	queries := []string{
+		`it's`,
+		`'; touch ` + marker + `; echo '`,
+		`"; touch ` + marker + `; echo "`,
+		"`touch " + marker + "`",
+		`$(touch ` + marker + `)`,
+		`a;b`,
+	}
+
+	page := &wiki{
+		Title:    "shell-chars",
+		Filename: "shell-chars",
+		Frontmatter: frontmatter{
+			Title:      "shell-chars",
+			Permission: publicPermission,
+		},
+		Content: []byte(strings.Join(queries, "\n") + "\n"),
+	}
+	checkT(page.save(e), t)
+
+	for _, query := range queries {
+		for _, regex := range []bool{false, true} {
+			results := e.gitSearch(query, []string{"shell-chars"}, regex)
+			// Regex mode reads $( and other characters as syntax, so only literal searches must match
+			if !regex && len(results) == 0 {
+				t.Errorf("expected a match for %q", query)
+			}
+			for _, v := range results {
+				if v.Name != "shell-chars" {
+					t.Errorf("unexpected result for %q: %+v", query, v)
+				}
+			}
+		}
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatal("search term was run by a shell")
+	}
+}
+
+func TestSearchModes(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	for _, name := range []string{"grep*", "grep-other"} {
+		page := &wiki{
+			Title:    name,
+			Filename: name,
+			Frontmatter: frontmatter{
+				Title:      name,
+				Permission: publicPermission,
+			},
+			Content: []byte("database failover\n"),
+		}
+		checkT(page.save(e), t)
+	}
+
+	if results := e.gitSearch("fail.?over", []string{"grep-other"}, false); len(results) != 0 {
+		t.Errorf("expected literal search not to treat the term as a regex, got %+v", results)
+	}
+	if results := e.gitSearch("fail.?over", []string{"grep-other"}, true); len(results) != 1 {
+		t.Errorf("expected regex search to match, got %+v", results)
+	}
+	if results := e.gitSearch("FAILOVER", []string{"grep-other"}, false); len(results) != 1 {
+		t.Errorf("expected search to ignore case, got %+v", results)
+	}
+	// Pathspecs are literal, so this only searches the one page
+	for _, v := range e.gitSearch("failover", []string{"grep*"}, false) {
+		if v.Name != "grep*" {
+			t.Errorf("expected only grep* to be searched, got %+v", v)
+		}
+	}
+
+	// Every backend searches files as they are on disk, including changes not yet committed
+	committed, err := e.store.ReadFile("grep-other")
+	checkT(err, t)
+	checkT(e.store.WriteFile("grep-other", append(append([]byte{}, committed...), "uncommitted switchover\n"...)), t)
+	results := e.gitSearch("switchover", []string{"grep-other"}, false)
+	checkT(e.store.WriteFile("grep-other", committed), t)
+	if len(results) != 1 || !strings.Contains(results[0].Result, "uncommitted switchover") {
+		t.Errorf("expected uncommitted changes to be searched, got %+v", results)
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	pages := []struct {
+		name       string
+		tags       []string
+		permission string
+		author     string
+		content    string
+	}{
+		{"query/runbook", []string{"oncall"}, publicPermission, "alice <alice@example.lan>", "promote the replica\n"},
+		{"query/draft", []string{"oncall", "draft"}, publicPermission, "bob <bob@example.lan>", "promote the replica, maybe\n"},
+		{"query/secret", []string{"oncall"}, adminPermission, "alice <alice@example.lan>", "root password\n"},
+	}
+	for _, v := range pages {
+		page := &wiki{
+			Title:    "DB failover " + v.name,
+			Filename: v.name,
+			Frontmatter: frontmatter{
+				Title:      "DB failover " + v.name,
+				Tags:       v.tags,
+				Permission: v.permission,
+			},
+			Content: []byte(v.content),
+			Author:  v.author,
+		}
+		checkT(page.save(e), t)
+	}
+
+	tests := []struct {
+		query   string
+		isAdmin bool
+		want    []string
+	}{
+		{"tag:oncall -tag:draft path:query/", false, []string{"query/runbook"}},
+		{"tag:oncall path:query/", true, []string{"query/draft", "query/runbook", "query/secret"}},
+		{`"promote the replica" -maybe`, false, []string{"query/runbook"}},
+		{`title:"db failover" author:alice`, true, []string{"query/runbook", "query/secret"}},
+		{"path:query/ permission:admin", false, nil},
+		{"path:query/ modified:<2000-01-01", true, nil},
+		{`"omote the repl" -maybe path:query/`, false, []string{"query/runbook"}},
+		{"plic path:query/", false, []string{"query/draft", "query/runbook"}},
+		{"author:bob path:query/", true, []string{"query/draft"}},
+	}
+	for _, test := range tests {
+		q, err := search.Parse(test.query)
+		checkT(err, t)
+		var got []string
+		for _, v := range e.queryWiki(q, test.isAdmin, test.isAdmin) {
+			got = append(got, v.Name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.want, got)
+		}
+	}
+
+	// Bad queries are explained, rather than searched for
+	req := httptest.NewRequest("GET", "/search/modified:>soon", nil)
+	rr := httptest.NewRecorder()
+	router(e).ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), "dates must look like") {
+		t.Error("expected an explanation of the bad date")
+	}
+}
+
+// TestSearchCandidates checks the index narrows queries down to every page that could match, and no others
+func TestSearchCandidates(t *testing.T) {
+	idx := newSearchIndex()
+	idx.add("failover", frontmatter{Title: "DB failover"}, []byte("Promote the replica, then repoint the app.\n"))
+	idx.add("backups", frontmatter{Title: "Backups"}, []byte("Restore the replica from last night.\n"))
+	idx.add("other", frontmatter{Title: "Other"}, []byte("Nothing to see here.\n"))
+
+	tests := []struct {
+		words []string
+		want  []string
+	}{
+		{[]string{"replica"}, []string{"backups", "failover"}},
+		{[]string{"plic"}, []string{"backups", "failover"}},
+		{[]string{"omote the repl"}, []string{"failover"}},
+		{[]string{"the replica", "night"}, []string{"backups"}},
+		{[]string{"ups"}, []string{"backups"}},
+		{[]string{"missing"}, nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for name := range idx.candidates(test.words) {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.words, test.want, got)
+		}
+	}
+
+	if idx.candidates(nil) != nil || idx.candidates([]string{"--"}) != nil {
+		t.Error("expected queries without words to leave every page a candidate")
+	}
+}
+
+// TestSearchHistory tests finding text that has since been removed from a page
+func TestSearchHistory(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewAdmin("admin", "admin")
+	e.authState.NewUser("historyuser", "historyuser")
+
+	for _, v := range []struct{ name, permission string }{{"history-network", privatePermission}, {"history-secret", adminPermission}} {
+		page := &wiki{
+			Title:    v.name,
+			Filename: v.name,
+			Frontmatter: frontmatter{
+				Title:      v.name,
+				Permission: v.permission,
+			},
+			Content: []byte("The router is at 10.9.8.7\n"),
+			Author:  "alice <alice@example.lan>",
+			Message: "Add router",
+		}
+		checkT(page.save(e), t)
+		page.Content = []byte("The router has moved\n")
+		page.Author = "bob <bob@example.lan>"
+		page.Message = "Redact router address"
+		checkT(page.save(e), t)
+	}
+
+	commits, err := e.store.Pickaxe("10.9.8.7", false)
+	checkT(err, t)
+	if len(commits) != 4 || commits[0].Message != "Redact router address" || commits[3].Message != "Add router" {
+		t.Fatalf("unexpected commits: %+v", commits)
+	}
+	if commits, _ := e.store.Pickaxe("10.9.8.[0-9]", false); len(commits) != 0 {
+		t.Errorf("expected literal search not to match, got %+v", commits)
+	}
+	if commits, _ := e.store.Pickaxe("10\\.9\\.8\\.[0-9]", true); len(commits) != 4 {
+		t.Errorf("expected regex search to match 4 commits, got %+v", commits)
+	}
+
+	// Anonymous users are not allowed to search history
+	r := httptest.NewRequest("GET", "/search/10.9.8.7?history=1", nil)
+	w := httptest.NewRecorder()
+	router(e).ServeHTTP(w, r)
+	if w.Code == http.StatusOK {
+		t.Error("expected anonymous history search to be refused")
+	}
+
+	w = httptest.NewRecorder()
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.Login("historyuser", r)
+	})
+	e.authState.LoadAndSave(testHandler).ServeHTTP(w, r)
+	r.Header = http.Header{"Cookie": w.Result().Header["Set-Cookie"]}
+
+	w = httptest.NewRecorder()
+	router(e).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("history search returned wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	// Newest first, so the secret page's changes come before these
+	if commits[2].Filename != "history-network" || !strings.Contains(body, `href="/history-network?commit=`+commits[2].Commit+`"`) {
+		t.Error("expected a link to the commit which removed the address")
+	}
+	if strings.Contains(body, "history-secret") {
+		t.Error("admin page shown to a non-admin")
+	}
+
+	// Deleted pages are listed according to the permission they had before they were deleted
+	for _, v := range []struct{ name, permission string }{{"history-gone-public", publicPermission}, {"history-gone-secret", adminPermission}} {
+		page := &wiki{
+			Title:    v.name,
+			Filename: v.name,
+			Frontmatter: frontmatter{
+				Title:      v.name,
+				Permission: v.permission,
+			},
+			Content: []byte("The vault code is 4242\n"),
+		}
+		checkT(page.save(e), t)
+		checkT(e.store.Remove(v.name), t)
+		checkT(e.store.Commit("", v.name+" has been removed from git repo."), t)
+	}
+	e.refreshCache()
+	if got := e.deletedPermission("history-gone-secret"); got != adminPermission {
+		t.Errorf("expected the deleted page's old permission, got %q", got)
+	}
+	if got := e.deletedPermission("history-never-existed"); got != adminPermission {
+		t.Errorf("expected pages which cannot be found to be admin-only, got %q", got)
+	}
+
+	cookies := r.Header
+	r = httptest.NewRequest("GET", "/search/4242?history=1", nil)
+	r.Header = cookies
+	w = httptest.NewRecorder()
+	router(e).ServeHTTP(w, r)
+	body = w.Body.String()
+	if !strings.Contains(body, "history-gone-public") {
+		t.Error("expected the deleted public page to be listed")
+	}
+	if strings.Contains(body, "history-gone-secret") {
+		t.Error("deleted admin page shown to a non-admin")
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewAdmin("admin", "admin")
+
+	for _, v := range []struct {
+		name, title, tag, permission string
+	}{
+		{"suggest/db-failover", "Database failover", "suggestoncall", publicPermission},
+		{"suggest/secret-failover", "Secret failover", "suggestsecret", adminPermission},
+	} {
+		page := &wiki{
+			Title:    v.title,
+			Filename: v.name,
+			Frontmatter: frontmatter{
+				Title:      v.title,
+				Tags:       []string{v.tag},
+				Permission: v.permission,
+			},
+			Content: []byte("contents\n"),
+		}
+		checkT(page.save(e), t)
+	}
+	e.tags.List = e.loadCache().Tags
+
+	suggest := func(q string, r *http.Request) suggestions {
+		r.URL.RawQuery = url.Values{"q": {q}}.Encode()
+		w := httptest.NewRecorder()
+		router(e).ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("unexpected response: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		var s suggestions
+		checkT(json.NewDecoder(w.Body).Decode(&s), t)
+		return s
+	}
+
+	anon := httptest.NewRequest("GET", "/api/suggest", nil)
+	// Other tests leave similar pages behind, but these are the closest matches
+	s := suggest("suggest/dbfail", anon)
+	if len(s.Pages) != 1 || s.Pages[0].Name != "suggest/db-failover" || s.Pages[0].Title != "Database failover" {
+		t.Errorf("unexpected pages: %+v", s.Pages)
+	}
+	// Titles are matched too
+	if s := suggest("databasefail", anon); len(s.Pages) != 1 {
+		t.Errorf("expected a match on the title, got %+v", s.Pages)
+	}
+	s = suggest("suggest", anon)
+	if !reflect.DeepEqual(s.Tags, []string{"suggestoncall"}) {
+		t.Errorf("unexpected tags: %v", s.Tags)
+	}
+	for _, v := range s.Pages {
+		if v.Name == "suggest/secret-failover" {
+			t.Error("admin page suggested to an anonymous user")
+		}
+	}
+
+	admin := httptest.NewRequest("GET", "/api/suggest", nil)
+	w := httptest.NewRecorder()
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.Login("admin", r)
+	})
+	e.authState.LoadAndSave(testHandler).ServeHTTP(w, admin)
+	admin.Header = http.Header{"Cookie": w.Result().Header["Set-Cookie"]}
+	s = suggest("suggest", admin)
+	if !reflect.DeepEqual(s.Tags, []string{"suggestoncall", "suggestsecret"}) {
+		t.Errorf("unexpected tags for an admin: %v", s.Tags)
+	}
+	if s := suggest("secretfail", admin); len(s.Pages) != 1 || s.Pages[0].Name != "suggest/secret-failover" {
+		t.Errorf("expected admin page to be suggested to an admin, got %+v", s.Pages)
+	}
+}
+
+// TestUpdateCache tests that bringing the cache up to date gives the same result as rebuilding it
+func TestUpdateCache(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	save := func(name, permission string, tags []string, favorite bool) {
+		page := &wiki{
+			Title:    name,
+			Filename: name,
+			Frontmatter: frontmatter{
+				Title:      name,
+				Permission: permission,
+				Tags:       tags,
+				Favorite:   favorite,
+			},
+			Content: []byte("contents of " + name + "\n"),
+		}
+		checkT(page.save(e), t)
+	}
+	save("cache-modified", publicPermission, []string{"cachetag"}, true)
+	save("cache-deleted", publicPermission, []string{"cachetag"}, false)
+	save("cache-moved", privatePermission, nil, false)
+	save("cache-unchanged", privatePermission, nil, false)
+
+	old := e.buildCache()
+
+	save("cache-modified", adminPermission, []string{"cacheother"}, false)
+	save("cachedir/sub/added", publicPermission, []string{"cachetag"}, true)
+	checkT(e.store.Remove("cache-deleted"), t)
+	checkT(e.store.Commit("", "cache-deleted has been removed from git repo."), t)
+	checkT(e.moveWiki("cache-moved", "cachedir/moved", "", false, false), t)
+
+	changes, err := e.store.ChangedFiles(old.SHA1, e.headHash())
+	checkT(err, t)
+	var renamed bool
+	for _, change := range changes {
+		if change.Status == 'R' && change.From == "cache-moved" && change.Name == "cachedir/moved" {
+			renamed = true
+		}
+	}
+	if !renamed {
+		t.Errorf("expected the move to be listed as a rename, got %+v", changes)
+	}
+
+	full := e.buildCache()
+	updated := e.updateCache(old)
+	if !reflect.DeepEqual(updated, full) {
+		t.Errorf("updated cache differs from a rebuilt one:\n%+v\n%+v", updated, full)
+	}
+
+	// Only changed files are read again
+	for i, v := range old.Cache {
+		if v.Filename == "cache-unchanged" {
+			old.Cache[i].Permission = "stale"
+		}
+	}
+	for _, v := range e.updateCache(old).Cache {
+		if v.Filename == "cache-unchanged" && v.Permission != "stale" {
+			t.Error("expected unchanged file to be kept as it was")
+		}
+	}
+
+	// A cache from a commit which is no longer around is rebuilt
+	old.SHA1 = strings.Repeat("0", 40)
+	if updated := e.updateCache(old); !reflect.DeepEqual(updated, full) {
+		t.Errorf("expected cache to be rebuilt, got %+v", updated)
+	}
+
+	// The saved cache is picked up and brought up to date on startup
+	tmpdb2, e2 := testEnvInit()
+	defer os.Remove(tmpdb2)
+	save("cache-unchanged", publicPermission, nil, false)
+	for _, v := range e2.loadCache().Cache {
+		if v.Filename == "cache-unchanged" && v.Permission != publicPermission {
+			t.Errorf("expected saved cache to be brought up to date, got %+v", v)
+		}
+	}
+}
+
+func TestTimesWalk(t *testing.T) {
+	walk := newTimesWalk()
+	// Newest first
+	walk.commit(9, "dana", []fileChange{
+		{Status: 'M', Name: "edited"},
+		{Status: 'R', Name: "moved", From: "old"},
+		{Status: 'C', Name: "copy", From: "stub"},
+		{Status: 'M', Name: "stub"},
+	})
+	walk.commit(8, "carol", []fileChange{
+		{Status: 'A', Name: "recreated"},
+		{Status: 'D', Name: "deleted"},
+	})
+	walk.commit(7, "bob", []fileChange{
+		{Status: 'D', Name: "recreated"},
+		{Status: 'M', Name: "old"},
+	})
+	walk.commit(6, "alice", []fileChange{
+		{Status: 'A', Name: "edited"},
+		{Status: 'A', Name: "old"},
+		{Status: 'A', Name: "stub"},
+		{Status: 'A', Name: "recreated"},
+		{Status: 'A', Name: "deleted"},
+	})
+
+	expected := map[string]fileTimes{
+		"edited":    {Ctime: 6, Mtime: 9, Authors: []string{"dana", "alice"}},
+		"moved":     {Ctime: 6, Mtime: 9, Authors: []string{"dana", "bob", "alice"}},
+		"copy":      {Ctime: 6, Mtime: 9, Authors: []string{"dana", "alice"}},
+		"stub":      {Ctime: 6, Mtime: 9, Authors: []string{"dana", "alice"}},
+		"recreated": {Ctime: 8, Mtime: 8, Authors: []string{"carol"}},
+	}
+	if !reflect.DeepEqual(walk.times, expected) {
+		t.Errorf("timesWalk got %v, expected %v", walk.times, expected)
+	}
+}
+
+// TestFileTimes checks the times found all at once match those found for each file
+func TestFileTimes(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	times, err := e.store.FileTimes()
+	checkT(err, t)
+
+	fileList, err := e.store.LsTree()
+	checkT(err, t)
+	for _, file := range fileList {
+		if file.Type != "blob" {
+			continue
+		}
+		expected := e.pageTimes(file.Filename)
+		// `git log --follow` also finds copies of untouched files, dating pages with the same content as an older one back to it
+		// and taking in its authors too
+		if got := times[file.Filename]; testStorage == "git" && got.Ctime > expected.Ctime && got.Ctime <= expected.Mtime {
+			expected.Ctime = got.Ctime
+			expected.Authors = got.Authors
+		}
+		if !reflect.DeepEqual(times[file.Filename], expected) {
+			t.Errorf("FileTimes for %s: got %v, expected %v", file.Filename, times[file.Filename], expected)
+		}
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	c := newRenderCache(2, 10)
+	c.add("a", "aaaa")
+	c.add("b", "bbbb")
+	if _, ok := c.get("a"); !ok {
+		t.Error("expected a to be cached")
+	}
+	// b is now the least recently used
+	c.add("c", "cccc")
+	if _, ok := c.get("b"); ok {
+		t.Error("expected b to be evicted once there were too many entries")
+	}
+	// a has to go too, to make room
+	c.add("d", "dddddd")
+	if _, ok := c.get("a"); ok {
+		t.Error("expected a to be evicted once there were too many bytes")
+	}
+	if html, ok := c.get("d"); !ok || html != "dddddd" {
+		t.Errorf("expected d to be cached, got %q", html)
+	}
+	c.add("huge", "more than ten bytes")
+	if _, ok := c.get("huge"); ok || c.len() != 2 {
+		t.Error("expected pages bigger than the whole cache to be skipped")
+	}
+
+	if newRenderCache(-1, 0) != nil {
+		t.Error("expected a negative size to disable the cache")
+	}
+}
+
+// TestWikiLinks checks [[wikilinks]] find pages as checkName does, and links to missing pages are marked, with both engines
+func TestWikiLinks(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.cache.Cache = []gitDirList{
+		{Type: "blob", Filename: "index", Permission: publicPermission},
+		{Type: "blob", Filename: "notes.md", Permission: publicPermission},
+		{Type: "tree", Filename: "docs", Permission: publicPermission},
+		{Type: "blob", Filename: "docs/getting-started", Permission: publicPermission},
+	}
+	e.cache.index()
+	for _, c := range []struct {
+		name, target string
+		exists       bool
+	}{
+		{"index", "index", true},
+		{"/index", "index", true},
+		{"notes", "notes.md", true},
+		{"Getting Started", "getting-started", false},
+		{"docs/Getting Started", "docs/getting-started", true},
+		{"docs", "docs", true},
+		{"New Page", "new-page", false},
+	} {
+		target, exists := e.resolveLink(c.name, "anonymous")
+		if target != c.target || exists != c.exists {
+			t.Errorf("expected %q to resolve to %q, %v; got %q, %v", c.name, c.target, c.exists, target, exists)
+		}
+	}
+
+	md := []byte("[[notes]], [[docs/Getting Started|Start here]] and [[New Page]], but not `[[code]]`\n\n    [[indented]]\n")
+	goldmark, err := newRenderer(config{Renderer: "goldmark"})
+	checkT(err, t)
+	for _, engine := range []*render.Renderer{nil, goldmark} {
+		e.goldmark = engine
+		html := e.renderMarkdown(md, false, "anonymous")
+		for _, want := range []string{
+			`<a href="/notes.md" rel="nofollow">notes</a>`,
+			`<a href="/docs/getting-started" rel="nofollow">Start here</a>`,
+			`<a href="/new-page" class="new-page" rel="nofollow">New Page</a>`,
+			`<code>[[code]]</code>`,
+			"<pre><code>[[indented]]",
+		} {
+			if !strings.Contains(html, want) {
+				t.Errorf("expected %q in %q", want, html)
+			}
+		}
+	}
+
+	// Creating the page turns the link blue, rather than serving the old render
+	before := e.renderID()
+	e.cache.Cache = append(e.cache.Cache, gitDirList{Type: "blob", Filename: "new-page", Permission: publicPermission})
+	e.cache.index()
+	if e.renderID() == before {
+		t.Error("expected the render ID to change along with the pages in the wiki")
+	}
+	if html := e.renderMarkdown(md, false, "anonymous"); strings.Contains(html, "new-page\" class") {
+		t.Errorf("expected the new page to be linked normally, got %q", html)
+	}
+}
+
+// TestWikiLinksPermission checks pages a viewer cannot see are linked as missing, so red links do not give them away
+func TestWikiLinksPermission(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+	e.authState.NewAdmin("admin", "admin")
+	e.renders = newRenderCache(0, 0)
+
+	e.cache.Cache = []gitDirList{
+		{Type: "blob", Filename: "open", Permission: publicPermission},
+		{Type: "blob", Filename: "plans.md", Permission: privatePermission},
+		{Type: "blob", Filename: "keys", Permission: adminPermission},
+	}
+	e.cache.index()
+	for _, c := range []struct {
+		name, class, target string
+		exists              bool
+	}{
+		{"open", "anonymous", "open", true},
+		{"plans", "anonymous", "plans", false},
+		{"plans", "user", "plans.md", true},
+		{"plans", adminPermission, "plans.md", true},
+		{"keys", "anonymous", "keys", false},
+		{"keys", "user", "keys", false},
+		{"keys", adminPermission, "keys", true},
+	} {
+		target, exists := e.resolveLink(c.name, c.class)
+		if target != c.target || exists != c.exists {
+			t.Errorf("expected %q to resolve to %q, %v for %s; got %q, %v", c.name, c.target, c.exists, c.class, target, exists)
+		}
+	}
+
+	// Both for rendered pages, and for previews, which anyone can ask for
+	md := []byte("[[open]] [[plans]] [[keys]]\n")
+	goldmark, err := newRenderer(config{Renderer: "goldmark"})
+	checkT(err, t)
+	for _, engine := range []*render.Renderer{nil, goldmark} {
+		e.goldmark = engine
+		if html := e.renderMarkdown(md, false, adminPermission); strings.Contains(html, "new-page") {
+			t.Errorf("expected every page to exist for admins, got %q", html)
+		}
+		// Served from the render cache after the admin's copy, so the class has to be part of the key
+		html := e.renderMarkdown(md, false, "anonymous")
+		for _, want := range []string{
+			`<a href="/open" rel="nofollow">open</a>`,
+			`<a href="/plans" class="new-page" rel="nofollow">plans</a>`,
+			`<a href="/keys" class="new-page" rel="nofollow">keys</a>`,
+		} {
+			if !strings.Contains(html, want) {
+				t.Errorf("expected %q in %q", want, html)
+			}
+		}
+
+		preview := func(r *http.Request) string {
+			w := httptest.NewRecorder()
+			e.authState.LoadAndSave(http.HandlerFunc(e.markdownPreview)).ServeHTTP(w, r)
+			return w.Body.String()
+		}
+		r := httptest.NewRequest("POST", "/md_render", strings.NewReader(`{"md": "[[plans]] [[keys]]"}`))
+		if html := preview(r); !strings.Contains(html, `<a href="/plans" class="new-page"`) || !strings.Contains(html, `<a href="/keys" class="new-page"`) {
+			t.Errorf("expected hidden pages to be missing from anonymous previews, got %q", html)
+		}
+
+		w := httptest.NewRecorder()
+		e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.authState.Login("admin", r)
+		})).ServeHTTP(w, r)
+		r = httptest.NewRequest("POST", "/md_render", strings.NewReader(`{"md": "[[plans]] [[keys]]"}`))
+		r.Header = http.Header{"Cookie": w.Result().Header["Set-Cookie"]}
+		if html := preview(r); strings.Contains(html, "new-page") {
+			t.Errorf("expected every page to exist in admin previews, got %q", html)
+		}
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	content := []byte("[[Target Page]] [up](../other) [here](sibling#part) [abs](/abs?x=1) [again](/abs)\n\n[out](https://example.com/) [anchor](#top) [Page]()\n\n![a](/uploads/a.png) ![b](b.png) ![c](https://example.com/c.png)\n")
+	want := []string{"Target Page", "docs/other", "docs/guide/sibling", "abs", "Page"}
+	links, images := pageLinks("docs/guide/page", content)
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("expected %q, got %q", want, links)
+	}
+	if want := []string{"uploads/a.png", "docs/guide/b.png"}; !reflect.DeepEqual(images, want) {
+		t.Errorf("expected images %q, got %q", want, images)
+	}
+}
+
+// TestBacklinks checks pages list the pages linking to them, as far as the viewer is allowed to see them
+func TestBacklinks(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewAdmin("admin", "admin")
+	e.authState.NewUser("backlinksuser", "backlinksuser")
+
+	for _, p := range []struct {
+		name, permission, content string
+	}{
+		{"bltarget", publicPermission, "The target\n"},
+		{"blpublic", publicPermission, "Links to [[BLTarget]]\n"},
+		{"blprivate", privatePermission, "Links to [the target](/bltarget)\n"},
+		{"bldir/bladmin", adminPermission, "Links to [the target](../bltarget) and [[blmissing]]\n"},
+	} {
+		page := &wiki{
+			Title:       p.name,
+			Filename:    p.name,
+			Frontmatter: frontmatter{Title: p.name, Permission: p.permission},
+			Content:     []byte(p.content),
+		}
+		checkT(page.save(e), t)
+	}
+	e.refreshCache()
+
+	login := func(name string) []string {
+		if name == "" {
+			return nil
+		}
+		rec := httptest.NewRecorder()
+		e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.authState.Login(name, r)
+		})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Result().Header["Set-Cookie"]
+	}
+	get := func(url string, cookies []string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		if cookies != nil {
+			r.Header["Cookie"] = cookies
+		}
+		w := httptest.NewRecorder()
+		router(e).ServeHTTP(w, r)
+		return w
+	}
+
+	for _, c := range []struct {
+		user string
+		want []string
+	}{
+		{"", []string{"blpublic"}},
+		{"backlinksuser", []string{"blprivate", "blpublic"}},
+		{"admin", []string{"bldir/bladmin", "blprivate", "blpublic"}},
+	} {
+		cookies := login(c.user)
+		w := get("/api/backlinks/bltarget", cookies)
+		var b backlinks
+		err := json.NewDecoder(w.Body).Decode(&b)
+		checkT(err, t)
+		if w.Code != http.StatusOK || b.Name != "bltarget" || !reflect.DeepEqual(b.Backlinks, c.want) {
+			t.Errorf("expected %q to see backlinks %q, got %d %+v", c.user, c.want, w.Code, b)
+		}
+
+		w = get("/bltarget", cookies)
+		if !strings.Contains(w.Body.String(), "Pages linking here") || !strings.Contains(w.Body.String(), `<a href="/blpublic">blpublic</a>`) {
+			t.Errorf("expected the page to list its backlinks for %q, got %q", c.user, w.Body.String())
+		}
+		if c.user == "" && strings.Contains(w.Body.String(), "blprivate") {
+			t.Error("expected private pages to be left out for anonymous users")
+		}
+	}
+
+	// Pages without any links to them have nothing to list
+	w := get("/api/backlinks/blpublic", nil)
+	if !strings.Contains(w.Body.String(), `"backlinks":[]`) {
+		t.Errorf("expected no backlinks, got %q", w.Body.String())
+	}
+
+	// Links to pages which do not exist yet count once the page is created
+	page := &wiki{
+		Title:       "blmissing",
+		Filename:    "blmissing",
+		Frontmatter: frontmatter{Title: "blmissing", Permission: publicPermission},
+		Content:     []byte("Now here\n"),
+	}
+	checkT(page.save(e), t)
+	e.refreshCache()
+	if got := e.loadCache().listedBacklinks("blmissing", true, true); !reflect.DeepEqual(got, []string{"bldir/bladmin"}) {
+		t.Errorf("expected the new page to be linked from bldir/bladmin, got %q", got)
+	}
+
+	// The links are saved along with the cache
+	saved := e.readCache()
+	if !reflect.DeepEqual(saved.Links["blpublic"], []string{"BLTarget"}) || len(saved.listedBacklinks("bltarget", true, true)) != 3 {
+		t.Errorf("expected links to survive the cache being saved, got %q", saved.Links)
+	}
+}
+
+// TestReports checks orphaned, wanted and broken pages are found from the links kept in the cache
+func TestReports(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewAdmin("admin", "admin")
+	e.authState.NewUser("reportsuser", "reportsuser")
+
+	for _, p := range []struct {
+		name, content string
+	}{
+		{"rporphan", "Links to [[rpwanted]], [again](/rpwanted), [[RPTarget]] and [tags](/tags)\n\n![up](/uploads/rp-up.png) ![gone](/uploads/rp-gone.png) ![here](rpimage.png)\n"},
+		{"rptarget", "Links to [[rpwanted]] and [a file](/uploads/rp-gone.txt)\n"},
+	} {
+		page := &wiki{
+			Title:       p.name,
+			Filename:    p.name,
+			Frontmatter: frontmatter{Title: p.name, Permission: publicPermission},
+			Content:     []byte(p.content),
+		}
+		checkT(page.save(e), t)
+	}
+	e.refreshCache()
+
+	theCache := e.loadCache()
+	r := theCache.reports(func(name string) bool { return name == "uploads/rp-up.png" })
+	if !slices.Contains(r.Orphans, "rporphan") || slices.Contains(r.Orphans, "rptarget") {
+		t.Errorf("expected rporphan to be orphaned but not rptarget, got %q", r.Orphans)
+	}
+	if !slices.ContainsFunc(r.Wanted, func(w wantedPage) bool {
+		return w.Name == "rpwanted" && reflect.DeepEqual(w.LinkedFrom, []string{"rporphan", "rptarget"})
+	}) {
+		t.Errorf("expected rpwanted to be wanted by both pages, got %+v", r.Wanted)
+	}
+	want := []brokenPage{
+		{Name: "rporphan", Links: []string{"rpwanted"}, Images: []string{"uploads/rp-gone.png", "rpimage.png"}},
+		{Name: "rptarget", Links: []string{"rpwanted", "uploads/rp-gone.txt"}},
+	}
+	var got []brokenPage
+	for _, b := range r.Broken {
+		if strings.HasPrefix(b.Name, "rp") {
+			got = append(got, b)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected broken pages %+v, got %+v", want, got)
+	}
+
+	// Images are saved along with the cache
+	saved := e.readCache()
+	if !reflect.DeepEqual(saved.Images["rporphan"], []string{"uploads/rp-up.png", "uploads/rp-gone.png", "rpimage.png"}) {
+		t.Errorf("expected images to survive the cache being saved, got %q", saved.Images)
+	}
+
+	// Creating the wanted page takes it off the reports
+	page := &wiki{
+		Title:       "rpwanted",
+		Filename:    "rpwanted",
+		Frontmatter: frontmatter{Title: "rpwanted", Permission: publicPermission},
+		Content:     []byte("Here now\n"),
+	}
+	checkT(page.save(e), t)
+	e.refreshCache()
+	theCache = e.loadCache()
+	r = theCache.reports(func(string) bool { return false })
+	if slices.ContainsFunc(r.Wanted, func(w wantedPage) bool { return w.Name == "rpwanted" }) || slices.Contains(r.Orphans, "rpwanted") {
+		t.Errorf("expected rpwanted to no longer be reported, got %+v", r)
+	}
+
+	// Only admins can see the reports
+	for _, c := range []struct {
+		user string
+		code int
+	}{
+		{"reportsuser", http.StatusSeeOther},
+		{"admin", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.authState.Login(c.user, r)
+		})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		req := httptest.NewRequest("GET", "/admin/reports", nil)
+		req.Header["Cookie"] = rec.Result().Header["Set-Cookie"]
+		w := httptest.NewRecorder()
+		router(e).ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("expected %d for %q, got %d", c.code, c.user, w.Code)
+		}
+		if c.code == http.StatusOK && !strings.Contains(w.Body.String(), "<code>/uploads/rp-gone.txt</code>") {
+			t.Errorf("expected the reports to list broken links, got %q", w.Body.String())
+		}
+	}
+}
+
+// TestRenderCacheView checks pages are only rendered again once their content changes
+func TestRenderCacheView(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+	e.renders = newRenderCache(0, 0)
+
+	page := &wiki{
+		Title:    "rendered",
+		Filename: "rendered",
+		Frontmatter: frontmatter{
+			Title:      "rendered",
+			Permission: publicPermission,
+		},
+		Content: []byte("# First\n"),
+	}
+	checkT(page.save(e), t)
+
+	view := func() string {
+		r := httptest.NewRequest("GET", "/rendered", nil)
+		w := httptest.NewRecorder()
+		router(e).ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	hits := testutil.ToFloat64(renderCacheHits)
+	misses := testutil.ToFloat64(renderCacheMisses)
+	view()
+	if !strings.Contains(view(), "First") {
+		t.Error("expected the cached page to be shown")
+	}
+	if testutil.ToFloat64(renderCacheMisses)-misses != 1 || testutil.ToFloat64(renderCacheHits)-hits != 1 {
+		t.Error("expected the page to be rendered once, then served from the cache")
+	}
+
+	page.Content = []byte("# Second\n")
+	checkT(page.save(e), t)
+	if !strings.Contains(view(), "Second") {
+		t.Error("expected the changed page to be rendered again")
+	}
+	if e.renders.len() != 2 {
+		t.Errorf("expected both versions to be cached, got %d", e.renders.len())
+	}
+}
+
+// TestConditionalView checks pages and files are only sent again once they change, and private ones are never cached by proxies
+func TestConditionalView(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewAdmin("admin", "admin")
+	e.authState.NewUser("conditionaluser", "conditionaluser")
+
+	page := &wiki{
+		Title:    "conditional",
+		Filename: "conditional",
+		Frontmatter: frontmatter{
+			Title:      "conditional",
+			Permission: publicPermission,
+		},
+		Content: []byte("first\n"),
+	}
+	checkT(page.save(e), t)
+
+	get := func(name string, header http.Header, cookies []string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/"+name, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		if cookies != nil {
+			r.Header["Cookie"] = cookies
+		}
+		w := httptest.NewRecorder()
+		router(e).ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("conditional", nil, nil)
+	etag := w.Header().Get("Etag")
+	lastModified := w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("expected a page with validators, got %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Cache-Control") != "public, no-cache" {
+		t.Errorf("expected public page to be cacheable, got %q", w.Header().Get("Cache-Control"))
+	}
+
+	w = get("conditional", http.Header{"If-None-Match": {etag}}, nil)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected 304 for a matching ETag, got %d", w.Code)
+	}
+	w = get("conditional", http.Header{"If-None-Match": {etag}, "If-Modified-Since": {lastModified}}, nil)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for an unchanged page, got %d", w.Code)
+	}
+
+	// A new page linking here changes the backlinks shown, but not this page's mtime
+	linking := &wiki{
+		Title:    "conditional-from",
+		Filename: "conditional-from",
+		Frontmatter: frontmatter{
+			Title:      "conditional-from",
+			Permission: publicPermission,
+		},
+		Content: []byte("[[conditional]]\n"),
+	}
+	checkT(linking.save(e), t)
+	e.refreshCache()
+	w = get("conditional", http.Header{"If-Modified-Since": {lastModified}}, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "conditional-from") {
+		t.Errorf("expected If-Modified-Since alone not to serve a stale page, got %d", w.Code)
+	}
+	w = get("conditional", http.Header{"If-None-Match": {etag}}, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Etag") == etag {
+		t.Errorf("expected a new ETag along with the new backlink, got %d", w.Code)
+	}
+	etag = w.Header().Get("Etag")
+
+	// Logging in changes the page, so the ETag has to change too
+	rec := httptest.NewRecorder()
+	login := httptest.NewRequest("GET", "/", nil)
+	e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.Login("conditionaluser", r)
+	})).ServeHTTP(rec, login)
+	cookies := rec.Result().Header["Set-Cookie"]
+	w = get("conditional", http.Header{"If-None-Match": {etag}}, cookies)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("expected a fresh private copy for a logged in user, got %d %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	// Nor is it ever answered with 304, as it shows who is logged in, which the ETag does not cover
+	if w.Header().Get("Etag") != "" {
+		t.Errorf("expected no ETag for a logged in user, got %q", w.Header().Get("Etag"))
+	}
+	w = get("conditional", http.Header{"If-None-Match": {"*"}}, cookies)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected a logged in user's copy to always be sent, got %d", w.Code)
+	}
+
+	// A flash is only shown once, so it must not be lost to the browser's copy
+	rec = httptest.NewRecorder()
+	e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.authState.SetFlash("Unable to view that.", r)
+	})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	w = get("conditional", http.Header{"If-None-Match": {etag}}, rec.Result().Header["Set-Cookie"])
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Unable to view that.") {
+		t.Errorf("expected the flash to be shown rather than a 304, got %d", w.Code)
+	}
+
+	page.Content = []byte("second\n")
+	checkT(page.save(e), t)
+	w = get("conditional", http.Header{"If-None-Match": {etag}}, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Etag") == etag || !strings.Contains(w.Body.String(), "second") {
+		t.Errorf("expected the changed page to be sent, got %d", w.Code)
+	}
+
+	page.Frontmatter.Permission = privatePermission
+	checkT(page.save(e), t)
+	w = get("conditional", nil, cookies)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("expected private page to only be cached by the browser, got %d %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+
+	// Files which are not wiki pages are served with the same validators
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	checkT(e.store.WriteFile("conditional.png", png), t)
+	checkT(e.store.Add("conditional.png"), t)
+	checkT(e.store.Commit("", "Adding conditional.png"), t)
+	w = get("conditional.png", nil, cookies)
+	etag = w.Header().Get("Etag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Last-Modified") == "" || w.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Fatalf("expected a file with validators, got %d %v", w.Code, w.Header())
+	}
+	w = get("conditional.png", http.Header{"If-None-Match": {etag}}, cookies)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for an unchanged file, got %d", w.Code)
+	}
+}
+
+func TestEtagMatch(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		match  bool
+	}{
+		{`"a"`, true},
+		{`W/"a"`, true},
+		{`"b", "a"`, true},
+		{`*`, true},
+		{`"b"`, false},
+		{`a`, false},
+	} {
+		if etagMatch(c.header, `"a"`) != c.match {
+			t.Errorf("etagMatch(%q) should be %v", c.header, c.match)
+		}
+	}
+}
+
+// TestWatcher checks files changed outside the wiki are committed and picked up by the cache
+func TestWatcher(t *testing.T) {
+	if testStorage == "memory" {
+		t.Skip("in-memory wikis cannot be changed from outside")
+	}
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+	e.cfg.WatchCommit = true
+	e.cfg.WatchCommitMessage = "Edited on the server"
+
+	w, err := e.watchWiki()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// The watcher works in the background, so give it a few seconds
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 50; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+	commits := func(name string) []commitLog {
+		history, _ := e.store.FileLog(name)
+		return history
+	}
+	cached := func(name string) bool {
+		e.cacheLock.Lock()
+		defer e.cacheLock.Unlock()
+		for _, v := range e.cache.Cache {
+			if v.Filename == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Saving through the wiki should not lead to another commit
+	page := &wiki{
+		Title:    "watched",
+		Filename: "watched",
+		Frontmatter: frontmatter{
+			Title:      "watched",
+			Permission: publicPermission,
+		},
+		Content: []byte("saved through the wiki\n"),
+	}
+	checkT(page.save(e), t)
+
+	external := []byte("---\ntitle: watched elsewhere\npermission: public\n---\nedited on the server\n")
+	checkT(os.MkdirAll(filepath.Join(e.cfg.WikiDir, "watchdir"), 0755), t)
+	checkT(os.WriteFile(filepath.Join(e.cfg.WikiDir, "watchdir", "external"), external, 0644), t)
+	checkT(os.WriteFile(filepath.Join(e.cfg.WikiDir, ".watched.swp"), []byte("swap"), 0644), t)
+
+	if !waitFor(func() bool { return cached("watchdir/external") }) {
+		t.Fatal("expected the external file to be committed and cached")
+	}
+	if history := commits("watchdir/external"); len(history) != 1 || history[0].Message != "Edited on the server" {
+		t.Errorf("expected the external file to be committed with the configured message, got %+v", history)
+	}
+	if history := commits("watched"); len(history) != 1 {
+		t.Errorf("expected pages saved through the wiki to be left alone, got %d commits", len(history))
+	}
+	untracked, err := e.store.Untracked()
+	checkT(err, t)
+	found := false
+	for _, name := range untracked {
+		found = found || name == ".watched.swp"
+	}
+	if !found {
+		t.Error("expected hidden files to be left uncommitted")
+	}
+	checkT(os.Remove(filepath.Join(e.cfg.WikiDir, ".watched.swp")), t)
+
+	// Deleting a file outside the wiki deletes it from the repo too
+	checkT(os.Remove(filepath.Join(e.cfg.WikiDir, "watchdir", "external")), t)
+	if !waitFor(func() bool { return !cached("watchdir/external") }) {
+		t.Error("expected the deletion to be committed and picked up by the cache")
+	}
+	if history := commits("watchdir/external"); len(history) != 2 {
+		t.Errorf("expected the deletion to be committed, got %+v", history)
+	}
+}
+
+// TestSanitize checks scripts are stripped from rendered pages, while everything the renderer adds itself is kept
+func TestSanitize(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	goldmark, err := newRenderer(config{Renderer: "goldmark"})
+	checkT(err, t)
+	for _, engine := range []*render.Renderer{nil, goldmark} {
+		e.goldmark = engine
+		for _, payload := range []string{
+			"<script>alert(1)</script>",
+			"<img src=x onerror=alert(1)>",
+			"[click](javascript:alert(1))",
+			"<a href=\"javascript:alert(1)\">click</a>",
+			"<svg onload=alert(1)><path d=\"M0\" onclick=\"alert(1)\"></path></svg>",
+			"<iframe src=\"https://example.com/\"></iframe>",
+			"<div style=\"background:url(javascript:alert(1))\">styled</div>",
+			"<form action=\"/delete/index\"><button>go</button></form>",
+			"<object data=\"x.swf\"></object>",
+		} {
+			html := e.renderMarkdown([]byte("before\n\n"+payload+"\n\nafter\n"), false, "anonymous")
+			for _, bad := range []string{"<script", "onerror", "onload", "onclick", "javascript:", "<iframe", "style=", "<form", "<object"} {
+				if strings.Contains(strings.ToLower(html), bad) {
+					t.Errorf("expected %q to be stripped from %q, got %q", bad, payload, html)
+				}
+			}
+			if !strings.Contains(html, "after") {
+				t.Errorf("expected the rest of the page to be kept, got %q", html)
+			}
+		}
+	}
+	e.goldmark = nil
+
+	md := "# Heading\n\n- [ ] todo\n- [x] done\n\nText[^1]\n\n```go\nfmt.Println()\n```\n\n[^1]: A footnote\n"
+	html := e.renderMarkdown([]byte(md), false, "anonymous")
+	for _, kept := range []string{
+		"<nav>",
+		`href="#heading"`,
+		`<h1 id="heading">`,
+		`<div class="svg-icon">`,
+		"<svg",
+		"<path d=",
+		`<sup class="footnote-ref" id="fnref:1">`,
+		`<div class="footnotes">`,
+		`<li id="fn:1">`,
+		`class="footnote-return"`,
+		`class="language-go"`,
+	} {
+		if !strings.Contains(html, kept) {
+			t.Errorf("expected %q to be kept, got %q", kept, html)
+		}
+	}
+
+	// goldmark marks footnotes up a little differently
+	e.goldmark = goldmark
+	html = e.renderMarkdown([]byte(md), false, "anonymous")
+	for _, kept := range []string{
+		"<nav>",
+		`<h1 id="heading">`,
+		`<div class="svg-icon">`,
+		`<a href="#fn:1" class="footnote-ref"`,
+		`<div class="footnotes">`,
+		`class="footnote-backref"`,
+		`class="language-go"`,
+	} {
+		if !strings.Contains(html, kept) {
+			t.Errorf("expected %q to be kept by goldmark, got %q", kept, html)
+		}
+	}
+	e.goldmark = nil
+
+	// Pages opting out are left alone
+	if html := e.renderMarkdown([]byte("<script>ok()</script>\n"), true, "anonymous"); !strings.Contains(html, "<script>") {
+		t.Errorf("expected rawhtml pages to keep their scripts, got %q", html)
+	}
+
+	e.cfg.Sanitize = "nope"
+	if _, err := newSanitizer(e.cfg); err == nil {
+		t.Error("expected an unknown policy to be an error")
+	}
+}
+
+// TestSanitizeOptOut checks only admins can turn off sanitizing for a page, and anyone else saving it turns it back on
+func TestSanitizeOptOut(t *testing.T) {
+	tmpdb, e := testEnvInit()
+	defer os.Remove(tmpdb)
+
+	e.authState.NewAdmin("admin", "admin")
+	e.authState.NewUser("sanitizeuser", "sanitizeuser")
+
+	// Only the save handler itself is under test, so CSRF checks are left out
+	saveRouter := chi.NewRouter()
+	saveRouter.Use(e.authState.LoadAndSave)
+	saveRouter.Post("/save/*", e.saveHandler)
+
+	save := func(username, content string, rawHTML bool) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		e.authState.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e.authState.Login(username, r)
+		})).ServeHTTP(w, r)
+
+		form := url.Values{
+			"title":      {"rawpage"},
+			"permission": {publicPermission},
+			"editor":     {content},
+		}
+		if rawHTML {
+			form.Set("rawhtml", "on")
+		}
+		r = httptest.NewRequest("POST", "/save/rawpage", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header["Cookie"] = w.Result().Header["Set-Cookie"]
+		w = httptest.NewRecorder()
+		saveRouter.ServeHTTP(w, r)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("expected the page to be saved, got %d", w.Code)
+		}
+	}
+	rawHTML := func() bool {
+		fm, _ := e.readPage("rawpage")
+		return fm.RawHTML
+	}
+	view := func() string {
+		w := httptest.NewRecorder()
+		router(e).ServeHTTP(w, httptest.NewRequest("GET", "/rawpage", nil))
+		return w.Body.String()
+	}
+
+	save("sanitizeuser", "<script>trusted()</script>\n", true)
+	if rawHTML() || strings.Contains(view(), "<script>trusted()") {
+		t.Error("expected users other than admins to be unable to turn off sanitizing")
+	}
+
+	save("admin", "<script>trusted()</script>\n", true)
+	if !rawHTML() || !strings.Contains(view(), "<script>trusted()") {
+		t.Error("expected admins to be able to turn off sanitizing")
+	}
+	optedOut, err := e.store.LastCommit("rawpage")
+	checkT(err, t)
+
+	save("sanitizeuser", "<script>trusted()</script>\nedited\n", false)
+	if rawHTML() || strings.Contains(view(), "<script>trusted()") {
+		t.Error("expected sanitizing to be turned back on once someone else saves the page")
+	}
+
+	// Reverting to the admin's version brings it back only for admins
+	checkT(e.restoreWiki("rawpage", optedOut, "", "Revert rawpage", false), t)
+	if rawHTML() {
+		t.Error("expected a revert by a user to keep the page sanitized")
+	}
+	checkT(e.restoreWiki("rawpage", optedOut, "", "Revert rawpage", true), t)
+	if !rawHTML() {
+		t.Error("expected a revert by an admin to bring back the opt out")
+	}
+}
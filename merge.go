@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	conflictStart = "<<<<<<< current version"
+	conflictSep   = "======="
+	conflictEnd   = ">>>>>>> your changes"
+)
+
+// hunk replaces base[BaseStart:BaseEnd] with Lines
+type hunk struct {
+	BaseStart int
+	BaseEnd   int
+	Lines     []string
+}
+
+// diffHunks lists the changes needed to turn base into other, in base order
+func diffHunks(base, other string) []hunk {
+	dmp := diffmatchpatch.New()
+	dmp.DiffTimeout = 0
+	br, or, lineArray := dmp.DiffLinesToRunes(base, other)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMainRunes(br, or, false), lineArray)
+
+	var hunks []hunk
+	var current *hunk
+	pos := 0
+	for _, d := range diffs {
+		lines := splitLines(d.Text)
+		if d.Type == diffmatchpatch.DiffEqual {
+			if current != nil {
+				hunks = append(hunks, *current)
+				current = nil
+			}
+			pos += len(lines)
+			continue
+		}
+		if current == nil {
+			current = &hunk{BaseStart: pos, BaseEnd: pos}
+		}
+		if d.Type == diffmatchpatch.DiffDelete {
+			pos += len(lines)
+			current.BaseEnd = pos
+		} else {
+			current.Lines = append(current.Lines, lines...)
+		}
+	}
+	if current != nil {
+		hunks = append(hunks, *current)
+	}
+	return hunks
+}
+
+// applyHunks returns base[start:end] with the given hunks, which must lie within that range, applied
+func applyHunks(base []string, start, end int, hunks []hunk) []string {
+	var out []string
+	pos := start
+	for _, h := range hunks {
+		out = append(out, base[pos:h.BaseStart]...)
+		out = append(out, h.Lines...)
+		pos = h.BaseEnd
+	}
+	return append(out, base[pos:end]...)
+}
+
+// merge3 performs a line-based three-way merge of two texts derived from base
+// Changes from both sides are combined where they do not touch; where they do,
+// both versions are kept between conflict markers and ok is false
+func merge3(base, current, mine string) (merged string, ok bool) {
+	baseLines := splitLines(base)
+	currentHunks := diffHunks(base, current)
+	mineHunks := diffHunks(base, mine)
+
+	var out []string
+	ok = true
+	pos := 0
+	i, j := 0, 0
+	for i < len(currentHunks) || j < len(mineHunks) {
+		// Start a region at the earliest remaining hunk,
+		//  then grow it while hunks from either side overlap or touch it
+		var regionC, regionM []hunk
+		var start, end int
+		if j >= len(mineHunks) || (i < len(currentHunks) && currentHunks[i].BaseStart <= mineHunks[j].BaseStart) {
+			start, end = currentHunks[i].BaseStart, currentHunks[i].BaseEnd
+			regionC = append(regionC, currentHunks[i])
+			i++
+		} else {
+			start, end = mineHunks[j].BaseStart, mineHunks[j].BaseEnd
+			regionM = append(regionM, mineHunks[j])
+			j++
+		}
+		for {
+			if i < len(currentHunks) && currentHunks[i].BaseStart <= end {
+				if currentHunks[i].BaseEnd > end {
+					end = currentHunks[i].BaseEnd
+				}
+				regionC = append(regionC, currentHunks[i])
+				i++
+				continue
+			}
+			if j < len(mineHunks) && mineHunks[j].BaseStart <= end {
+				if mineHunks[j].BaseEnd > end {
+					end = mineHunks[j].BaseEnd
+				}
+				regionM = append(regionM, mineHunks[j])
+				j++
+				continue
+			}
+			break
+		}
+
+		out = append(out, baseLines[pos:start]...)
+		currentVersion := applyHunks(baseLines, start, end, regionC)
+		mineVersion := applyHunks(baseLines, start, end, regionM)
+		switch {
+		case len(regionM) == 0:
+			out = append(out, currentVersion...)
+		case len(regionC) == 0:
+			out = append(out, mineVersion...)
+		case reflect.DeepEqual(currentVersion, mineVersion):
+			out = append(out, currentVersion...)
+		default:
+			ok = false
+			out = append(out, conflictStart+"\n")
+			out = append(out, terminateLines(currentVersion)...)
+			out = append(out, conflictSep+"\n")
+			out = append(out, terminateLines(mineVersion)...)
+			out = append(out, conflictEnd+"\n")
+		}
+		pos = end
+	}
+	out = append(out, baseLines[pos:]...)
+
+	return strings.Join(out, ""), ok
+}
+
+// terminateLines makes sure the last line ends in a newline, so conflict markers start on their own line
+func terminateLines(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+	terminated := append([]string{}, lines...)
+	terminated[len(terminated)-1] += "\n"
+	return terminated
+}
+
+// mergeFrontmatter merges frontmatter field by field
+// Fields left untouched by the editor take the current value; otherwise the editor's value wins
+// RawHTML is never merged: it is whatever the editor was allowed to set, so an admin turning it
+// on does not carry over to edits made by someone else at the same time
+func mergeFrontmatter(base, current, mine frontmatter) frontmatter {
+	merged := mine
+	baseV := reflect.ValueOf(base)
+	currentV := reflect.ValueOf(current)
+	mineV := reflect.ValueOf(mine)
+	mergedV := reflect.ValueOf(&merged).Elem()
+	for i := 0; i < baseV.NumField(); i++ {
+		if reflect.DeepEqual(mineV.Field(i).Interface(), baseV.Field(i).Interface()) {
+			mergedV.Field(i).Set(currentV.Field(i))
+		}
+	}
+	merged.RawHTML = mine.RawHTML
+	return merged
+}
+
+// mergeWiki merges a page being saved with changes committed since wiki.BaseCommit
+// Pages created by someone else while being created are merged from an empty page
+// On success the wiki holds the merged page; if changes overlap, it holds the
+// text with conflict markers, and errEditConflict is returned
+func (env *wikiEnv) mergeWiki(wiki *wiki, filename string) error {
+	var baseBytes []byte
+	if !wiki.NewPage {
+		var err error
+		baseBytes, err = env.store.FileAt(filename, wiki.BaseCommit)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"page":       filename,
+				"basecommit": wiki.BaseCommit,
+				"error":      err,
+			}).Errorln("error retrieving base revision for merge")
+			return errEditConflict
+		}
+	}
+	// If the page has been deleted since, there is nothing to merge with
+	currentBytes, err := env.store.FileAt(filename, "HEAD")
+	if err != nil {
+		return errEditConflict
+	}
+
+	baseFm, baseContent := readWikiPage(bytes.NewReader(baseBytes))
+	currentFm, currentContent := readWikiPage(bytes.NewReader(currentBytes))
+
+	// Pages read back from git have LF line endings, and always end with a newline
+	mine := strings.Replace(string(wiki.Content), "\r\n", "\n", -1)
+	if mine != "" && !strings.HasSuffix(mine, "\n") {
+		mine = mine + "\n"
+	}
+
+	merged, ok := merge3(string(baseContent), string(currentContent), mine)
+	wiki.Frontmatter = mergeFrontmatter(baseFm, currentFm, wiki.Frontmatter)
+	wiki.Content = []byte(merged)
+	if !ok {
+		return errEditConflict
+	}
+	return nil
+}
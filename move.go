@@ -0,0 +1,158 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.sr.ht/~aqtrans/gohttputils"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkMoveTarget cleans up and validates the name a page is being moved to
+// It must stay inside the wikidir, must not be under an existing file, and must not already exist
+func (env *wikiEnv) checkMoveTarget(newname *string) error {
+	*newname = strings.Trim(*newname, " /")
+	if *newname == "" {
+		return errBadPath
+	}
+	// Nothing can be moved into the repo itself, while names merely containing .git are fine
+	for _, part := range strings.Split(path.Clean(*newname), "/") {
+		if strings.EqualFold(part, ".git") {
+			return errBadPath
+		}
+	}
+
+	exists, err := env.checkName(newname)
+	if err == errIsDir {
+		return errPageExists
+	}
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errPageExists
+	}
+	return nil
+}
+
+// linkPatterns matches links to the given page, both [name]() inter-wiki links and regular [text](name) links
+// The groups hold everything before and after the page name, including any #anchor
+func linkPatterns(name string) []*regexp.Regexp {
+	quoted := regexp.QuoteMeta(name)
+	return []*regexp.Regexp{
+		regexp.MustCompile(`(\[/?)` + quoted + `(\]\(\))`),
+		regexp.MustCompile(`(\]\(/?)` + quoted + `((?:#[^)\s]*)?\))`),
+	}
+}
+
+// rewriteLinks points all links to oldname in content at newname instead
+func rewriteLinks(content []byte, oldname, newname string) []byte {
+	names := []string{oldname}
+	// Pages found with an implied extension are usually linked to without it
+	if ext := filepath.Ext(oldname); ext == ".md" || ext == ".page" {
+		names = append(names, strings.TrimSuffix(oldname, ext))
+	}
+	replacement := []byte("${1}" + strings.Replace(newname, "$", "$$", -1) + "${2}")
+	for _, name := range names {
+		for _, pattern := range linkPatterns(name) {
+			content = pattern.ReplaceAll(content, replacement)
+		}
+	}
+	return content
+}
+
+// moveWiki renames a page with `git mv`, so its history can still be followed
+// If updateLinks is set, links to the page from other pages are rewritten to the new name
+// If leaveRedirect is set, a stub is left behind at the old name, redirecting to the new one
+// Everything is committed at once, with the given author
+// If anything fails after the page is moved, every file touched is put back, so nothing half done goes out with the next commit
+func (env *wikiEnv) moveWiki(oldname, newname, author string, updateLinks, leaveRedirect bool) (err error) {
+	env.pageWriteLock.Lock()
+	defer env.pageWriteLock.Unlock()
+	defer httputils.TimeTrack(time.Now(), "moveWiki")
+
+	err = env.store.Move(oldname, newname)
+	if err != nil {
+		return err
+	}
+	touched := []string{oldname, newname}
+	defer func() {
+		if err == nil {
+			return
+		}
+		restoreErr := env.store.Restore(touched...)
+		if restoreErr != nil {
+			log.WithFields(log.Fields{
+				"page":    oldname,
+				"newname": newname,
+				"error":   restoreErr,
+			}).Errorln("error undoing failed move")
+		}
+	}()
+
+	if updateLinks {
+		fileList, err := env.store.LsTree()
+		if err != nil {
+			return err
+		}
+		for _, file := range fileList {
+			if file.Type != "blob" {
+				continue
+			}
+			// The moved page has not been committed under its new name yet
+			filename := file.Filename
+			if filename == oldname {
+				filename = newname
+			}
+			if !env.isWiki(filename) {
+				continue
+			}
+			content, err := env.store.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			rewritten := rewriteLinks(content, oldname, newname)
+			if string(rewritten) == string(content) {
+				continue
+			}
+			touched = append(touched, filename)
+			err = env.store.WriteFile(filename, rewritten)
+			if err != nil {
+				return err
+			}
+			err = env.store.Add(filename)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if leaveRedirect {
+		fm, _ := env.readPage(newname)
+		stub := &wiki{
+			Frontmatter: frontmatter{
+				Title:      fm.Title,
+				Permission: fm.Permission,
+				Redirect:   newname,
+			},
+			Content: []byte("This page has been moved to [" + newname + "](/" + newname + ").\n"),
+		}
+		stubBytes, err := stub.encode()
+		if err != nil {
+			return err
+		}
+		err = env.store.WriteFile(oldname, stubBytes)
+		if err != nil {
+			return err
+		}
+		err = env.store.Add(oldname)
+		if err != nil {
+			return err
+		}
+	}
+
+	return env.store.Commit(author, oldname+" has been moved to "+newname+".")
+}
@@ -0,0 +1,349 @@
+// Package render turns wiki pages written in Markdown into HTML, with goldmark
+//
+// Pages are read as CommonMark, along with everything the wiki has always had with blackfriday:
+// task lists, [Page]() links between pages, a table of contents, footnotes, definition lists and heading IDs
+// GitHub Flavored Markdown tables, autolinks and strikethrough come with it, as do [[Page Name]] links
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Options changes how pages are rendered
+type Options struct {
+	// TaskIcon returns the HTML shown in place of a task list checkbox
+	// If nil, plain disabled checkboxes are shown
+	TaskIcon func(checked bool) []byte
+}
+
+// Resolver returns the page a [[Page Name]] link points at, and whether it exists yet
+// Links to missing pages are given the new-page class
+type Resolver func(name string) (target string, exists bool)
+
+// resolverKey holds the Resolver for the page being rendered, as which pages exist depends on who is looking
+var resolverKey = parser.NewContextKey()
+
+// Renderer renders pages; it is safe to use from several goroutines at once
+type Renderer struct {
+	md goldmark.Markdown
+}
+
+// New returns a Renderer with the given options
+func New(opts Options) *Renderer {
+	var rendererOptions []renderer.Option
+	// Raw HTML is kept, as it always has been; pages are sanitized afterwards
+	rendererOptions = append(rendererOptions, gmhtml.WithUnsafe())
+	if opts.TaskIcon != nil {
+		rendererOptions = append(rendererOptions, renderer.WithNodeRenderers(
+			util.Prioritized(&taskIconRenderer{icon: opts.TaskIcon}, 100),
+		))
+	}
+
+	return &Renderer{
+		md: goldmark.New(
+			goldmark.WithExtensions(
+				// GFM, with cells aligned as blackfriday did, since style attributes are sanitized away
+				extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+				extension.Strikethrough,
+				extension.Linkify,
+				extension.TaskList,
+				extension.Footnote,
+				extension.DefinitionList,
+			),
+			goldmark.WithParserOptions(
+				parser.WithAutoHeadingID(),
+				parser.WithASTTransformers(util.Prioritized(links{}, 100)),
+				// Ahead of the link parser, which would otherwise take [[ as the start of a link
+				parser.WithInlineParsers(util.Prioritized(&wikiLinkParser{}, 199)),
+			),
+			goldmark.WithRendererOptions(rendererOptions...),
+		),
+	}
+}
+
+// Render renders a page, starting with its table of contents
+// [[Page Name]] links are pointed at pages with resolve; if nil, links go to the page as written
+func (r *Renderer) Render(src []byte, resolve Resolver) ([]byte, error) {
+	ctx := parser.NewContext(parser.WithIDs(&anchorIDs{used: make(map[string]int)}))
+	ctx.Set(resolverKey, resolve)
+	doc := r.md.Parser().Parse(text.NewReader(src), parser.WithContext(ctx))
+
+	var buf bytes.Buffer
+	writeTOC(&buf, doc, src)
+	err := r.md.Renderer().Render(&buf, src, doc)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// linkParser finds links in pages without rendering them
+var linkParser = New(Options{}).md.Parser()
+
+// Links returns where every link and image in a page points, in order
+// [Page]() and [[Page Name]] links point at the page as written, starting with a slash
+func Links(src []byte) (links, images []string) {
+	doc := linkParser.Parse(text.NewReader(src))
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			links = append(links, string(n.Destination))
+		case *ast.AutoLink:
+			links = append(links, string(n.URL(src)))
+		case *ast.Image:
+			images = append(images, string(n.Destination))
+		}
+		return ast.WalkContinue, nil
+	})
+	return links, images
+}
+
+// wikiNamePattern matches the text of [Page]() and [/Page]() links to other pages
+var wikiNamePattern = regexp.MustCompile(`^/?([0-9a-zA-Z-_./]+)$`)
+
+// links points links with nothing but a page name, [Page]() or [/Page](), at that page
+// Links leaving the wiki are marked rel="nofollow", as they were by blackfriday
+type links struct{}
+
+func (links) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	src := reader.Source()
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			wikiLink(n, src)
+			if !isRelativeLink(n.Destination) {
+				n.SetAttributeString("rel", []byte("nofollow"))
+			}
+		case *ast.AutoLink:
+			if !isRelativeLink(n.URL(src)) {
+				n.SetAttributeString("rel", []byte("nofollow"))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// wikiLink points a link at the page it names, if it is a [Page]() link
+func wikiLink(link *ast.Link, src []byte) {
+	if len(link.Destination) != 0 || link.ChildCount() != 1 {
+		return
+	}
+	t, ok := link.FirstChild().(*ast.Text)
+	if !ok {
+		return
+	}
+	m := wikiNamePattern.FindSubmatch(t.Segment.Value(src))
+	if m == nil {
+		return
+	}
+	link.Destination = []byte(path.Join("/", string(m[1])))
+	link.ReplaceChild(link, t, ast.NewString(m[1]))
+}
+
+// isRelativeLink reports whether a link stays within the wiki, as blackfriday's isRelativeLink
+func isRelativeLink(link []byte) bool {
+	switch {
+	case len(link) == 0:
+		return true
+	case link[0] == '#':
+		return true
+	case link[0] == '/' && (len(link) == 1 || link[1] != '/'):
+		return true
+	}
+	return bytes.HasPrefix(link, []byte("./")) || bytes.HasPrefix(link, []byte("../"))
+}
+
+// wikiLinkPattern matches [[Page Name]] and [[path/page|label]] links
+var wikiLinkPattern = regexp.MustCompile(`^\[\[([^\[\]|]+)(?:\|([^\[\]]+))?\]\]`)
+
+// wikiLinkParser turns [[Page Name]] and [[path/page|label]] into links to those pages
+type wikiLinkParser struct{}
+
+func (p *wikiLinkParser) Trigger() []byte {
+	return []byte{'['}
+}
+
+func (p *wikiLinkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	m := wikiLinkPattern.FindSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	block.Advance(len(m[0]))
+
+	name := strings.TrimSpace(string(m[1]))
+	label := name
+	if len(m[2]) != 0 {
+		label = string(m[2])
+	}
+	target, exists := strings.TrimPrefix(name, "/"), true
+	if resolve, _ := pc.Get(resolverKey).(Resolver); resolve != nil {
+		target, exists = resolve(name)
+	}
+
+	link := ast.NewLink()
+	link.Destination = []byte("/" + target)
+	link.AppendChild(link, ast.NewString([]byte(label)))
+	if !exists {
+		link.SetAttributeString("class", []byte("new-page"))
+	}
+	return link
+}
+
+// taskIconRenderer shows task list checkboxes as icons
+type taskIconRenderer struct {
+	icon func(checked bool) []byte
+}
+
+func (r *taskIconRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(extast.KindTaskCheckBox, r.render)
+}
+
+func (r *taskIconRenderer) render(w util.BufWriter, src []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		w.Write(r.icon(n.(*extast.TaskCheckBox).IsChecked))
+		w.WriteByte(' ')
+	}
+	return ast.WalkContinue, nil
+}
+
+// anchorIDs gives headings the same IDs blackfriday did, so links to them keep working
+type anchorIDs struct {
+	used  map[string]int
+	count int
+}
+
+func (ids *anchorIDs) Generate(value []byte, kind ast.NodeKind) []byte {
+	id := anchorName(string(value))
+	if id == "" {
+		id = fmt.Sprintf("toc_%d", ids.count)
+	}
+	ids.count++
+
+	// Repeated IDs are numbered, as in blackfriday's ensureUniqueHeaderID
+	for count, found := ids.used[id]; found; count, found = ids.used[id] {
+		tmp := fmt.Sprintf("%s-%d", id, count+1)
+		if _, tmpFound := ids.used[tmp]; !tmpFound {
+			ids.used[id] = count + 1
+			id = tmp
+		} else {
+			id = id + "-1"
+		}
+	}
+	ids.used[id] = 0
+	return []byte(id)
+}
+
+func (ids *anchorIDs) Put(value []byte) {
+	ids.used[string(value)] = 0
+}
+
+// anchorName lowercases letters and numbers, and joins everything else up with dashes, as blackfriday's SanitizedAnchorName
+func anchorName(s string) string {
+	var name []rune
+	dash := false
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			if dash && len(name) > 0 {
+				name = append(name, '-')
+			}
+			dash = false
+			name = append(name, unicode.ToLower(r))
+		default:
+			dash = true
+		}
+	}
+	return string(name)
+}
+
+// writeTOC writes a nested list of links to every heading in the page, as blackfriday's HTML_TOC did
+// Pages without headings still get an empty nav, just as before
+func writeTOC(buf *bytes.Buffer, doc ast.Node, src []byte) {
+	buf.WriteString("<nav>\n")
+	var levels []int
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		h, ok := n.(*ast.Heading)
+		if !entering || !ok {
+			return ast.WalkContinue, nil
+		}
+		switch {
+		case len(levels) == 0:
+			buf.WriteString("<ul>\n<li>")
+			levels = append(levels, h.Level)
+		case h.Level > levels[len(levels)-1]:
+			buf.WriteString("\n<ul>\n<li>")
+			levels = append(levels, h.Level)
+		default:
+			for len(levels) > 1 && h.Level < levels[len(levels)-1] {
+				buf.WriteString("</li>\n</ul>")
+				levels = levels[:len(levels)-1]
+			}
+			buf.WriteString("</li>\n<li>")
+		}
+		id, _ := h.AttributeString("id")
+		idBytes, _ := id.([]byte)
+		buf.WriteString(`<a href="#`)
+		buf.Write(util.EscapeHTML(idBytes))
+		buf.WriteString(`">`)
+		buf.Write(util.EscapeHTML(plainText(h, src)))
+		buf.WriteString(`</a>`)
+		return ast.WalkSkipChildren, nil
+	})
+	for range levels {
+		buf.WriteString("</li>\n</ul>")
+	}
+	if len(levels) != 0 {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("</nav>\n\n")
+}
+
+// plainText returns the text of a node, without any formatting
+func plainText(n ast.Node, src []byte) []byte {
+	var buf bytes.Buffer
+	ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch c := c.(type) {
+		case *ast.Text:
+			buf.Write(c.Segment.Value(src))
+			if c.SoftLineBreak() {
+				buf.WriteByte(' ')
+			}
+		case *ast.String:
+			buf.Write(c.Value)
+		case *ast.CodeSpan:
+			for t := c.FirstChild(); t != nil; t = t.NextSibling() {
+				if s, ok := t.(*ast.Text); ok {
+					buf.Write(s.Segment.Value(src))
+				}
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return buf.Bytes()
+}
@@ -0,0 +1,75 @@
+package render
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnchorIDs(t *testing.T) {
+	ids := &anchorIDs{used: make(map[string]int)}
+	for _, c := range []struct{ heading, id string }{
+		{"Markdown: Basics", "markdown-basics"},
+		{"Getting the Gist of Markdown's Formatting Syntax", "getting-the-gist-of-markdown-s-formatting-syntax"},
+		{"  Ünïcode 2 ", "ünïcode-2"},
+		{"Markdown: Basics", "markdown-basics-1"},
+		{"!!!", "toc_4"},
+		{"markdown basics", "markdown-basics-2"},
+	} {
+		if id := string(ids.Generate([]byte(c.heading), 0)); id != c.id {
+			t.Errorf("expected %q for %q, got %q", c.id, c.heading, id)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	r := New(Options{TaskIcon: func(checked bool) []byte {
+		if checked {
+			return []byte("<b>done</b>")
+		}
+		return []byte("<b>todo</b>")
+	}})
+	for _, c := range []struct{ md, contains string }{
+		{"[/omg/yeah]()", `<p><a href="/omg/yeah">omg/yeah</a></p>`},
+		{"[Page]()", `<a href="/Page">Page</a>`},
+		{"[Not a page!]()", `<a href="">Not a page!</a>`},
+		{"[out](https://example.com/)", `<a href="https://example.com/" rel="nofollow">out</a>`},
+		{"[in](/page) [anchor](#top) [up](../page)", `<a href="/page">in</a> <a href="#top">anchor</a> <a href="../page">up</a>`},
+		{"//example.com is [protocol relative](//example.com/)", `<a href="//example.com/" rel="nofollow">`},
+		{"https://example.com/", `<a href="https://example.com/" rel="nofollow">https://example.com/</a>`},
+		{"- [ ] one\n- [x] two", "<li><b>todo</b> one</li>\n<li><b>done</b> two</li>"},
+		{"# A & B\n## `code`", "<nav>\n<ul>\n<li><a href=\"#a-b\">A &amp; B</a>\n<ul>\n<li><a href=\"#code\">code</a></li>\n</ul></li>\n</ul>\n</nav>\n\n"},
+		{"No headings", "<nav>\n</nav>\n\n<p>No headings</p>"},
+		{"| a | b |\n|:--|--:|\n| 1 | 2 |", `<td align="left">1</td>`},
+	} {
+		html, err := r.Render([]byte(c.md), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(html), c.contains) {
+			t.Errorf("expected %q to render with %q, got %q", c.md, c.contains, html)
+		}
+	}
+}
+
+func TestRenderPlainTasks(t *testing.T) {
+	html, err := New(Options{}).Render([]byte("- [x] done"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), `<input checked="" disabled="" type="checkbox"> done`) {
+		t.Errorf("expected a checkbox without TaskIcon, got %q", html)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	src := []byte("# Title\n\n[Page]() [/dir/page]() [[Page Name]] [[dir/other|label]] [rel](sibling) [abs](/abs#top) https://example.com/\n\n`[[code]]` ![img](/uploads/a.png)\n")
+	want := []string{"/Page", "/dir/page", "/Page Name", "/dir/other", "sibling", "/abs#top", "https://example.com/"}
+	links, images := Links(src)
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("expected %q, got %q", want, links)
+	}
+	if !reflect.DeepEqual(images, []string{"/uploads/a.png"}) {
+		t.Errorf("expected the image to be found, got %q", images)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// renderVersion is part of every key in the render cache, along with the engine; see renderID
+// Bump it whenever markdownRender's output changes, so nothing rendered the old way is served
+const renderVersion = "2"
+
+// Defaults for the render cache size, when not set in the config
+const (
+	defaultRenderCacheEntries = 1000
+	defaultRenderCacheBytes   = 64 << 20
+)
+
+var (
+	renderCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wiki_render_cache_hits_total",
+		Help: "Pages served from the rendered HTML cache.",
+	})
+	renderCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wiki_render_cache_misses_total",
+		Help: "Pages rendered because they were not in the rendered HTML cache.",
+	})
+)
+
+// renderCache is an LRU cache of rendered pages, keyed by the git blob hash of their Markdown
+// A page's key changes along with its content, so entries never need to be invalidated; old ones just fall out
+type renderCache struct {
+	sync.Mutex
+	maxEntries int
+	maxBytes   int
+	size       int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type renderEntry struct {
+	key  string
+	html string
+}
+
+// newRenderCache returns a cache holding up to maxEntries pages, and up to maxBytes of HTML
+// It returns nil, disabling the cache, if either is negative
+func newRenderCache(maxEntries, maxBytes int) *renderCache {
+	if maxEntries == 0 {
+		maxEntries = defaultRenderCacheEntries
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultRenderCacheBytes
+	}
+	if maxEntries < 0 || maxBytes < 0 {
+		return nil
+	}
+	return &renderCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *renderCache) get(key string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*renderEntry).html, true
+}
+
+func (c *renderCache) add(key, html string) {
+	// Pages too big to ever fit would only push everything else out
+	if len(html) > c.maxBytes {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&renderEntry{key: key, html: html})
+	c.size += len(html)
+	for c.ll.Len() > c.maxEntries || c.size > c.maxBytes {
+		c.removeOldest()
+	}
+}
+
+func (c *renderCache) removeOldest() {
+	e := c.ll.Back()
+	if e == nil {
+		return
+	}
+	c.ll.Remove(e)
+	entry := e.Value.(*renderEntry)
+	delete(c.items, entry.key)
+	c.size -= len(entry.html)
+}
+
+// len returns the number of pages in the cache
+func (c *renderCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.ll.Len()
+}
+
+// blobHash returns the hash git gives the given content, as in `git hash-object`
+func blobHash(content []byte) string {
+	return plumbing.ComputeHash(plumbing.BlobObject, content).String()
+}
+
+// renderMarkdown renders and sanitizes a page's Markdown through the render cache, if it is enabled
+// rawHTML is part of the key, so a page opting out of sanitizing is never served from a sanitized copy, or the other way round
+// So is the viewer's permissionClass, as links to pages they cannot see are rendered as missing
+func (env *wikiEnv) renderMarkdown(content []byte, rawHTML bool, class string) string {
+	if env.renders == nil {
+		return env.sanitize(env.markdownRender(content, class), rawHTML)
+	}
+	key := env.renderID() + ":" + class + ":" + strconv.FormatBool(rawHTML) + ":" + blobHash(content)
+	if html, ok := env.renders.get(key); ok {
+		renderCacheHits.Inc()
+		return html
+	}
+	renderCacheMisses.Inc()
+	html := env.sanitize(env.markdownRender(content, class), rawHTML)
+	env.renders.add(key, html)
+	return html
+}
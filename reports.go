@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~aqtrans/gohttputils"
+)
+
+// wantedPage is a page which does not exist yet, along with the pages linking to it
+type wantedPage struct {
+	Name       string
+	LinkedFrom []string
+}
+
+// brokenPage is a page with links to missing pages or uploads, or missing images
+type brokenPage struct {
+	Name   string
+	Links  []string
+	Images []string
+}
+
+// reports lists what needs tidying up in the wiki
+type reports struct {
+	// Orphans are pages no other page links to
+	Orphans []string
+	// Wanted are pages linked to which do not exist yet, the most wanted first
+	Wanted []wantedPage
+	// Broken are pages with links or images that go nowhere
+	Broken []brokenPage
+}
+
+type reportsPage struct {
+	page
+	reports
+}
+
+// uploadExists checks a file is in the uploads directory, given its path under /uploads/
+func uploadExists(name string) bool {
+	name = strings.TrimPrefix(name, uploadsDir+"/")
+	_, err := os.Stat(filepath.Join(uploadsDir, filepath.FromSlash(name)))
+	return err == nil
+}
+
+// isUpload reports whether a path within the wiki points under /uploads/
+func isUpload(name string) bool {
+	return strings.HasPrefix(name, uploadsDir+"/")
+}
+
+// isRoute reports whether a path within the wiki is handled by something other than a wiki page
+func isRoute(name string) bool {
+	first, _, _ := strings.Cut(name, "/")
+	return routeNames[first]
+}
+
+// reports works out the reports from the links and images found while building the cache, so no pages are read
+// uploaded is used to check links and images pointing under /uploads/, as those are not kept in the wiki
+func (c wikiCache) reports(uploaded func(name string) bool) reports {
+	var r reports
+	home, _ := c.resolve("index")
+	wanted := make(map[string][]string)
+
+	for _, v := range c.Cache {
+		if !v.Wiki {
+			continue
+		}
+		if len(c.backlinks[v.Filename]) == 0 && v.Filename != home {
+			r.Orphans = append(r.Orphans, v.Filename)
+		}
+
+		var broken brokenPage
+		for _, link := range c.Links[v.Filename] {
+			if isUpload(link) {
+				if !uploaded(link) {
+					broken.Links = append(broken.Links, link)
+				}
+				continue
+			}
+			if isRoute(link) {
+				continue
+			}
+			name, exists := c.resolve(link)
+			if exists {
+				continue
+			}
+			broken.Links = append(broken.Links, link)
+			// A page linking to the same missing page in several ways only counts once
+			from := wanted[name]
+			if len(from) == 0 || from[len(from)-1] != v.Filename {
+				wanted[name] = append(from, v.Filename)
+			}
+		}
+		for _, image := range c.Images[v.Filename] {
+			if isUpload(image) {
+				if !uploaded(image) {
+					broken.Images = append(broken.Images, image)
+				}
+				continue
+			}
+			if isRoute(image) {
+				continue
+			}
+			// Images are served as they are named, so they are not resolved like links
+			if _, ok := c.names[image]; !ok {
+				broken.Images = append(broken.Images, image)
+			}
+		}
+		if broken.Links != nil || broken.Images != nil {
+			broken.Name = v.Filename
+			r.Broken = append(r.Broken, broken)
+		}
+	}
+
+	for name, from := range wanted {
+		r.Wanted = append(r.Wanted, wantedPage{Name: name, LinkedFrom: from})
+	}
+	sort.Slice(r.Wanted, func(i, j int) bool {
+		if len(r.Wanted[i].LinkedFrom) != len(r.Wanted[j].LinkedFrom) {
+			return len(r.Wanted[i].LinkedFrom) > len(r.Wanted[j].LinkedFrom)
+		}
+		return r.Wanted[i].Name < r.Wanted[j].Name
+	})
+	return r
+}
+
+// reportsHandler lists orphaned pages, wanted pages and pages with broken links, for admins to tidy up
+func (env *wikiEnv) reportsHandler(w http.ResponseWriter, r *http.Request) {
+	defer httputils.TimeTrack(time.Now(), "reportsHandler")
+
+	p := make(chan page, 1)
+	go env.loadPage(r, p)
+
+	theCache := env.loadCache()
+
+	rp := reportsPage{
+		page:    <-p,
+		reports: theCache.reports(uploadExists),
+	}
+	renderTemplate(r.Context(), env, w, "admin_reports.tmpl", rp)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.sr.ht/~aqtrans/gohttputils"
+)
+
+// validRevision matches the revisions pages can be viewed and restored from:
+// an abbreviated or full SHA1, optionally followed by ^ for the commit before it
+var validRevision = regexp.MustCompile(`^[0-9a-f]{7,40}\^?$`)
+
+// fullRevision matches a full SHA1, as handed out with the editor for edit conflict checks
+var fullRevision = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// shortRevision abbreviates a revision matched by validRevision for display
+func shortRevision(revision string) string {
+	sha := strings.TrimSuffix(revision, "^")
+	if len(sha) > 7 {
+		return sha[:7] + strings.TrimPrefix(revision, sha)
+	}
+	return revision
+}
+
+// revisionFront reads the frontmatter of a page as it was at the given revision
+func (env *wikiEnv) revisionFront(name, revision string) (frontmatter, error) {
+	if !validRevision.MatchString(revision) {
+		return frontmatter{}, errBadRevision
+	}
+	body, err := env.store.FileAt(name, revision)
+	if err != nil {
+		return frontmatter{}, err
+	}
+	return readFront(bytes.NewReader(body)), nil
+}
+
+// revisionPath finds where a page was kept at a revision from its history, which is its old name before a move
+// With a trailing ^, it is where the page was before that commit; at commits not changing the page, where the last change before left it
+// Revisions which are not in its history at all keep the page's name
+func (env *wikiEnv) revisionPath(name, revision string) string {
+	history, err := env.store.FileLog(name)
+	if err != nil {
+		return name
+	}
+	commit := strings.TrimSuffix(revision, "^")
+	for i, v := range history {
+		if !strings.HasPrefix(v.Commit, commit) {
+			continue
+		}
+		if commit != revision && i+1 < len(history) {
+			return history[i+1].Filename
+		}
+		return v.Filename
+	}
+	date, err := env.store.CommitTime(revision)
+	if err != nil {
+		return name
+	}
+	for _, v := range history {
+		if v.Date <= date {
+			return v.Filename
+		}
+	}
+	return name
+}
+
+// restoreWiki saves a page as it was at the given revision, through wiki.save()
+// Deleted pages can be restored from the commit before the one deleting them
+// Revisions from before a page was moved are read from where the page was at the time
+func (env *wikiEnv) restoreWiki(name, revision, author, message string, isAdmin bool) error {
+	defer httputils.TimeTrack(time.Now(), "restoreWiki")
+
+	if !validRevision.MatchString(revision) {
+		return errBadRevision
+	}
+
+	body, err := env.store.FileAt(env.revisionPath(name, revision), revision)
+	if err != nil {
+		return err
+	}
+
+	head := body
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if !isWikiContent(name, head) {
+		return errNotWiki
+	}
+
+	fm, content := readWikiPage(bytes.NewReader(body))
+	// As when saving, only admins can bring back a page which is not sanitized
+	fm.RawHTML = fm.RawHTML && isAdmin
+	restored := &wiki{
+		Title:       setPageTitle(fm.Title, name),
+		Filename:    name,
+		Frontmatter: fm,
+		Content:     content,
+		Author:      author,
+		Message:     message,
+	}
+	return restored.save(env)
+}
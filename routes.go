@@ -12,6 +12,19 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// uploadsDir is where uploaded files are served from, under /uploads/
+const uploadsDir = "uploads"
+
+// routeNames are the top level paths taken by the handlers below rather than wiki pages
+// Links to them are not reported as wanted pages; keep it in step with router
+var routeNames = map[string]bool{
+	"admin": true, "api": true, "assets": true, "auth": true, "blame": true, "debug": true,
+	"delete": true, "diff": true, "edit": true, "fav": true, "gitadd": true, "health": true,
+	"history": true, "list": true, "login": true, "logout": true, "md_render": true, "metrics": true,
+	"move": true, "recent": true, "revert": true, "save": true, "search": true, "signup": true,
+	"tag": true, "tags": true, "trash": true, uploadsDir: true,
+}
+
 func router(env *wikiEnv) http.Handler {
 
 	// HTTP stuff from here on out
@@ -58,13 +71,18 @@ func router(env *wikiEnv) http.Handler {
 	r.Get("/list", env.listHandler)
 	r.Get("/search/*", env.searchHandler)
 	r.Post("/search", env.searchHandler)
+	r.Get("/api/suggest", env.suggestHandler)
+	r.Get("/api/backlinks/*", env.wikiMiddle(env.backlinksHandler))
 	r.Get("/recent", env.authState.UsersOnly(env.recentHandler))
+	r.Get("/trash", env.authState.UsersOnly(env.trashHandler))
 	//r.Get("/health", healthCheckHandler)
 
 	r.Route("/admin", func(r chi.Router) {
 		r.Use(env.authState.AdminsOnlyH)
 		r.Get("/", env.adminMainHandler)
 		r.Get("/git", env.adminGitHandler)
+		r.Get("/trash", env.trashHandler)
+		r.Get("/reports", env.reportsHandler)
 		r.Post("/git/push", env.gitPushPostHandler)
 		r.Post("/git/checkin", env.gitCheckinPostHandler)
 		r.Post("/git/pull", env.gitPullPostHandler)
@@ -85,16 +103,20 @@ func router(env *wikiEnv) http.Handler {
 	r.Post("/gitadd", env.authState.UsersOnly(env.gitCheckinPostHandler))
 	r.Get("/gitadd", env.authState.UsersOnly(env.gitCheckinHandler))
 
-	r.Post("/md_render", markdownPreview)
+	r.Post("/md_render", env.markdownPreview)
 
-	r.Handle("/uploads/*", http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads"))))
+	r.Handle("/uploads/*", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadsDir))))
 
 	// Wiki page handlers
 	r.Get(`/fav/*`, env.authState.UsersOnly(env.wikiMiddle(env.setFavoriteHandler)))
 	r.Get(`/edit/*`, env.authState.UsersOnly(env.wikiMiddle(env.editHandler)))
 	r.Post(`/save/*`, env.authState.UsersOnly(env.wikiMiddle(env.saveHandler)))
 	r.Get(`/history/*`, env.authState.UsersOnly(env.wikiMiddle(env.historyHandler)))
+	r.Get(`/diff/*`, env.authState.UsersOnly(env.wikiMiddle(env.diffHandler)))
+	r.Get(`/blame/*`, env.authState.UsersOnly(env.wikiMiddle(env.blameHandler)))
 	r.Post(`/delete/*`, env.authState.UsersOnly(env.wikiMiddle(env.deleteHandler)))
+	r.Post(`/move/*`, env.authState.UsersOnly(env.wikiMiddle(env.moveHandler)))
+	r.Post(`/revert/*`, env.authState.UsersOnly(env.wikiMiddle(env.revertHandler)))
 
 	r.Handle("/debug/vars", expvar.Handler())
 	r.Get("/debug/pprof/", http.HandlerFunc(pprof.Index))
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// Classes set by the renderer on task lists, footnotes, title blocks and links to new pages, and on fenced code for highlighting
+var (
+	renderedClasses = regexp.MustCompile(`^(svg-icon|footnotes|footnote-ref|footnote-return|footnote-backref|title|new-page)$`)
+	codeClasses     = regexp.MustCompile(`^language-[\w+#.-]+$`)
+)
+
+// newSanitizer builds the policy rendered pages are cleaned up with, as set by Sanitize in the config
+//
+//	"ugc", the default, allows the HTML usually written in Markdown, along with everything the renderer adds
+//	"none" leaves pages as they are rendered; only for wikis where every editor is trusted
+//
+// SanitizeAllowElements and SanitizeAllowAttributes add to the "ugc" policy
+func newSanitizer(cfg config) (*bluemonday.Policy, error) {
+	switch cfg.Sanitize {
+	case "", "ugc":
+	case "none":
+		return nil, nil
+	default:
+		return nil, errors.New("unknown sanitize policy: " + cfg.Sanitize)
+	}
+
+	p := bluemonday.UGCPolicy()
+	// Table of contents
+	p.AllowElements("nav")
+	// Task list checkboxes, replaced with SVG icons by ListItem
+	p.AllowElements("svg", "title", "path")
+	p.AllowAttrs("version", "xmlns", "width", "height", "viewbox").OnElements("svg")
+	p.AllowAttrs("d").OnElements("path")
+	// Icons, footnotes and title blocks are styled by their class; heading and footnote IDs are already allowed
+	p.AllowAttrs("class").Matching(renderedClasses).OnElements("div", "sup", "a", "h1")
+	p.AllowAttrs("class").Matching(codeClasses).OnElements("code")
+
+	p.AllowElements(cfg.SanitizeAllowElements...)
+	if len(cfg.SanitizeAllowAttributes) != 0 {
+		p.AllowAttrs(cfg.SanitizeAllowAttributes...).Globally()
+	}
+	return p, nil
+}
+
+// sanitize cleans up a rendered page, unless the page has opted out with rawhtml
+func (env *wikiEnv) sanitize(html string, rawHTML bool) string {
+	if env.sanitizer == nil || rawHTML {
+		return html
+	}
+	return env.sanitizer.Sanitize(html)
+}
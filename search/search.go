@@ -0,0 +1,241 @@
+// Package search parses the wiki's search queries, and matches pages against them
+//
+// A query is made of words, "quoted phrases", and operators:
+//
+//	tag:oncall             pages with the given tag
+//	title:"db failover"    pages with the given text in their title
+//	path:infra/            pages under the given path
+//	permission:public      pages with the given permission
+//	modified:>2026-01-01   pages last changed after the given day; <, >=, <= and = work too
+//	created:<2026-01-01    pages first created before the given day
+//	author:alice           pages changed by the given author at some point
+//
+// Anything can be excluded by starting it with a -, as in -tag:draft
+// Words and phrases are matched against the title, filename and content of each page
+package search
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Date operators are compared day by day, in this layout
+const dateLayout = "2006-01-02"
+
+// Clause is a single word, phrase or operator in a query
+type Clause struct {
+	// Field is the operator used, or blank for plain words and phrases
+	Field string
+	// Op is how dates are compared; one of <, >, <=, >= or =
+	Op     string
+	Value  string
+	Negate bool
+}
+
+// Query is a parsed search query; a page must match every clause in it
+type Query struct {
+	Clauses []Clause
+}
+
+// Doc is a page a query is matched against
+// Content and Authors are only called if the query needs them, once everything else matches
+type Doc struct {
+	Name       string
+	Title      string
+	Tags       []string
+	Permission string
+	Created    time.Time
+	Modified   time.Time
+	Content    func() string
+	Authors    func() []string
+}
+
+var fields = map[string]bool{
+	"tag":        true,
+	"title":      true,
+	"path":       true,
+	"permission": true,
+	"modified":   true,
+	"created":    true,
+	"author":     true,
+}
+
+// Parse splits a query into its clauses
+// Unknown operators are searched for as plain words, but badly formed dates are an error
+func Parse(q string) (Query, error) {
+	var query Query
+	rs := []rune(q)
+	for i := 0; i < len(rs); {
+		if unicode.IsSpace(rs[i]) {
+			i++
+			continue
+		}
+
+		var c Clause
+		if rs[i] == '-' {
+			c.Negate = true
+			i++
+		}
+
+		// Read up to the next space that is not inside quotes
+		// A quoted phrase is always searched for as it is, even if it looks like an operator
+		phrase := i < len(rs) && rs[i] == '"'
+		var token strings.Builder
+		quoted := false
+		for ; i < len(rs) && (quoted || !unicode.IsSpace(rs[i])); i++ {
+			if rs[i] == '"' {
+				quoted = !quoted
+				continue
+			}
+			token.WriteRune(rs[i])
+		}
+
+		c.Value = token.String()
+		if field, value, ok := strings.Cut(c.Value, ":"); ok && !phrase && fields[strings.ToLower(field)] {
+			c.Field = strings.ToLower(field)
+			c.Value = value
+		}
+		if c.Value == "" {
+			continue
+		}
+
+		if c.Field == "modified" || c.Field == "created" {
+			c.Op, c.Value = splitOp(c.Value)
+			if _, err := time.Parse(dateLayout, c.Value); err != nil {
+				return Query{}, fmt.Errorf("%s: dates must look like %s", c.Field, dateLayout)
+			}
+		}
+
+		query.Clauses = append(query.Clauses, c)
+	}
+	return query, nil
+}
+
+func splitOp(value string) (string, string) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(value, op) {
+			return op, strings.TrimPrefix(value, op)
+		}
+	}
+	return "=", value
+}
+
+// Simple reports whether the query is only plain words, with no operators, phrases or exclusions
+func (q Query) Simple() bool {
+	for _, c := range q.Clauses {
+		if c.Field != "" || c.Negate || strings.IndexFunc(c.Value, unicode.IsSpace) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Words returns the words and phrases being looked for, for ranking and highlighting results
+func (q Query) Words() []string {
+	var words []string
+	for _, c := range q.Clauses {
+		if c.Field == "" && !c.Negate {
+			words = append(words, c.Value)
+		}
+	}
+	return words
+}
+
+// Match reports whether the page matches every clause in the query
+func (q Query) Match(d *Doc) bool {
+	// Everything held in memory is checked first, leaving authors and content for last
+	for _, c := range q.Clauses {
+		if c.Field != "" && c.Field != "author" && c.matchField(d) == c.Negate {
+			return false
+		}
+	}
+
+	var authors []string
+	loaded := false
+	for _, c := range q.Clauses {
+		if c.Field != "author" {
+			continue
+		}
+		if !loaded && d.Authors != nil {
+			authors = d.Authors()
+			loaded = true
+		}
+		if containsFold(authors, c.Value) == c.Negate {
+			return false
+		}
+	}
+
+	var content []string
+	for _, c := range q.Clauses {
+		if c.Field != "" {
+			continue
+		}
+		matched := containsFold([]string{d.Title, d.Name}, c.Value)
+		if !matched && d.Content != nil {
+			if content == nil {
+				content = []string{d.Content()}
+			}
+			matched = containsFold(content, c.Value)
+		}
+		if matched == c.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Clause) matchField(d *Doc) bool {
+	switch c.Field {
+	case "tag":
+		for _, tag := range d.Tags {
+			if strings.EqualFold(tag, c.Value) {
+				return true
+			}
+		}
+		return false
+	case "title":
+		return containsFold([]string{d.Title}, c.Value)
+	case "path":
+		return strings.HasPrefix(strings.ToLower(d.Name), strings.ToLower(strings.TrimPrefix(c.Value, "/")))
+	case "permission":
+		return strings.EqualFold(d.Permission, c.Value)
+	case "modified":
+		return compareDay(d.Modified, c.Op, c.Value)
+	case "created":
+		return compareDay(d.Created, c.Op, c.Value)
+	}
+	return false
+}
+
+// compareDay compares the day t falls on with the given day
+// Days in the layout sort the same way as strings, so they are compared as they are
+func compareDay(t time.Time, op, day string) bool {
+	if t.IsZero() {
+		return false
+	}
+	d := t.Format(dateLayout)
+	switch op {
+	case ">":
+		return d > day
+	case "<":
+		return d < day
+	case ">=":
+		return d >= day
+	case "<=":
+		return d <= day
+	}
+	return d == day
+}
+
+// containsFold reports whether any of the given strings contain substr, ignoring case
+func containsFold(s []string, substr string) bool {
+	substr = strings.ToLower(substr)
+	for _, v := range s {
+		if strings.Contains(strings.ToLower(v), substr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	q, err := Parse(`failover tag:oncall title:"db failover" -path:infra/old "split brain" modified:>2026-01-01 -draft foo:bar "tag:x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Clause{
+		{Value: "failover"},
+		{Field: "tag", Value: "oncall"},
+		{Field: "title", Value: "db failover"},
+		{Field: "path", Value: "infra/old", Negate: true},
+		{Value: "split brain"},
+		{Field: "modified", Op: ">", Value: "2026-01-01"},
+		{Value: "draft", Negate: true},
+		{Value: "foo:bar"},
+		{Value: "tag:x"},
+	}
+	if !reflect.DeepEqual(q.Clauses, want) {
+		t.Errorf("expected %+v, got %+v", want, q.Clauses)
+	}
+	if q.Simple() {
+		t.Error("expected query with operators not to be simple")
+	}
+	if words := q.Words(); !reflect.DeepEqual(words, []string{"failover", "split brain", "foo:bar", "tag:x"}) {
+		t.Errorf("unexpected words: %v", words)
+	}
+
+	if q, _ := Parse("plain words"); !q.Simple() {
+		t.Error("expected plain words to be simple")
+	}
+	if _, err := Parse("modified:>yesterday"); err == nil {
+		t.Error("expected an error for a bad date")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	contentRead := false
+	doc := &Doc{
+		Name:       "infra/db-failover",
+		Title:      "DB Failover runbook",
+		Tags:       []string{"oncall", "database"},
+		Permission: "public",
+		Created:    time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC),
+		Modified:   time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+		Content: func() string {
+			contentRead = true
+			return "Promote the replica before the split brain sets in."
+		},
+		Authors: func() []string {
+			return []string{"Alice", "bob"}
+		},
+	}
+
+	tests := []struct {
+		query string
+		match bool
+	}{
+		{"tag:oncall", true},
+		{"tag:ONCALL", true},
+		{"tag:call", false},
+		{"-tag:draft", true},
+		{`title:"db failover"`, true},
+		{`title:"failover db"`, false},
+		{"path:infra/", true},
+		{"path:/infra", true},
+		{"-path:infra/", false},
+		{"permission:public", true},
+		{"permission:private", false},
+		{"modified:>2026-01-01", true},
+		{"modified:<2026-01-01", false},
+		{"modified:2026-03-01", true},
+		{"modified:>=2026-03-01", true},
+		{"created:<2026-01-01", true},
+		{"author:alice", true},
+		{"author:carol", false},
+		{"-author:bob", false},
+		{`"split brain"`, true},
+		{`"brain split"`, false},
+		{"replica -witness", true},
+		{"replica -brain", false},
+		{"tag:oncall permission:public replica", true},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.Match(doc); got != test.match {
+			t.Errorf("%s: expected %v, got %v", test.query, test.match, got)
+		}
+	}
+
+	// Content is not read when the metadata already rules the page out
+	contentRead = false
+	q, _ := Parse("replica tag:draft")
+	if q.Match(doc) || contentRead {
+		t.Error("expected content to be left unread")
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Store is where the wiki keeps its pages, along with their history
+// All names are relative to the root of the wiki
+// Diffs are built from FileAt, so they look the same whichever Store is used
+type Store interface {
+	// The checked out files
+	Open(name string) (billy.File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+
+	// Changing the repo
+	Init() error
+	Add(name string) error
+	Remove(name string) error
+	Move(src, dst string) error
+	Commit(author, msg string) error
+	// Restore puts files back as they are at HEAD, in the index and the checked out files
+	// Files which are not at HEAD are removed from both
+	Restore(names ...string) error
+
+	// Syncing with the remote repo
+	Fetch() error
+	Push() error
+	Pull() error
+	Untracked() ([]string, error)
+	Status() error
+
+	// Reading history
+	IsEmpty() bool
+	Head() (string, error)
+	RevisionExists(revision string) bool
+	FileAt(name, revision string) ([]byte, error)
+	FileLog(name string) ([]commitLog, error)
+	FileDeletion(name string) (*commitLog, error)
+	LastCommit(name string) (string, error)
+	Ctime(name string) (int64, error)
+	Mtime(name string) (int64, error)
+	FileTimes() (map[string]fileTimes, error)
+	CommitTime(revision string) (int64, error)
+	ChangedFiles(from, to string) ([]fileChange, error)
+	DeletedFiles() ([]commitLog, error)
+	History() ([]recent, error)
+	Pickaxe(term string, regex bool) ([]commitLog, error)
+	Blame(name string) ([]blameLine, error)
+	LsTree() ([]*gitDirList, error)
+	Grep(term string, names []string, regex bool) ([]result, error)
+}
+
+// newStore returns the Store selected by cfg.Storage
+func newStore(cfg config) (Store, error) {
+	switch cfg.Storage {
+	case "", "git":
+		return newExecStore(cfg), nil
+	case "gogit":
+		return newGoGitStore(cfg), nil
+	case "memory":
+		return newMemoryStore(cfg)
+	}
+	return nil, errors.New("unknown storage backend: " + cfg.Storage)
+}
+
+type commitLog struct {
+	Filename string
+	Commit   string
+	Date     int64
+	Author   string
+	Message  string
+}
+
+type blameLine struct {
+	Commit  string
+	Author  string
+	Date    int64
+	Summary string
+	Num     int
+	Text    string
+}
+
+// fileChange is a file added (A), modified (M), deleted (D), renamed (R) or copied (C) between two commits
+// From is the old name of renamed files, and the original of copies
+type fileChange struct {
+	Status byte
+	Name   string
+	From   string
+}
+
+// fileTimes holds when a file was created and last modified, as UNIX times, and who has changed it
+type fileTimes struct {
+	Ctime int64
+	Mtime int64
+	// Authors is everyone who has changed the file, including before it was moved, most recent first
+	Authors []string
+}
+
+// timesWalk works out the times of every file from the changes made by each commit, newest first
+// Modification times come from the last commit changing each name, as with Mtime
+// Creation times follow files back across moves and copies to where they were first added, as with Ctime
+// Authors are followed back the same way, as with FileLog
+type timesWalk struct {
+	times map[string]fileTimes
+	// seen holds every name changed so far, including those no longer around
+	seen map[string]bool
+	// follow holds the names files had before they were moved or copied, and the files they became
+	follow map[string][]string
+}
+
+func newTimesWalk() *timesWalk {
+	return &timesWalk{
+		times:  make(map[string]fileTimes),
+		seen:   make(map[string]bool),
+		follow: make(map[string][]string),
+	}
+}
+
+// commit records the changes made by the next oldest commit
+func (w *timesWalk) commit(date int64, author string, changes []fileChange) {
+	for _, c := range changes {
+		if !w.seen[c.Name] {
+			w.seen[c.Name] = true
+			// Files which were deleted the last time they changed are gone
+			if c.Status != 'D' {
+				w.times[c.Name] = fileTimes{Mtime: date}
+				w.follow[c.Name] = append(w.follow[c.Name], c.Name)
+			}
+		}
+		// Moved files are gone from their old name
+		if c.Status == 'R' {
+			w.seen[c.From] = true
+		}
+
+		names := w.follow[c.Name]
+		if len(names) == 0 {
+			continue
+		}
+		for _, name := range names {
+			t := w.times[name]
+			if !slices.Contains(t.Authors, author) {
+				t.Authors = append(t.Authors, author)
+				w.times[name] = t
+			}
+		}
+		switch c.Status {
+		case 'A':
+			for _, name := range names {
+				t := w.times[name]
+				t.Ctime = date
+				w.times[name] = t
+			}
+			delete(w.follow, c.Name)
+		case 'R', 'C':
+			delete(w.follow, c.Name)
+			w.follow[c.From] = append(w.follow[c.From], names...)
+		}
+	}
+}
+
+// worktree implements the file half of a Store, on top of a billy filesystem
+type worktree struct {
+	fs billy.Filesystem
+}
+
+func newWorktree(dir string) worktree {
+	return worktree{fs: osfs.New(dir)}
+}
+
+func (t worktree) Open(name string) (billy.File, error) {
+	return t.fs.Open(name)
+}
+
+func (t worktree) Stat(name string) (os.FileInfo, error) {
+	return t.fs.Stat(name)
+}
+
+func (t worktree) ReadFile(name string) ([]byte, error) {
+	return util.ReadFile(t.fs, name)
+}
+
+// WriteFile creates or replaces the given file, creating any directories above it
+func (t worktree) WriteFile(name string, data []byte) error {
+	if dir := path.Dir(name); dir != "." {
+		err := t.fs.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return util.WriteFile(t.fs, name, data, 0666)
+}
+
+// splitAuthor splits an author in the form "Name <email>"
+func splitAuthor(author string) (string, string) {
+	i := strings.LastIndex(author, "<")
+	if i == -1 {
+		return strings.TrimSpace(author), ""
+	}
+	return strings.TrimSpace(author[:i]), strings.TrimSuffix(author[i+1:], ">")
+}
+
+// Check for untracked files, then whether the wiki is in sync with the remote repo
+func (env *wikiEnv) gitIsClean() error {
+	untracked, err := env.store.Untracked()
+	if err != nil {
+		return err
+	}
+	if len(untracked) != 0 {
+		return errors.New(strings.Join(untracked, "\n"))
+	}
+
+	// Fetching changes from remote is left out here; adds a solid second to load times!
+
+	return env.store.Status()
+}
+
+func (env *wikiEnv) gitIsCleanStartup() error {
+	untracked, err := env.store.Untracked()
+	if err != nil {
+		return err
+	}
+	if len(untracked) != 0 {
+		return errors.New("Untracked files: " + strings.Join(untracked, "\n"))
+	}
+
+	if env.cfg.RemoteGitRepo != "" {
+		// Fetch changes from remote
+		err = env.store.Fetch()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch err := env.store.Status(); err {
+	case errGitBehind:
+		log.Debugln("gitIsCleanStartup: Pulling git repo...")
+		return env.store.Pull()
+	case errGitAhead:
+		if env.cfg.PushOnSave {
+			log.Debugln("gitIsCleanStartup: Pushing git repo...")
+			return env.store.Push()
+		}
+		return nil
+	default:
+		return err
+	}
+}
+
+// File creation and modification times, output to UNIX time
+func (env *wikiEnv) gitGetTimes(filename string, ctime, mtime chan<- int64) {
+
+	go func() {
+		ctimeI, err := env.store.Ctime(filename)
+		if err != nil {
+			log.Println(filename, err)
+			ctime <- 0
+			return
+		}
+		ctime <- ctimeI
+	}()
+
+	go func() {
+		mtimeI, err := env.store.Mtime(filename)
+		if err != nil {
+			log.Println(filename, err)
+			mtime <- 0
+			return
+		}
+		mtime <- mtimeI
+	}()
+
+}
+
+// Search results, via the Store
+// Content matches come first, then matching filenames
+// searchTerm is taken literally, unless regex is set
+func (env *wikiEnv) gitSearch(searchTerm string, names []string, regex bool) []result {
+	results, err := env.store.Grep(searchTerm, names, regex)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"term":  searchTerm,
+			"error": err,
+		}).Errorln("Error searching wiki")
+		return nil
+	}
+
+	// Check for matching filenames
+	matches := func(name string) bool {
+		return strings.Contains(name, searchTerm)
+	}
+	if regex {
+		pattern, err := regexp.Compile("(?i)" + searchTerm)
+		if err != nil {
+			return results
+		}
+		matches = pattern.MatchString
+	}
+	for _, v := range names {
+		if matches(v) {
+			results = append(results, result{
+				Name: v,
+			})
+		}
+	}
+
+	return results
+}
+
+func (env *wikiEnv) gitIsCleanURLs(token string) template.HTML {
+	switch env.gitIsClean() {
+	case errGitAhead:
+		return template.HTML(`<form method="post" action="/admin/git/push" id="git_push"><input type="hidden" name="csrf_token" value="` + token + `"><i class="fa fa-cloud-upload" aria-hidden="true"></i><button type="submit" class="button">Push git</button></form>`)
+	case errGitBehind:
+		return template.HTML(`<form method="post" action="/admin/git/pull" id="git_pull"><input type="hidden" name="csrf_token" value="` + token + `"><i class="fa fa-cloud-download" aria-hidden="true"></i><button type="submit" class="button">Pull git</button></form>`)
+	case errGitDiverged:
+		return template.HTML(`<a href="/admin/git"><i class="fa fa-exclamation-triangle" aria-hidden="true"></i>Issue with git:wiki!</a>`)
+	default:
+		return template.HTML(`Git repo is clean.`)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchDelay is how long changes have to settle down before the wiki catches up with them
+const watchDelay = 500 * time.Millisecond
+
+const defaultWatchCommitMessage = "Committing files changed outside the wiki."
+
+// watcher notices changes made outside the wiki, such as files edited in WikiDir, or commits pushed to the repo
+// Everything is handled by a single goroutine, so changed needs no locking
+type watcher struct {
+	env  *wikiEnv
+	fsw  *fsnotify.Watcher
+	done chan struct{}
+	// changed holds the files changed since the wiki last caught up
+	changed map[string]bool
+}
+
+// watchWiki starts watching the working tree and .git/refs for changes
+// The cache is brought up to date after every change, and if WatchCommit is set, files changed outside the wiki are committed
+func (env *wikiEnv) watchWiki() (*watcher, error) {
+	if env.cfg.Storage == "memory" {
+		return nil, errors.New("in-memory wikis cannot be changed from outside, so there is nothing to watch")
+	}
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		env:     env,
+		fsw:     fsw,
+		done:    make(chan struct{}),
+		changed: make(map[string]bool),
+	}
+	for _, root := range []string{env.cfg.WikiDir, filepath.Join(env.cfg.WikiDir, ".git", "refs")} {
+		err = w.addTree(root, false)
+		if err != nil {
+			fsw.Close()
+			return nil, err
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching, and waits for any refresh still going on to finish
+func (w *watcher) Close() error {
+	err := w.fsw.Close()
+	<-w.done
+	return err
+}
+
+// addTree watches a directory and every directory under it, as fsnotify only watches a single directory
+// For new directories, mark is set so files created before the directory was watched are not missed
+// .git is left out, apart from .git/refs which is watched on its own
+func (w *watcher) addTree(root string, mark bool) error {
+	return filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			if mark {
+				w.mark(name)
+			}
+			return nil
+		}
+		if d.Name() == ".git" && name != root {
+			return filepath.SkipDir
+		}
+		return w.fsw.Add(name)
+	})
+}
+
+// mark records a file in the working tree as changed
+// Hidden files and editor backups are left alone, so swap files are never committed
+func (w *watcher) mark(name string) {
+	rel, err := filepath.Rel(w.env.cfg.WikiDir, name)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".git" || strings.HasPrefix(rel, ".git/") {
+		return
+	}
+	base := path.Base(rel)
+	if strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") {
+		return
+	}
+	w.changed[rel] = true
+}
+
+func (w *watcher) run() {
+	defer close(w.done)
+	timer := time.NewTimer(watchDelay)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) && isDir(event.Name) {
+				err := w.addTree(event.Name, true)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"dir":   event.Name,
+						"error": err,
+					}).Errorln("Unable to watch new directory")
+				}
+			} else {
+				w.mark(event.Name)
+			}
+			timer.Reset(watchDelay)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorln("Error watching wiki")
+		case <-timer.C:
+			w.refresh()
+		}
+	}
+}
+
+// refresh commits any files changed outside the wiki if WatchCommit is set, then brings the cache up to date
+func (w *watcher) refresh() {
+	if w.env.cfg.WatchCommit && len(w.changed) != 0 {
+		names := make([]string, 0, len(w.changed))
+		for name := range w.changed {
+			names = append(names, name)
+		}
+		err := w.env.commitExternal(names)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"files": names,
+				"error": err,
+			}).Errorln("Unable to commit files changed outside the wiki")
+		}
+	}
+	w.changed = make(map[string]bool)
+	w.env.refreshCache()
+}
+
+func isDir(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
+
+// commitExternal commits any of the given files which differ from HEAD, having been changed outside the wiki
+// Files saved through the wiki are already committed by the time the lock is taken, so they are left alone
+func (env *wikiEnv) commitExternal(names []string) error {
+	env.pageWriteLock.Lock()
+	defer env.pageWriteLock.Unlock()
+
+	tracked := make(map[string]bool)
+	if !env.store.IsEmpty() {
+		fileList, err := env.store.LsTree()
+		if err != nil {
+			return err
+		}
+		for _, file := range fileList {
+			if file.Type == "blob" {
+				tracked[file.Filename] = true
+			}
+		}
+	}
+
+	var committed []string
+	for _, name := range names {
+		if isDir(filepath.Join(env.cfg.WikiDir, name)) {
+			continue
+		}
+		current, err := env.store.ReadFile(name)
+		switch {
+		case err != nil && tracked[name]:
+			err = env.store.Remove(name)
+		case err != nil:
+			continue
+		case tracked[name]:
+			var previous []byte
+			previous, err = env.store.FileAt(name, "HEAD")
+			if err == nil && bytes.Equal(current, previous) {
+				continue
+			}
+			err = env.store.Add(name)
+		default:
+			err = env.store.Add(name)
+		}
+		if err != nil {
+			return err
+		}
+		committed = append(committed, name)
+	}
+	if len(committed) == 0 {
+		return nil
+	}
+
+	msg := env.cfg.WatchCommitMessage
+	if msg == "" {
+		msg = defaultWatchCommitMessage
+	}
+	err := env.store.Commit("", msg)
+	if err != nil {
+		return err
+	}
+	log.Println("Committed files changed outside the wiki:", strings.Join(committed, ", "))
+	return nil
+}
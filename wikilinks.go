@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"html"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~aqtrans/gowiki/render"
+)
+
+// pageExtensions are tried in turn when a page is asked for without an extension
+var pageExtensions = []string{".md", ".page"}
+
+var (
+	nameSeparators = regexp.MustCompile(`[ &_=+:]`)
+	nameDashes     = regexp.MustCompile(`[\-]+`)
+)
+
+// normalizeName lowercases a page name, and turns spaces and other separators into single dashes
+func normalizeName(name string) string {
+	name = strings.ToLower(name)
+	name = nameSeparators.ReplaceAllString(name, "-")
+	return nameDashes.ReplaceAllString(name, "-")
+}
+
+// wikiLinkPattern matches [[Page Name]] and [[path/page|label]] links
+var wikiLinkPattern = regexp.MustCompile(`\[\[([^\[\]|]+)(?:\|([^\[\]]+))?\]\]`)
+
+// index lists every page and directory in the cache along with its permission, so links can be checked without going to disk
+// namesID changes along with the list, so pages rendered before a page was created or deleted are not reused
+// Backlinks are worked out from Links here too, as which page a link points at depends on which pages exist
+func (c *wikiCache) index() {
+	c.names = make(map[string]string, len(c.Cache))
+	names := make([]string, 0, len(c.Cache))
+	for _, v := range c.Cache {
+		c.names[v.Filename] = v.Permission
+		names = append(names, v.Filename)
+	}
+	sort.Strings(names)
+	h := sha1.Sum([]byte(strings.Join(names, "\n")))
+	c.namesID = hex.EncodeToString(h[:4])
+	c.indexBacklinks()
+}
+
+// resolve finds the page a link points at, as checkName would
+// Names without an extension are tried with .md and .page, then normalized as by normalizeName
+// Missing pages are given the normalized name, so following the link creates a tidily named page
+func (c *wikiCache) resolve(name string) (string, bool) {
+	return c.resolveListed(name, true, true)
+}
+
+// resolveListed is resolve, counting only the pages listed to the given viewer as existing
+// Otherwise red links would give away which private pages there are, to those not allowed to see them
+func (c *wikiCache) resolveListed(name string, isLoggedIn, isAdmin bool) (string, bool) {
+	exists := func(name string) bool {
+		permission, ok := c.names[name]
+		return ok && permissionListed(permission, isLoggedIn, isAdmin)
+	}
+	name = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(name), "/"))
+	if exists(name) {
+		return name, true
+	}
+	if filepath.Ext(name) == "" {
+		for _, ext := range pageExtensions {
+			if exists(name + ext) {
+				return name + ext, true
+			}
+		}
+	}
+	normalName := normalizeName(name)
+	return normalName, exists(normalName)
+}
+
+// resolveLink finds the page a [[wikilink]] points at from the cache, for a viewer of the given permissionClass
+// If the cache has not been built yet, every page is assumed to exist
+func (env *wikiEnv) resolveLink(name, class string) (string, bool) {
+	env.cacheLock.Lock()
+	c := env.cache
+	env.cacheLock.Unlock()
+	if c.names == nil {
+		return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(name), "/")), true
+	}
+	return c.resolveListed(name, class != "anonymous", class == adminPermission)
+}
+
+// linkResolver returns resolveLink for a viewer of the given permissionClass, for the goldmark renderer
+func (env *wikiEnv) linkResolver(class string) render.Resolver {
+	return func(name string) (string, bool) {
+		return env.resolveLink(name, class)
+	}
+}
+
+// pageSetID identifies which pages exist, as red links depend on it; empty if the cache has not been built
+func (env *wikiEnv) pageSetID() string {
+	env.cacheLock.Lock()
+	defer env.cacheLock.Unlock()
+	return env.cache.namesID
+}
+
+// wikiLinkHTML returns a link to the given page, marked as a new page if it does not exist yet for the given permissionClass
+func (env *wikiEnv) wikiLinkHTML(name, label, class string) string {
+	target, exists := env.resolveLink(name, class)
+	if label == "" {
+		label = strings.TrimSpace(name)
+	}
+	href := (&url.URL{Path: "/" + target}).String()
+	attrs := ""
+	if !exists {
+		attrs = ` class="new-page"`
+	}
+	return `<a href="` + html.EscapeString(href) + `"` + attrs + `>` + html.EscapeString(label) + `</a>`
+}
+
+// wikiLinks turns [[wikilinks]] left in a page rendered by blackfriday into links
+// blackfriday hands text to NormalText a bit at a time, so they can only be found once the page is rendered
+// Code, preformatted text and existing links are left alone
+func (env *wikiEnv) wikiLinks(rendered, class string) string {
+	if !strings.Contains(rendered, "[[") {
+		return rendered
+	}
+	var out strings.Builder
+	skip := 0
+	for rendered != "" {
+		i := strings.IndexByte(rendered, '<')
+		if i == -1 {
+			i = len(rendered)
+		}
+		text := rendered[:i]
+		if skip == 0 {
+			text = wikiLinkPattern.ReplaceAllStringFunc(text, func(m string) string {
+				sub := wikiLinkPattern.FindStringSubmatch(m)
+				return env.wikiLinkHTML(html.UnescapeString(sub[1]), html.UnescapeString(sub[2]), class)
+			})
+		}
+		out.WriteString(text)
+		rendered = rendered[i:]
+		if rendered == "" {
+			break
+		}
+
+		j := strings.IndexByte(rendered, '>')
+		if j == -1 {
+			j = len(rendered) - 1
+		}
+		tag := rendered[:j+1]
+		switch tagName(tag) {
+		case "code", "pre", "a", "script", "style":
+			skip++
+		case "/code", "/pre", "/a", "/script", "/style":
+			if skip > 0 {
+				skip--
+			}
+		}
+		out.WriteString(tag)
+		rendered = rendered[j+1:]
+	}
+	return out.String()
+}
+
+// tagName returns the lowercased name of an HTML tag, starting with / for closing tags
+func tagName(tag string) string {
+	tag = strings.TrimPrefix(tag, "<")
+	end := strings.IndexAny(tag, " \t\n/>")
+	if strings.HasPrefix(tag, "/") {
+		end = strings.IndexAny(tag[1:], " \t\n>")
+		if end != -1 {
+			end++
+		}
+	}
+	if end == -1 {
+		end = len(tag)
+	}
+	return strings.ToLower(tag[:end])
+}